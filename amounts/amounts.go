@@ -0,0 +1,107 @@
+package amounts
+
+// Most stages only need the amount (sats) of each txo, block by block. Reading them from the chain means
+// following handles through blocks, transactions and txos, every stage, every pass. A Source serves them
+// either straight from the chain (ChainSource) or from a compact file written once (see Extract). The same
+// goes for the fees of each transaction (see fees.go).
+
+import (
+	"errors"
+	"github.com/KitchenMishap/pudding-shed/chainreadinterface"
+)
+
+// Block is the amounts of the outputs of a block's transactions
+type Block struct {
+	Height     int64
+	FirstTrans int64     // Height (in the whole chain) of the block's first transaction
+	FirstTxos  []int64   // For each transaction in the block, the height (in the whole chain) of its first txo
+	Trans      [][]int64 // For each transaction in the block, the sats of each of its outputs
+}
+
+// TransHeight is the height (in the whole chain) of the block's t'th transaction
+func (b *Block) TransHeight(t int) int64 {
+	return b.FirstTrans + int64(t)
+}
+
+// FirstTxo is the height (in the whole chain) of the block's first txo
+func (b *Block) FirstTxo() int64 {
+	if len(b.FirstTxos) == 0 {
+		return 0
+	}
+	return b.FirstTxos[0]
+}
+
+// Source serves the amounts of a chain, block by block. Block and BlockFees are threadsafe.
+type Source interface {
+	Blocks() int64
+	Block(height int64) (*Block, error)
+	BlockFees(height int64) ([]int64, error) // For each transaction in the block (see ChainSource.BlockFees)
+}
+
+// ChainSource reads the amounts straight from the chain
+type ChainSource struct {
+	chain   chainreadinterface.IBlockChain
+	handles chainreadinterface.IHandleCreator
+	blocks  int64
+}
+
+func NewChainSource(chain chainreadinterface.IBlockChain, handles chainreadinterface.IHandleCreator) (*ChainSource, error) {
+	latestBlock, err := chain.LatestBlock()
+	if err != nil {
+		return nil, err
+	}
+	return &ChainSource{chain: chain, handles: handles, blocks: latestBlock.Height() + 1}, nil
+}
+
+func (cs *ChainSource) Blocks() int64 {
+	return cs.blocks
+}
+
+func (cs *ChainSource) Block(height int64) (*Block, error) {
+	blockHandle, err := cs.handles.BlockHandleByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	block, err := cs.chain.BlockInterface(blockHandle)
+	if err != nil {
+		return nil, err
+	}
+	tCount, err := block.TransactionCount()
+	if err != nil {
+		return nil, err
+	}
+	result := Block{Height: height, FirstTxos: make([]int64, tCount), Trans: make([][]int64, tCount)}
+	for t := int64(0); t < tCount; t++ {
+		transHandle, err := block.NthTransaction(t)
+		if err != nil {
+			return nil, err
+		}
+		trans, err := cs.chain.TransInterface(transHandle)
+		if err != nil {
+			return nil, err
+		}
+		txoAmounts, err := trans.AllTxoSatoshis()
+		if err != nil {
+			return nil, err
+		}
+		result.Trans[t] = txoAmounts
+		if t == 0 {
+			// The rest of the block's transaction and txo heights follow on from the first's
+			if !transHandle.HeightSpecified() {
+				return nil, errors.New("transaction height not specified")
+			}
+			result.FirstTrans = transHandle.Height()
+			txoHandle, err := trans.NthTxo(0) // A coinbase always has an output
+			if err != nil {
+				return nil, err
+			}
+			if !txoHandle.TxoHeightSpecified() {
+				return nil, errors.New("txo height not specified")
+			}
+			result.FirstTxos[0] = txoHandle.TxoHeight()
+		} else {
+			result.FirstTxos[t] = result.FirstTxos[t-1] + int64(len(result.Trans[t-1]))
+		}
+	}
+	return &result, nil
+}
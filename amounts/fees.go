@@ -0,0 +1,120 @@
+package amounts
+
+// Fees aren't in the chain: they are what a transaction's inputs (the txos it spends) add up to, less its
+// outputs. So working them out means a random-access lookup of every input's source txo. Extract does that
+// once, into the fees column; the compression simulation needs them every pass.
+
+import (
+	"errors"
+	"fmt"
+	"github.com/KitchenMishap/pudding-shed/chainreadinterface"
+)
+
+const SATS_PER_BTC = 100000000
+const HALVING_INTERVAL = 210000
+
+// ErrCoinbaseNotFirst is when a block's coinbase isn't its first transaction (the fees assume it is)
+var ErrCoinbaseNotFirst = errors.New("coinbase is not the first transaction of the block")
+
+// BlockSubsidy is the number of newly minted sats a block at the given height may claim
+func BlockSubsidy(height int64) int64 {
+	halvings := height / HALVING_INTERVAL
+	if halvings >= 64 {
+		return 0
+	}
+	return (50 * SATS_PER_BTC) >> uint(halvings)
+}
+
+// TransactionInputTotal adds up the amounts of the txos spent by a transaction's inputs.
+// A coinbase has no inputs (see chainreadinterface), so it gives zero and isCoinbase.
+func TransactionInputTotal(chain chainreadinterface.IBlockChain, trans chainreadinterface.ITransaction) (total int64, isCoinbase bool, err error) {
+	txiCount, err := trans.TxiCount()
+	if err != nil {
+		return 0, false, err
+	}
+	if txiCount == 0 {
+		return 0, true, nil
+	}
+	for i := int64(0); i < txiCount; i++ {
+		txiHandle, err := trans.NthTxi(i)
+		if err != nil {
+			return 0, false, err
+		}
+		txi, err := chain.TxiInterface(txiHandle)
+		if err != nil {
+			return 0, false, err
+		}
+		txoHandle, err := txi.SourceTxo()
+		if err != nil {
+			return 0, false, err
+		}
+		txo, err := chain.TxoInterface(txoHandle)
+		if err != nil {
+			return 0, false, err
+		}
+		sats, err := txo.Satoshis()
+		if err != nil {
+			return 0, false, err
+		}
+		total += sats
+	}
+	return total, false, nil
+}
+
+// BlockFees works out the fees of each transaction in a block from its inputs. The coinbase (the first
+// transaction) claims the subsidy plus all the other transactions' fees, so its "fees" are whatever the miner
+// didn't claim (almost always zero).
+func (cs *ChainSource) BlockFees(height int64) ([]int64, error) {
+	blockHandle, err := cs.handles.BlockHandleByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	block, err := cs.chain.BlockInterface(blockHandle)
+	if err != nil {
+		return nil, err
+	}
+	tCount, err := block.TransactionCount()
+	if err != nil {
+		return nil, err
+	}
+	fees := make([]int64, tCount)
+	blockFees := int64(0)
+	for t := int64(0); t < tCount; t++ {
+		transHandle, err := block.NthTransaction(t)
+		if err != nil {
+			return nil, err
+		}
+		trans, err := cs.chain.TransInterface(transHandle)
+		if err != nil {
+			return nil, err
+		}
+		txoAmounts, err := trans.AllTxoSatoshis()
+		if err != nil {
+			return nil, err
+		}
+		inputTotal, isCoinbase, err := TransactionInputTotal(cs.chain, trans)
+		if err != nil {
+			return nil, err
+		}
+		if isCoinbase != (t == 0) {
+			return nil, fmt.Errorf("block %d transaction %d: %w", height, t, ErrCoinbaseNotFirst)
+		}
+		fees[t] = inputTotal - outputsTotal(txoAmounts)
+		if t > 0 {
+			blockFees += fees[t]
+		}
+	}
+	if tCount > 0 {
+		// The coinbase's "input" is the subsidy plus the fees
+		fees[0] += BlockSubsidy(height) + blockFees
+	}
+	return fees, nil
+}
+
+func outputsTotal(outputs []int64) int64 {
+	total := int64(0)
+	for _, sats := range outputs {
+		total += sats
+	}
+	return total
+}
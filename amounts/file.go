@@ -0,0 +1,413 @@
+package amounts
+
+// The amounts file is a folder of columns:
+//	index   For each block (and finally one past the last), five little endian uint64s: its first transaction
+//	        height, its first txo height, and where its entries start in the counts, sats and fees columns
+//	counts  For each transaction, the number of its outputs (uvarint)
+//	sats    For each txo, its amount (varint)
+//	fees    For each transaction, its fees (varint, see ChainSource.BlockFees)
+//	header  (JSON) The version, and how many blocks are in the columns. Written last, so it never counts a block
+//	        whose columns weren't completely written.
+// The block height, transaction index and output index of each txo aren't stored; they follow from the index
+// and counts columns.
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/KitchenMishap/pudding-huffman/progress"
+	"github.com/KitchenMishap/pudding-shed/chainreadinterface"
+	"golang.org/x/sync/errgroup"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// VERSION changes whenever the columns change, so that an older file is written again rather than misread
+const VERSION = 2
+
+const INDEX_RECORD_BYTES = 5 * 8
+
+// EXTRACT_BATCH_BLOCKS is how many blocks each worker encodes between writes
+const EXTRACT_BATCH_BLOCKS = 64
+
+type header struct {
+	Version int
+	Blocks  int64
+}
+
+// indexRecord is a block's entry in the index column
+type indexRecord struct {
+	FirstTrans   int64
+	FirstTxo     int64
+	CountsOffset int64
+	SatsOffset   int64
+	FeesOffset   int64
+}
+
+// File serves amounts from an amounts file (see Extract)
+type File struct {
+	blocks int64
+	index  *os.File
+	counts *os.File
+	sats   *os.File
+	fees   *os.File
+}
+
+func columnFilenames(folder string) (string, string, string, string, string) {
+	return filepath.Join(folder, "header"), filepath.Join(folder, "index"), filepath.Join(folder, "counts"), filepath.Join(folder, "sats"),
+		filepath.Join(folder, "fees")
+}
+
+func readHeader(filename string) (header, error) {
+	var h header
+	bytes, err := os.ReadFile(filename)
+	if err != nil {
+		return h, err
+	}
+	err = json.Unmarshal(bytes, &h)
+	return h, err
+}
+
+// Extract brings the amounts file in a folder up to date with the chain, and opens it. Blocks already in the
+// file (from a run when the chain was shorter, or one that was interrupted) aren't read again. If the file is
+// from another version, or has more blocks than the chain, it is written again from scratch. If ctx is
+// cancelled, the blocks extracted so far are kept (for next time) and ctx's error is returned.
+func Extract(ctx context.Context, chain chainreadinterface.IBlockChain, handles chainreadinterface.IHandleCreator, folder string,
+	numWorkers int, reporter *progress.Reporter) (*File, error) {
+	source, err := NewChainSource(chain, handles)
+	if err != nil {
+		return nil, err
+	}
+	blocks := source.Blocks()
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return nil, err
+	}
+	headerFilename, indexFilename, countsFilename, satsFilename, feesFilename := columnFilenames(folder)
+
+	// How far did an earlier extraction get?
+	start := int64(0)
+	h, err := readHeader(headerFilename)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Printf("\tAmounts header is unreadable (%s), extracting again\n", err.Error())
+	} else if err == nil && h.Version == VERSION && h.Blocks <= blocks {
+		start = h.Blocks
+	}
+	if start == blocks {
+		fmt.Printf("\tAmounts of all %d blocks already extracted\n", blocks)
+		return OpenFile(folder)
+	}
+
+	stage := reporter.Start("Extracting amounts (PARALLEL by block)", blocks-start)
+	defer stage.Finish()
+	fmt.Printf("\tBlocks %d to %d\n", start, blocks-1)
+
+	index, err := os.OpenFile(indexFilename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer index.Close()
+	counts, err := os.OpenFile(countsFilename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer counts.Close()
+	sats, err := os.OpenFile(satsFilename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer sats.Close()
+	fees, err := os.OpenFile(feesFilename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer fees.Close()
+
+	// Carry on from the end of the last block in the header (anything after that is half written)
+	next := indexRecord{}
+	if start > 0 {
+		if next, err = readIndexRecord(index, start); err != nil {
+			return nil, err
+		}
+	}
+	if err := index.Truncate(start * INDEX_RECORD_BYTES); err != nil {
+		return nil, err
+	}
+	if err := counts.Truncate(next.CountsOffset); err != nil {
+		return nil, err
+	}
+	if err := sats.Truncate(next.SatsOffset); err != nil {
+		return nil, err
+	}
+	if err := fees.Truncate(next.FeesOffset); err != nil {
+		return nil, err
+	}
+
+	// Each batch of blocks is encoded in parallel, then written in order
+	type encodedBlock struct {
+		firstTrans int64
+		firstTxo   int64
+		counts     []byte
+		sats       []byte
+		fees       []byte
+	}
+	batchBlocks := int64(numWorkers * EXTRACT_BATCH_BLOCKS)
+	batch := make([]encodedBlock, batchBlocks)
+	indexBytes := make([]byte, 0, batchBlocks*INDEX_RECORD_BYTES)
+	extracted := start // Blocks completely written
+	for batchStart := start; batchStart < blocks && ctx.Err() == nil; batchStart += batchBlocks {
+		batchEnd := min(batchStart+batchBlocks, blocks)
+
+		g, batchCtx := errgroup.WithContext(ctx)
+		g.SetLimit(numWorkers)
+		for height := batchStart; height < batchEnd; height++ {
+			g.Go(func() error {
+				if err := batchCtx.Err(); err != nil {
+					return err
+				}
+				block, err := source.Block(height)
+				if err != nil {
+					return err
+				}
+				blockFees, err := source.BlockFees(height)
+				if err != nil {
+					return err
+				}
+				encoded := encodedBlock{firstTrans: block.FirstTrans, firstTxo: block.FirstTxo()}
+				for t, txoAmounts := range block.Trans {
+					encoded.counts = binary.AppendUvarint(encoded.counts, uint64(len(txoAmounts)))
+					for _, amount := range txoAmounts {
+						encoded.sats = binary.AppendVarint(encoded.sats, amount)
+					}
+					encoded.fees = binary.AppendVarint(encoded.fees, blockFees[t])
+				}
+				batch[height-batchStart] = encoded
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			if ctx.Err() != nil {
+				break // Interrupted, so keep the batches before this one (not a worker's own error)
+			}
+			return nil, err
+		}
+
+		indexBytes = indexBytes[:0]
+		for i := range batch[:batchEnd-batchStart] {
+			next.FirstTrans = batch[i].firstTrans
+			next.FirstTxo = batch[i].firstTxo
+			indexBytes = next.append(indexBytes)
+			if _, err := counts.WriteAt(batch[i].counts, next.CountsOffset); err != nil {
+				return nil, err
+			}
+			if _, err := sats.WriteAt(batch[i].sats, next.SatsOffset); err != nil {
+				return nil, err
+			}
+			if _, err := fees.WriteAt(batch[i].fees, next.FeesOffset); err != nil {
+				return nil, err
+			}
+			next.CountsOffset += int64(len(batch[i].counts))
+			next.SatsOffset += int64(len(batch[i].sats))
+			next.FeesOffset += int64(len(batch[i].fees))
+			// Where the next block's transactions and txos would start
+			next.FirstTrans += int64(decodedCount(batch[i].counts))
+			next.FirstTxo += int64(decodedTotal(batch[i].counts))
+		}
+		if _, err := index.WriteAt(indexBytes, batchStart*INDEX_RECORD_BYTES); err != nil {
+			return nil, err
+		}
+		extracted = batchEnd
+		stage.Add(batchEnd - batchStart)
+	}
+
+	// The record one past the last block, then the header, once everything else is safely written
+	if _, err := index.WriteAt(next.append(nil), extracted*INDEX_RECORD_BYTES); err != nil {
+		return nil, err
+	}
+	for _, f := range []*os.File{index, counts, sats, fees} {
+		if err := f.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	headerBytes, err := json.Marshal(header{Version: VERSION, Blocks: extracted})
+	if err != nil {
+		return nil, err
+	}
+	temp := headerFilename + ".tmp"
+	if err := os.WriteFile(temp, headerBytes, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(temp, headerFilename); err != nil {
+		return nil, err
+	}
+
+	stage.Finish()
+	if err := ctx.Err(); err != nil {
+		fmt.Printf("\tInterrupted, with the amounts of %d blocks extracted\n", extracted)
+		return nil, err
+	}
+	return OpenFile(folder)
+}
+
+// decodedCount is the number of uvarints in a column
+func decodedCount(column []byte) int {
+	count := 0
+	for _, b := range column {
+		if b < 0x80 {
+			count++ // The last byte of each uvarint
+		}
+	}
+	return count
+}
+
+// decodedTotal is the sum of the uvarints in a column
+func decodedTotal(column []byte) uint64 {
+	total := uint64(0)
+	for len(column) > 0 {
+		value, n := binary.Uvarint(column)
+		total += value
+		column = column[n:]
+	}
+	return total
+}
+
+func (r indexRecord) append(bytes []byte) []byte {
+	bytes = binary.LittleEndian.AppendUint64(bytes, uint64(r.FirstTrans))
+	bytes = binary.LittleEndian.AppendUint64(bytes, uint64(r.FirstTxo))
+	bytes = binary.LittleEndian.AppendUint64(bytes, uint64(r.CountsOffset))
+	bytes = binary.LittleEndian.AppendUint64(bytes, uint64(r.SatsOffset))
+	bytes = binary.LittleEndian.AppendUint64(bytes, uint64(r.FeesOffset))
+	return bytes
+}
+
+func readIndexRecord(index *os.File, height int64) (indexRecord, error) {
+	bytes := make([]byte, INDEX_RECORD_BYTES)
+	if _, err := index.ReadAt(bytes, height*INDEX_RECORD_BYTES); err != nil {
+		return indexRecord{}, fmt.Errorf("amounts index, block %d: %w", height, err)
+	}
+	return indexRecord{
+		FirstTrans:   int64(binary.LittleEndian.Uint64(bytes[0:])),
+		FirstTxo:     int64(binary.LittleEndian.Uint64(bytes[8:])),
+		CountsOffset: int64(binary.LittleEndian.Uint64(bytes[16:])),
+		SatsOffset:   int64(binary.LittleEndian.Uint64(bytes[24:])),
+		FeesOffset:   int64(binary.LittleEndian.Uint64(bytes[32:])),
+	}, nil
+}
+
+// OpenFile opens an amounts file written by Extract
+func OpenFile(folder string) (*File, error) {
+	headerFilename, indexFilename, countsFilename, satsFilename, feesFilename := columnFilenames(folder)
+	h, err := readHeader(headerFilename)
+	if err != nil {
+		return nil, err
+	}
+	if h.Version != VERSION {
+		return nil, fmt.Errorf("amounts file %s is version %d, not %d", folder, h.Version, VERSION)
+	}
+	f := File{blocks: h.Blocks}
+	if f.index, err = os.Open(indexFilename); err != nil {
+		return nil, err
+	}
+	if f.counts, err = os.Open(countsFilename); err != nil {
+		f.index.Close()
+		return nil, err
+	}
+	if f.sats, err = os.Open(satsFilename); err != nil {
+		f.index.Close()
+		f.counts.Close()
+		return nil, err
+	}
+	if f.fees, err = os.Open(feesFilename); err != nil {
+		f.index.Close()
+		f.counts.Close()
+		f.sats.Close()
+		return nil, err
+	}
+	return &f, nil
+}
+
+func (f *File) Close() error {
+	return errors.Join(f.index.Close(), f.counts.Close(), f.sats.Close(), f.fees.Close())
+}
+
+func (f *File) Blocks() int64 {
+	return f.blocks
+}
+
+// Block reads a block's amounts. (ReadAt is threadsafe, so Block is too.)
+func (f *File) Block(height int64) (*Block, error) {
+	if height < 0 || height >= f.blocks {
+		return nil, fmt.Errorf("block %d not in the amounts file", height)
+	}
+	first, err := readIndexRecord(f.index, height)
+	if err != nil {
+		return nil, err
+	}
+	end, err := readIndexRecord(f.index, height+1)
+	if err != nil {
+		return nil, err
+	}
+	countBytes := make([]byte, end.CountsOffset-first.CountsOffset)
+	if _, err := f.counts.ReadAt(countBytes, first.CountsOffset); err != nil {
+		return nil, err
+	}
+	satsBytes := make([]byte, end.SatsOffset-first.SatsOffset)
+	if _, err := f.sats.ReadAt(satsBytes, first.SatsOffset); err != nil {
+		return nil, err
+	}
+
+	tCount := end.FirstTrans - first.FirstTrans
+	all := make([]int64, end.FirstTxo-first.FirstTxo) // One allocation for the amounts of all the transactions
+	result := Block{Height: height, FirstTrans: first.FirstTrans, FirstTxos: make([]int64, tCount), Trans: make([][]int64, tCount)}
+	txo := int64(0)
+	for t := range result.Trans {
+		count, n := binary.Uvarint(countBytes)
+		if n <= 0 || txo+int64(count) > int64(len(all)) {
+			return nil, fmt.Errorf("amounts file is corrupt at block %d", height)
+		}
+		countBytes = countBytes[n:]
+		result.FirstTxos[t] = first.FirstTxo + txo
+		result.Trans[t] = all[txo : txo+int64(count) : txo+int64(count)]
+		for i := range result.Trans[t] {
+			amount, n := binary.Varint(satsBytes)
+			if n <= 0 {
+				return nil, fmt.Errorf("amounts file is corrupt at block %d", height)
+			}
+			satsBytes = satsBytes[n:]
+			result.Trans[t][i] = amount
+		}
+		txo += int64(count)
+	}
+	return &result, nil
+}
+
+// BlockFees reads the fees of a block's transactions (see ChainSource.BlockFees)
+func (f *File) BlockFees(height int64) ([]int64, error) {
+	if height < 0 || height >= f.blocks {
+		return nil, fmt.Errorf("block %d not in the amounts file", height)
+	}
+	first, err := readIndexRecord(f.index, height)
+	if err != nil {
+		return nil, err
+	}
+	end, err := readIndexRecord(f.index, height+1)
+	if err != nil {
+		return nil, err
+	}
+	feesBytes := make([]byte, end.FeesOffset-first.FeesOffset)
+	if _, err := f.fees.ReadAt(feesBytes, first.FeesOffset); err != nil {
+		return nil, err
+	}
+	fees := make([]int64, end.FirstTrans-first.FirstTrans)
+	for t := range fees {
+		fee, n := binary.Varint(feesBytes)
+		if n <= 0 {
+			return nil, fmt.Errorf("amounts file is corrupt at block %d", height)
+		}
+		feesBytes = feesBytes[n:]
+		fees[t] = fee
+	}
+	return fees, nil
+}
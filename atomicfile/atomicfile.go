@@ -0,0 +1,30 @@
+package atomicfile
+
+// Output files are written under another name then renamed (as checkpoint.Save does), so that a run that
+// stops part way through leaves the previous file (if any) intact, never half written.
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Write creates (or replaces) a file with whatever write writes to it. If write (or closing the file) fails,
+// the file is left as it was.
+func Write(filename string, write func(f io.Writer) error) error {
+	temp := filename + ".tmp"
+	f, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp)
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	return os.Rename(temp, filename)
+}
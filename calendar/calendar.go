@@ -0,0 +1,256 @@
+package calendar
+
+// Epochs and micro-epochs are runs of consecutive blocks that share statistics (celebrity tables, fiat peaks).
+// They can be fixed block counts (the old way, 144*28 blocks being "roughly a month") or real calendar
+// periods (UTC day, week or month) worked out from the block timestamps.
+
+import (
+	"errors"
+	"fmt"
+	"github.com/KitchenMishap/pudding-shed/chainreadinterface"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Period int
+
+const (
+	BLOCKS Period = iota // A fixed number of blocks
+	DAY                  // UTC day
+	WEEK                 // UTC week, Monday to Sunday (as ISO 8601)
+	MONTH                // UTC calendar month
+)
+
+// TIME_FIELD is the block field that calendar periods are worked out from. Unlike "time", the median time
+// never goes backwards, so each period is a single run of blocks. It lags "time" by about an hour.
+const TIME_FIELD = "mediantime"
+
+// Spec says how to cut the chain into epochs
+type Spec struct {
+	Period Period
+	Blocks int64 // Blocks per epoch, for BLOCKS only
+}
+
+// BlockCount is the Spec for epochs of a fixed number of blocks
+func BlockCount(blocks int64) Spec {
+	return Spec{Period: BLOCKS, Blocks: blocks}
+}
+
+// ParseSpec reads "day", "week", "month", or a number of blocks
+func ParseSpec(s string) (Spec, error) {
+	switch strings.ToLower(s) {
+	case "day":
+		return Spec{Period: DAY}, nil
+	case "week":
+		return Spec{Period: WEEK}, nil
+	case "month":
+		return Spec{Period: MONTH}, nil
+	}
+	blocks, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || blocks <= 0 {
+		return Spec{}, fmt.Errorf("epoch %q is not day, week, month or a number of blocks", s)
+	}
+	return BlockCount(blocks), nil
+}
+
+func (s Spec) String() string {
+	switch s.Period {
+	case DAY:
+		return "day"
+	case WEEK:
+		return "week"
+	case MONTH:
+		return "month"
+	}
+	return strconv.FormatInt(s.Blocks, 10)
+}
+
+// MarshalText (as String) lets a Spec be written in a JSON config file
+func (s Spec) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText (as ParseSpec) lets a Spec be read from a JSON config file
+func (s *Spec) UnmarshalText(text []byte) error {
+	spec, err := ParseSpec(string(text))
+	if err != nil {
+		return err
+	}
+	*s = spec
+	return nil
+}
+
+// periodStart is the start of the calendar period containing t
+func (s Spec) periodStart(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch s.Period {
+	case WEEK:
+		sinceMonday := (int(day.Weekday()) + 6) % 7
+		return day.AddDate(0, 0, -sinceMonday)
+	case MONTH:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return day
+}
+
+// BlockTimes reads a time field ("time" or "mediantime") of every block, in Unix seconds
+func BlockTimes(chain chainreadinterface.IBlockChain, handles chainreadinterface.IHandleCreator, blocks int64, field string) ([]int64, error) {
+	times := make([]int64, blocks)
+	if blocks == 0 {
+		return times, nil
+	}
+	blockHandle, err := handles.BlockHandleByHeight(0)
+	if err != nil {
+		return nil, err
+	}
+	for height := int64(0); height < blocks; height++ {
+		block, err := chain.BlockInterface(blockHandle)
+		if err != nil {
+			return nil, err
+		}
+		ints, err := block.NonEssentialInts()
+		if err != nil {
+			return nil, err
+		}
+		secs, ok := (*ints)[field]
+		if !ok {
+			return nil, fmt.Errorf("block %d has no %s", height, field)
+		}
+		times[height] = secs
+		if height+1 < blocks {
+			blockHandle, err = chain.NextBlock(blockHandle)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return times, nil
+}
+
+// ChainTimes reads the TIME_FIELD of every block in the chain, for NewEpochs
+func ChainTimes(chain chainreadinterface.IBlockChain, handles chainreadinterface.IHandleCreator) ([]int64, error) {
+	latestBlock, err := chain.LatestBlock()
+	if err != nil {
+		return nil, err
+	}
+	return BlockTimes(chain, handles, latestBlock.Height()+1, TIME_FIELD)
+}
+
+// Epochs is the chain cut into epochs according to a Spec. Periods in which no block was mined
+// (there are whole days of them in early 2009) don't get an epoch.
+type Epochs struct {
+	spec        Spec
+	firstBlocks []int64     // First block of each epoch, and finally the block count
+	starts      []time.Time // Start of each epoch (its period, or its first block)
+}
+
+// NewEpochs cuts the chain into epochs. blockTimes (see BlockTimes) has one entry per block.
+func NewEpochs(spec Spec, blockTimes []int64) (*Epochs, error) {
+	blocks := int64(len(blockTimes))
+	e := Epochs{spec: spec}
+	if spec.Period == BLOCKS {
+		if spec.Blocks <= 0 {
+			return nil, errors.New("epochs must have at least one block")
+		}
+		for first := int64(0); first < blocks; first += spec.Blocks {
+			e.firstBlocks = append(e.firstBlocks, first)
+			e.starts = append(e.starts, time.Unix(blockTimes[first], 0).UTC())
+		}
+	} else {
+		for height, secs := range blockTimes {
+			start := spec.periodStart(time.Unix(secs, 0))
+			count := len(e.starts)
+			if count > 0 && start.Before(e.starts[count-1]) {
+				return nil, fmt.Errorf("block %d goes back in time", height)
+			}
+			if count == 0 || start.After(e.starts[count-1]) {
+				e.firstBlocks = append(e.firstBlocks, int64(height))
+				e.starts = append(e.starts, start)
+			}
+		}
+	}
+	e.firstBlocks = append(e.firstBlocks, blocks)
+	return &e, nil
+}
+
+func (e *Epochs) Spec() Spec {
+	return e.spec
+}
+
+// Count is the number of epochs
+func (e *Epochs) Count() int64 {
+	return int64(len(e.starts))
+}
+
+// BlockCount is the number of blocks in all the epochs
+func (e *Epochs) BlockCount() int64 {
+	return e.firstBlocks[len(e.firstBlocks)-1]
+}
+
+// Of is the epoch of a block
+func (e *Epochs) Of(height int64) int64 {
+	if e.spec.Period == BLOCKS {
+		return height / e.spec.Blocks
+	}
+	// The first epoch that starts after the block, less one
+	return int64(sort.Search(len(e.starts), func(i int) bool { return e.firstBlocks[i] > height })) - 1
+}
+
+// FirstChanged is the first epoch that a chain of only previousBlocks blocks didn't have all of: its last
+// epoch if that was partial, or else the first new one. Epochs before it are the same in both chains.
+func (e *Epochs) FirstChanged(previousBlocks int64) int64 {
+	if previousBlocks <= 0 {
+		return 0
+	}
+	last := e.Of(previousBlocks - 1)
+	if _, end := e.Blocks(last); end <= previousBlocks {
+		return last + 1
+	}
+	return last
+}
+
+// Blocks is the range of blocks in an epoch, first to end (exclusive)
+func (e *Epochs) Blocks(epoch int64) (int64, int64) {
+	return e.firstBlocks[epoch], e.firstBlocks[epoch+1]
+}
+
+// Start is the start of an epoch's calendar period, or for BLOCKS, the time of its first block
+func (e *Epochs) Start(epoch int64) time.Time {
+	return e.starts[epoch]
+}
+
+// Date is the ISO 8601 date of the start of an epoch
+func (e *Epochs) Date(epoch int64) string {
+	return e.starts[epoch].Format(time.DateOnly)
+}
+
+// Dates are the ISO 8601 dates of every epoch
+func (e *Epochs) Dates() []string {
+	dates := make([]string, len(e.starts))
+	for i := range dates {
+		dates[i] = e.Date(int64(i))
+	}
+	return dates
+}
+
+// FirstMicroEpochs finds which micro-epochs belong to each epoch: those of epoch i run from result[i] to
+// result[i+1] (exclusive). A micro-epoch that straddles two epochs (a week, in months) belongs to the
+// epoch of its first block.
+func FirstMicroEpochs(epochs *Epochs, microEpochs *Epochs) []int64 {
+	result := make([]int64, epochs.Count()+1)
+	epoch := int64(0)
+	for me := int64(0); me < microEpochs.Count(); me++ {
+		first, _ := microEpochs.Blocks(me)
+		for epoch < epochs.Count() && epochs.Of(first) >= epoch {
+			result[epoch] = me
+			epoch++
+		}
+	}
+	for ; epoch <= epochs.Count(); epoch++ {
+		result[epoch] = microEpochs.Count()
+	}
+	return result
+}
@@ -0,0 +1,251 @@
+package checkpoint
+
+// A full-chain run takes hours. Each stage's outputs are saved (gob encoded) to a folder as the run goes,
+// and a later run on the same chain loads them instead of working them out again, as long as the parameters
+// that the stage depends on are the same.
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/KitchenMishap/pudding-huffman/atomicfile"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+)
+
+// VERSION changes whenever what a stage saves (or how it is worked out) changes, so that older
+// checkpoints are ignored rather than misread
+const VERSION = 4
+
+const FILE_EXTENSION = ".gob"
+const RAW_EXTENSION = ".raw"
+
+// header comes first in every checkpoint file. A checkpoint is only valid for the chain height
+// and the (stage's) parameters that it was made with.
+type header struct {
+	Version int
+	Stage   string
+	Blocks  int64
+	Params  string
+}
+
+// Raw is for a value too big to gob encode in memory (a GobEncode has to return the whole encoding at once).
+// The value is gob encoded as usual, which should leave out its bulk, and then WriteRaw streams the bulk to a
+// file of its own beside the checkpoint. ReadRaw reads it back, after the rest of the value has been decoded.
+type Raw interface {
+	WriteRaw(w io.Writer) error
+	ReadRaw(r io.Reader) error
+}
+
+// rawSum follows a Raw value in the checkpoint, so that Load can tell that the raw file is the one that was
+// saved with it (and not one left by a later save that crashed before writing the checkpoint itself)
+type rawSum struct {
+	Bytes int64
+	CRC   uint32
+}
+
+// Store saves and loads the stages of one run. A nil *Store saves nothing and loads nothing,
+// so that a run without checkpoints needs no special cases.
+type Store struct {
+	folder string
+	blocks int64
+	log    func(message string)
+}
+
+// ParamsHash boils down everything (other than the chain) that a stage's outputs depend on. That includes
+// the ParamsHash of any stage whose outputs it uses.
+func ParamsHash(params ...interface{}) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%#v", params)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// NewStore keeps the checkpoints for a chain of the given number of blocks in a folder. An empty folder gives a
+// nil Store (no checkpoints). log is told which checkpoints are loaded, and why any others are ignored.
+func NewStore(folder string, blocks int64, log func(message string)) (*Store, error) {
+	if folder == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return nil, err
+	}
+	return &Store{folder: folder, blocks: blocks, log: log}, nil
+}
+
+func (s *Store) filename(stage string) string {
+	return filepath.Join(s.folder, stage+FILE_EXTENSION)
+}
+
+// rawFilename is where the bulk of a stage's i'th output is kept, if it is Raw
+func (s *Store) rawFilename(stage string, i int) string {
+	return filepath.Join(s.folder, stage+"."+strconv.Itoa(i)+RAW_EXTENSION)
+}
+
+// countingWriter counts the bytes written through it, and their CRC
+type countingWriter struct {
+	sum rawSum
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.sum.Bytes += int64(len(p))
+	c.sum.CRC = crc32.Update(c.sum.CRC, crc32.IEEETable, p)
+	return len(p), nil
+}
+
+// saveRaw writes the bulk of a Raw value to its own file, and returns the sum to save with the checkpoint
+func (s *Store) saveRaw(stage string, i int, raw Raw) (rawSum, error) {
+	counter := countingWriter{}
+	err := atomicfile.Write(s.rawFilename(stage, i), func(f io.Writer) error {
+		bw := bufio.NewWriter(io.MultiWriter(f, &counter))
+		if err := raw.WriteRaw(bw); err != nil {
+			return err
+		}
+		return bw.Flush()
+	})
+	return counter.sum, err
+}
+
+// loadRaw reads the bulk of a Raw value back from its own file, and checks it against the saved sum
+func (s *Store) loadRaw(stage string, i int, raw Raw, sum rawSum) error {
+	f, err := os.Open(s.rawFilename(stage, i))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil {
+		return err
+	} else if info.Size() != sum.Bytes {
+		return fmt.Errorf("raw file %d is %d bytes, not the %d saved with the checkpoint", i, info.Size(), sum.Bytes)
+	}
+	counter := countingWriter{}
+	if err := raw.ReadRaw(io.TeeReader(bufio.NewReader(f), &counter)); err != nil {
+		return err
+	}
+	if counter.sum != sum {
+		return fmt.Errorf("raw file %d doesn't match the checkpoint", i)
+	}
+	return nil
+}
+
+// Save writes a stage's outputs (in order), and the parameters (see ParamsHash) they were worked out with.
+// The file is written under another name then renamed, so a crash part way through leaves the previous
+// checkpoint (if any) intact. The bulk of a Raw output goes in a file of its own (see Raw).
+func (s *Store) Save(stage string, params string, values ...interface{}) error {
+	if s == nil {
+		return nil
+	}
+	filename := s.filename(stage)
+	temp := filename + ".tmp"
+	f, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+	enc := gob.NewEncoder(f)
+	err = enc.Encode(header{Version: VERSION, Stage: stage, Blocks: s.blocks, Params: params})
+	for i, value := range values {
+		if err != nil {
+			break
+		}
+		err = enc.Encode(value)
+		if raw, ok := value.(Raw); ok && err == nil {
+			var sum rawSum
+			if sum, err = s.saveRaw(stage, i, raw); err == nil {
+				err = enc.Encode(sum)
+			}
+		}
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp)
+		return fmt.Errorf("checkpoint %s: %w", stage, err)
+	}
+	return os.Rename(temp, filename)
+}
+
+// Load reads a stage's outputs (in the order they were saved) into the values, which are pointers.
+// It returns false, and leaves the values alone, if there is no valid checkpoint for the stage (with the
+// given parameters).
+func (s *Store) Load(stage string, params string, values ...interface{}) (bool, error) {
+	if s == nil {
+		return false, nil
+	}
+	blocks, err := s.load(stage, params, func(blocks int64) bool { return blocks == s.blocks }, values)
+	return blocks > 0, err
+}
+
+// LoadLatest is like Load, but also accepts a checkpoint made when the chain was shorter (for an
+// incremental run). It returns the number of blocks that the checkpoint was made with, or zero if
+// there is no valid checkpoint for the stage.
+func (s *Store) LoadLatest(stage string, params string, values ...interface{}) (int64, error) {
+	if s == nil {
+		return 0, nil
+	}
+	return s.load(stage, params, func(blocks int64) bool { return blocks > 0 && blocks <= s.blocks }, values)
+}
+
+func (s *Store) load(stage string, params string, blocksOk func(int64) bool, values []interface{}) (int64, error) {
+	f, err := os.Open(s.filename(stage))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	dec := gob.NewDecoder(f)
+	var h header
+	if err := dec.Decode(&h); err != nil {
+		s.log(fmt.Sprintf("Checkpoint %s is unreadable (%s), ignoring it", stage, err.Error()))
+		return 0, nil
+	}
+	if h.Version != VERSION || h.Stage != stage || !blocksOk(h.Blocks) || h.Params != params {
+		s.log(fmt.Sprintf("Checkpoint %s is out of date (version %d, %d blocks), ignoring it", stage, h.Version, h.Blocks))
+		return 0, nil
+	}
+	// Decode into fresh values first, so a bad file can't leave the caller with half a stage
+	fresh := make([]interface{}, len(values))
+	for i, value := range values {
+		fresh[i] = newLike(value)
+		if err := dec.Decode(fresh[i]); err != nil {
+			s.log(fmt.Sprintf("Checkpoint %s is unreadable (%s), ignoring it", stage, err.Error()))
+			return 0, nil
+		}
+		if raw, ok := reflect.ValueOf(fresh[i]).Elem().Interface().(Raw); ok {
+			var sum rawSum
+			err := dec.Decode(&sum)
+			if err == nil {
+				err = s.loadRaw(stage, i, raw, sum)
+			}
+			if err != nil {
+				s.log(fmt.Sprintf("Checkpoint %s is unreadable (%s), ignoring it", stage, err.Error()))
+				return 0, nil
+			}
+		}
+	}
+	for i, value := range values {
+		setFrom(value, fresh[i])
+	}
+	s.log(fmt.Sprintf("Loaded checkpoint %s (%d blocks)", stage, h.Blocks))
+	return h.Blocks, nil
+}
+
+// newLike is a pointer to a new zero value of the type that ptr points to
+func newLike(ptr interface{}) interface{} {
+	return reflect.New(reflect.TypeOf(ptr).Elem()).Interface()
+}
+
+// setFrom copies what fresh points to into what ptr points to
+func setFrom(ptr interface{}, fresh interface{}) {
+	reflect.ValueOf(ptr).Elem().Set(reflect.ValueOf(fresh).Elem())
+}
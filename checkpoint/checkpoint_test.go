@@ -0,0 +1,125 @@
+package checkpoint
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+// bulky is a Raw value: its Data isn't gob encoded, but streamed to a raw file
+type bulky struct {
+	Name   string
+	Length int
+	data   []byte
+}
+
+func (b *bulky) WriteRaw(w io.Writer) error {
+	_, err := w.Write(b.data)
+	return err
+}
+
+func (b *bulky) ReadRaw(r io.Reader) error {
+	b.data = make([]byte, b.Length)
+	_, err := io.ReadFull(r, b.data)
+	return err
+}
+
+func newBulky(name string, length int) *bulky {
+	b := bulky{Name: name, Length: length, data: make([]byte, length)}
+	for i := range b.data {
+		b.data[i] = byte(i * 7)
+	}
+	return &b
+}
+
+func newTestStore(t *testing.T, blocks int64) *Store {
+	t.Helper()
+	store, err := NewStore(t.TempDir(), blocks, func(message string) { t.Log(message) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestRawRoundTrip(t *testing.T) {
+	store := newTestStore(t, 10)
+	peaks := [][]float64{nil, {1, 2}, {}}
+	saved := newBulky("big", 100000)
+	if err := store.Save("stage", "params", peaks, saved, 42); err != nil {
+		t.Fatal(err)
+	}
+
+	var loadedPeaks [][]float64
+	var loaded *bulky
+	var answer int
+	ok, err := store.Load("stage", "params", &loadedPeaks, &loaded, &answer)
+	if err != nil || !ok {
+		t.Fatalf("Load gave %v, %v", ok, err)
+	}
+	if len(loadedPeaks) != 3 || loadedPeaks[1][1] != 2 || answer != 42 {
+		t.Fatalf("loaded %v and %d", loadedPeaks, answer)
+	}
+	if loaded.Name != saved.Name || !bytes.Equal(loaded.data, saved.data) {
+		t.Fatalf("loaded %q with %d bytes, want %q with %d", loaded.Name, len(loaded.data), saved.Name, len(saved.data))
+	}
+
+	// Saving again (a rerun) replaces both files
+	if err := store.Save("stage", "params", peaks, newBulky("bigger", 200000), 42); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := store.Load("stage", "params", &loadedPeaks, &loaded, &answer); err != nil || !ok || len(loaded.data) != 200000 {
+		t.Fatalf("Load gave %v, %v", ok, err)
+	}
+}
+
+// TestRawMismatch checks that a checkpoint whose raw file is missing, or isn't the one saved with it, is ignored
+func TestRawMismatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(store *Store)
+	}{
+		{"raw file missing", func(store *Store) {
+			os.Remove(store.rawFilename("stage", 0))
+		}},
+		{"raw file from a later save that crashed", func(store *Store) {
+			checkpoint, _ := os.ReadFile(store.filename("stage"))
+			store.Save("stage", "params", newBulky("longer", 2000), 42) // But with the same first 1000 bytes
+			os.WriteFile(store.filename("stage"), checkpoint, 0644)
+		}},
+		{"raw file from a later save of the same length", func(store *Store) {
+			checkpoint, _ := os.ReadFile(store.filename("stage"))
+			other := newBulky("other", 1000)
+			other.data[0]++
+			store.Save("stage", "params", other, 42)
+			os.WriteFile(store.filename("stage"), checkpoint, 0644)
+		}},
+		{"raw file changed", func(store *Store) {
+			raw, _ := os.ReadFile(store.rawFilename("stage", 0))
+			raw[500]++
+			os.WriteFile(store.rawFilename("stage", 0), raw, 0644)
+		}},
+		{"raw file cut short", func(store *Store) {
+			os.Truncate(store.rawFilename("stage", 0), 999)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newTestStore(t, 10)
+			if err := store.Save("stage", "params", newBulky("big", 1000), 42); err != nil {
+				t.Fatal(err)
+			}
+			test.damage(store)
+
+			loaded := newBulky("untouched", 0)
+			answer := 0
+			ok, err := store.Load("stage", "params", &loaded, &answer)
+			if err != nil || ok {
+				t.Fatalf("Load gave %v, %v, want it ignored", ok, err)
+			}
+			if loaded.Name != "untouched" || answer != 0 {
+				t.Fatalf("ignored checkpoint changed the values to %q and %d", loaded.Name, answer)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package compress
+
+import (
+	"errors"
+	"fmt"
+	"github.com/KitchenMishap/pudding-huffman/amounts"
+	"github.com/KitchenMishap/pudding-huffman/calendar"
+	"github.com/KitchenMishap/pudding-huffman/huffman"
+)
+
+// TransAmounts is everything the codec encodes for one transaction
+type TransAmounts struct {
+	Outputs    []int64
+	Fees       int64 // For a coinbase, whatever the miner didn't claim (see BlockTransAmounts)
+	IsCoinbase bool
+}
+
+// InputTotal is what the transaction's inputs must add up to
+func (ta TransAmounts) InputTotal() int64 {
+	total := ta.Fees
+	for _, sats := range ta.Outputs {
+		total += sats
+	}
+	return total
+}
+
+// TransShape is the side information a decoder needs for each transaction. It is NOT in the bitstream:
+// the output count comes from the chain structure, and the input total from the (already decoded) amounts
+// of the txos that the transaction spends. This is what lets "the rest" cost just two bits.
+// A coinbase has no inputs; its input total is the block subsidy plus the other transactions' fees,
+// so the decoder works it out itself once the rest of the block is decoded.
+type TransShape struct {
+	OutputCount int
+	InputTotal  int64 // Ignored for a coinbase
+	IsCoinbase  bool
+}
+
+// AmountCodec turns the amounts of a block into a real bitstream using the same registered encoders
+// (see encoders.go) as ParallelSimulateCompressionWithKMeans, and turns the bitstream back into amounts
+type AmountCodec struct {
+	epochs      *calendar.Epochs
+	microEpochs *calendar.Epochs
+	encoders    []AmountEncoder
+	selectors   *SelectorCodes
+}
+
+func NewAmountCodec(epochs *calendar.Epochs,
+	microEpochs *calendar.Epochs,
+	tables *EncoderTables,
+	selectors *SelectorCodes) *AmountCodec {
+
+	return &AmountCodec{
+		epochs:      epochs,
+		microEpochs: microEpochs,
+		encoders:    NewAmountEncoders(tables),
+		selectors:   selectors,
+	}
+}
+
+// Encoders are the codec's encoders, in choice order
+func (c *AmountCodec) Encoders() []AmountEncoder {
+	return c.encoders
+}
+
+// ErrNothingToEncode is when no amount of a transaction costs any bits, so none can be the one left to infer
+var ErrNothingToEncode = errors.New("transaction has nothing to encode")
+
+// EncodeBlock writes the amounts of every transaction in a block to a bitstream.
+// It returns the bytes (final byte zero padded) and the number of bits actually used.
+func (c *AmountCodec) EncodeBlock(blockIdx int64, transactions []TransAmounts) ([]byte, int, error) {
+	ctx := AmountContext{EpochID: c.epochs.Of(blockIdx), MicroEpochID: c.microEpochs.Of(blockIdx)}
+
+	w := huffman.NewBitWriter()
+	for _, trans := range transactions {
+		// Outputs first, then the fees, as in the simulation
+		if trans.IsCoinbase {
+			w.Append(CoinbaseFlag(trans))
+		}
+		amounts := EncodedAmounts(trans)
+
+		choices := make([]int, len(amounts))
+		mostExpensive := 0
+		loser := -1
+		previous := CHOICE_START
+		for i, amount := range amounts {
+			choice, err := cheapestChoice(c.encoders, c.selectors, ctx, previous, amount)
+			if err != nil {
+				return nil, 0, err
+			}
+			choices[i] = choice
+			payloadBits, _ := c.encoders[choice].Cost(ctx, amount)
+			cost := c.selectors.Code(ctx.EpochID, previous, choice).Length + payloadBits
+			if cost > mostExpensive {
+				mostExpensive = cost
+				loser = i
+			}
+			previous = choices[i]
+		}
+		if loser < 0 {
+			return nil, 0, ErrNothingToEncode
+		}
+		// The most expensive amount can be worked out from the rest of the transaction
+		choices[loser] = CHOICE_REST
+
+		previous = CHOICE_START
+		for i, amount := range amounts {
+			w.Append(c.selectors.Code(ctx.EpochID, previous, choices[i]))
+			w.AppendWriter(c.encoders[choices[i]].Encode(ctx, amount))
+			previous = choices[i]
+		}
+	}
+	return w.Bytes(), w.Len(), nil
+}
+
+// DecodeBlock reads back the amounts written by EncodeBlock. The shapes provide the side information
+// (see TransShape) for each transaction in the block.
+func (c *AmountCodec) DecodeBlock(blockIdx int64, data []byte, shapes []TransShape) ([]TransAmounts, error) {
+	ctx := AmountContext{EpochID: c.epochs.Of(blockIdx), MicroEpochID: c.microEpochs.Of(blockIdx)}
+
+	r := huffman.NewBitReader(data, -1)
+	result := make([]TransAmounts, len(shapes))
+	blockFees := int64(0)
+	coinbase := -1 // The coinbase's rest has to wait until all the fees are known
+	coinbaseRestIdx := -1
+	coinbaseSumOthers := int64(0)
+	var coinbaseAmounts []int64
+	for t, shape := range shapes {
+		amountCount := shape.OutputCount + 1
+		if shape.IsCoinbase {
+			flag, err := r.ReadBits(COINBASE_FLAG_BITS)
+			if err != nil {
+				return nil, err
+			}
+			if flag == coinbaseClaimedFlag.Bits {
+				amountCount = shape.OutputCount // Nothing unclaimed, so no fees encoded
+			}
+		}
+		amounts := make([]int64, amountCount, shape.OutputCount+1)
+		restIdx := -1
+		sumOthers := int64(0)
+		previous := CHOICE_START
+		for i := range amounts {
+			choice, err := c.selectors.Decode(r, ctx.EpochID, previous)
+			if err != nil {
+				return nil, err
+			}
+			previous = choice
+			if choice == CHOICE_REST {
+				if restIdx >= 0 {
+					return nil, fmt.Errorf("block %d transaction %d: more than one rest", blockIdx, t)
+				}
+				restIdx = i
+				continue
+			}
+			if choice < 0 || choice >= len(c.encoders) {
+				return nil, fmt.Errorf("block %d transaction %d: bad selector %d", blockIdx, t, choice)
+			}
+			amount, err := c.encoders[choice].Decode(ctx, r)
+			if err != nil {
+				return nil, err
+			}
+			amounts[i] = amount
+			sumOthers += amount
+		}
+		if restIdx < 0 {
+			return nil, fmt.Errorf("block %d transaction %d: no rest", blockIdx, t)
+		}
+		result[t].IsCoinbase = shape.IsCoinbase
+		if shape.IsCoinbase {
+			if coinbase >= 0 {
+				return nil, fmt.Errorf("block %d transaction %d: more than one coinbase", blockIdx, t)
+			}
+			coinbase = t
+			coinbaseRestIdx = restIdx
+			coinbaseSumOthers = sumOthers
+			coinbaseAmounts = amounts
+			continue
+		}
+		amounts[restIdx] = shape.InputTotal - sumOthers
+
+		result[t].Outputs = amounts[:shape.OutputCount]
+		result[t].Fees = amounts[shape.OutputCount]
+		blockFees += result[t].Fees
+	}
+	if coinbase >= 0 {
+		coinbaseAmounts[coinbaseRestIdx] = amounts.BlockSubsidy(blockIdx) + blockFees - coinbaseSumOthers
+		outputCount := shapes[coinbase].OutputCount
+		result[coinbase].Outputs = coinbaseAmounts[:outputCount]
+		if len(coinbaseAmounts) > outputCount {
+			result[coinbase].Fees = coinbaseAmounts[outputCount]
+		}
+	}
+	return result, nil
+}
+
+// RoundTripBlock encodes a block, decodes it again, and checks that every amount survived.
+// It returns the number of bits used, and the number of bytes they were packed into.
+func (c *AmountCodec) RoundTripBlock(blockIdx int64, transactions []TransAmounts) (int, int, error) {
+	data, bitLen, err := c.EncodeBlock(blockIdx, transactions)
+	if err != nil {
+		return 0, 0, err
+	}
+	shapes := make([]TransShape, len(transactions))
+	for t, trans := range transactions {
+		shapes[t] = TransShape{OutputCount: len(trans.Outputs), InputTotal: trans.InputTotal(), IsCoinbase: trans.IsCoinbase}
+	}
+	decoded, err := c.DecodeBlock(blockIdx, data, shapes)
+	if err != nil {
+		return 0, 0, fmt.Errorf("block %d: %w", blockIdx, err)
+	}
+	for t, trans := range transactions {
+		if decoded[t].Fees != trans.Fees {
+			return 0, 0, fmt.Errorf("block %d transaction %d: fees %d decoded as %d", blockIdx, t, trans.Fees, decoded[t].Fees)
+		}
+		for o, sats := range trans.Outputs {
+			if decoded[t].Outputs[o] != sats {
+				return 0, 0, fmt.Errorf("block %d transaction %d output %d: %d sats decoded as %d", blockIdx, t, o, sats, decoded[t].Outputs[o])
+			}
+		}
+	}
+	return bitLen, len(data), nil
+}
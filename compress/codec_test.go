@@ -0,0 +1,197 @@
+package compress
+
+import (
+	"errors"
+	"github.com/KitchenMishap/pudding-huffman/amounts"
+	"github.com/KitchenMishap/pudding-huffman/calendar"
+	"github.com/KitchenMishap/pudding-huffman/huffman"
+	"strings"
+	"testing"
+)
+
+const testSubsidy = 50 * amounts.SATS_PER_BTC
+
+// testCodec has small hand made tables, so it's clear which encoder each amount should get:
+// 0, 50 BTC and 1 BTC are celebrities, 1000000 and its neighbours are ghosts (of a peak at 10^0),
+// and anything else is a literal
+func testCodec(t *testing.T) *AmountCodec {
+	t.Helper()
+	celebs := huffman.CanonicalCodes(map[int64]int{0: 1, testSubsidy: 2, amounts.SATS_PER_BTC: 2})
+	exps := map[int64]int{}
+	for exp := int64(0); exp < 16; exp++ {
+		exps[exp] = 4
+	}
+	residuals := make([]map[int64]huffman.BitCode, 16)
+	for exp := range residuals {
+		residuals[exp] = huffman.CanonicalCodes(map[int64]int{0: 1, -1: 2, 1: 2})
+	}
+	magnitudes := map[int64]int64{}
+	for mag := int64(0); mag <= 64; mag++ {
+		magnitudes[mag] = 1
+	}
+	magnitudeCodes, err := huffman.BuildCodes(magnitudes, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := EncoderTables{
+		EpochToCelebCodes:      []map[int64]huffman.BitCode{celebs},
+		ExpCodes:               huffman.CanonicalCodes(exps),
+		ResidualCodesByExp:     residuals,
+		MagnitudeCodes:         magnitudeCodes,
+		CombinedCodes:          huffman.CanonicalCodes(map[int64]int{0: 1, 1: 1}),
+		MicroEpochToPhasePeaks: [][]float64{{0.0}},
+	}
+	times := []int64{1231006505, 1231006505 + 600, 1231006505 + 1200}
+	epochs, err := calendar.NewEpochs(calendar.BlockCount(10), times)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewAmountCodec(epochs, epochs, &tables, FixedSelectorCodes(NumChoices()))
+}
+
+// expectedBits is what EncodeBlock should write, given the choice for every amount
+func expectedBits(c *AmountCodec, transactions []TransAmounts, choices [][]int) *huffman.BitWriter {
+	ctx := AmountContext{}
+	w := huffman.NewBitWriter()
+	for t, trans := range transactions {
+		if trans.IsCoinbase {
+			w.Append(CoinbaseFlag(trans))
+		}
+		previous := CHOICE_START
+		for i, amount := range EncodedAmounts(trans) {
+			w.Append(c.selectors.Code(ctx.EpochID, previous, choices[t][i]))
+			w.AppendWriter(c.encoders[choices[t][i]].Encode(ctx, amount))
+			previous = choices[t][i]
+		}
+	}
+	return w
+}
+
+func TestCodecSelectors(t *testing.T) {
+	const C, G, L, R = CHOICE_CELEB, CHOICE_GHOST, CHOICE_LITERAL, CHOICE_REST
+	tests := []struct {
+		name         string
+		transactions []TransAmounts
+		choices      [][]int // For each transaction, the choice for each of EncodedAmounts
+	}{
+		{"celebrities, and the most expensive is the rest",
+			[]TransAmounts{{Outputs: []int64{testSubsidy, 0}, Fees: 0}},
+			[][]int{{R, C, C}}},
+		{"ghosts",
+			[]TransAmounts{{Outputs: []int64{1000000, 1000001, 10000000, 100000001}, Fees: 0}},
+			[][]int{{G, R, G, G, C}}}, // The first of the most expensive is the rest
+		{"not a ghost just below a power of ten (the peak is taken from the decade below)",
+			[]TransAmounts{{Outputs: []int64{1000000, 999999}, Fees: 0}},
+			[][]int{{G, R, C}}},
+		{"literals, the biggest being the rest",
+			[]TransAmounts{{Outputs: []int64{123456789, 987654321, 12345}, Fees: 777}},
+			[][]int{{L, R, L, L}}},
+		{"every choice",
+			[]TransAmounts{{Outputs: []int64{0, 1000000, 123456789, 987654321}, Fees: amounts.SATS_PER_BTC}},
+			[][]int{{C, G, L, R, C}}},
+		{"fully claimed coinbase (flag, and no fees)",
+			[]TransAmounts{
+				{Outputs: []int64{testSubsidy + 12345}, IsCoinbase: true},
+				{Outputs: []int64{1000000, 0}, Fees: 12345},
+			},
+			[][]int{{R}, {G, C, R}}},
+		{"fully claimed coinbase with two outputs",
+			[]TransAmounts{
+				{Outputs: []int64{testSubsidy, 0}, IsCoinbase: true},
+				{Outputs: []int64{123456789}, Fees: 0},
+			},
+			[][]int{{R, C}, {R, C}}},
+		{"unclaimed coinbase (flag, then the unclaimed amount)",
+			[]TransAmounts{
+				{Outputs: []int64{testSubsidy - amounts.SATS_PER_BTC + 500}, Fees: amounts.SATS_PER_BTC, IsCoinbase: true},
+				{Outputs: []int64{1000000}, Fees: 500},
+			},
+			[][]int{{R, C}, {G, R}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := testCodec(t)
+			data, bitLen, err := c.EncodeBlock(0, test.transactions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := expectedBits(c, test.transactions, test.choices)
+			if bitLen != want.Len() {
+				t.Fatalf("%d bits, want %d", bitLen, want.Len())
+			}
+			if string(data) != string(want.Bytes()) {
+				t.Fatalf("encoded as %x, want %x (%s)", data, want.Bytes(), want.String())
+			}
+
+			bits, _, err := c.RoundTripBlock(0, test.transactions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bits != bitLen {
+				t.Fatalf("round trip used %d bits, encoding %d", bits, bitLen)
+			}
+		})
+	}
+}
+
+func TestCodecCorrupt(t *testing.T) {
+	c := testCodec(t)
+	transactions := []TransAmounts{
+		{Outputs: []int64{testSubsidy + 777}, IsCoinbase: true},
+		{Outputs: []int64{0, 1000000, 123456789, 987654321}, Fees: 777},
+	}
+	shapes := make([]TransShape, len(transactions))
+	for t, trans := range transactions {
+		shapes[t] = TransShape{OutputCount: len(trans.Outputs), InputTotal: trans.InputTotal(), IsCoinbase: trans.IsCoinbase}
+	}
+	data, bitLen, err := c.EncodeBlock(0, transactions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.DecodeBlock(0, data, shapes); err != nil {
+		t.Fatal(err)
+	}
+
+	// Truncated (the padding of the last byte is read as zeros, so cut it a byte short)
+	truncated := data[:(bitLen-1)/8]
+	if _, err := c.DecodeBlock(0, truncated, shapes); !errors.Is(err, huffman.ErrEndOfBits) {
+		t.Fatalf("truncated block gave %v, want ErrEndOfBits", err)
+	}
+
+	// selectors writes a stream of the given choices (with the payload for an amount of 0, where there is one).
+	// A choice of -1 writes a (fully claimed) coinbase flag instead, which starts a new transaction.
+	selectors := func(choices ...int) []byte {
+		w := huffman.NewBitWriter()
+		previous := CHOICE_START
+		for _, choice := range choices {
+			if choice < 0 {
+				w.Append(coinbaseClaimedFlag)
+				previous = CHOICE_START
+				continue
+			}
+			w.Append(c.selectors.Code(0, previous, choice))
+			w.AppendWriter(c.encoders[choice].Encode(AmountContext{}, 0))
+			previous = choice
+		}
+		return w.Bytes()
+	}
+	tests := []struct {
+		name   string
+		data   []byte
+		shapes []TransShape
+		want   string
+	}{
+		{"two rests", selectors(CHOICE_REST, CHOICE_REST), []TransShape{{OutputCount: 1, InputTotal: 5}}, "more than one rest"},
+		{"no rest", selectors(CHOICE_CELEB, CHOICE_CELEB), []TransShape{{OutputCount: 1, InputTotal: 5}}, "no rest"},
+		{"two coinbases", selectors(-1, CHOICE_REST, -1, CHOICE_REST),
+			[]TransShape{{OutputCount: 1, IsCoinbase: true}, {OutputCount: 1, IsCoinbase: true}}, "more than one coinbase"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := c.DecodeBlock(0, test.data, test.shapes)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("got error %v, want %q", err, test.want)
+			}
+		})
+	}
+}
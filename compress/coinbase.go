@@ -0,0 +1,41 @@
+package compress
+
+import (
+	"github.com/KitchenMishap/pudding-huffman/huffman"
+)
+
+// --- Coinbase ---
+
+// A coinbase has no inputs, but its outputs (plus anything the miner didn't claim) add up to the block
+// subsidy plus the block's fees. The subsidy comes from the height (amounts.BlockSubsidy) and the decoder knows the
+// fees once the rest of the block is decoded, so a coinbase gets a "rest" just like any other transaction.
+// Nearly every miner claims everything, so a one bit flag says "fully claimed", and then the unclaimed
+// amount (zero) isn't encoded at all.
+
+const COINBASE_FLAG_BITS = 1
+
+var coinbaseClaimedFlag = huffman.BitCode{Bits: 1, Length: COINBASE_FLAG_BITS}
+var coinbaseUnclaimedFlag = huffman.BitCode{Bits: 0, Length: COINBASE_FLAG_BITS}
+
+// FullyClaimed is true for a coinbase that claimed the whole of the subsidy and fees
+func (ta TransAmounts) FullyClaimed() bool {
+	return ta.IsCoinbase && ta.Fees == 0
+}
+
+// CoinbaseFlag is the flag written before the amounts of a coinbase
+func CoinbaseFlag(trans TransAmounts) huffman.BitCode {
+	if trans.FullyClaimed() {
+		return coinbaseClaimedFlag
+	}
+	return coinbaseUnclaimedFlag
+}
+
+// EncodedAmounts lists the amounts of a transaction in the order they get encoded: the outputs, then the fees.
+// The fees are left out for a fully claimed coinbase.
+func EncodedAmounts(trans TransAmounts) []int64 {
+	amounts := append(make([]int64, 0, len(trans.Outputs)+1), trans.Outputs...)
+	if trans.FullyClaimed() {
+		return amounts
+	}
+	return append(amounts, trans.Fees)
+}
@@ -0,0 +1,106 @@
+package compress
+
+import (
+	"errors"
+	"github.com/KitchenMishap/pudding-huffman/huffman"
+)
+
+// --- Pluggable Amount Encoders ---
+
+// AmountContext is what an encoder knows about where an amount is in the chain
+type AmountContext struct {
+	EpochID      int64
+	MicroEpochID int64
+}
+
+// AmountEncoder is one way of encoding an amount (celebrity, ghost, literal...). For every amount, the
+// simulation and the AmountCodec try every registered encoder and keep the cheapest (selector included).
+// The encoder's index in the registered list is its choice number, which is what the selector encodes.
+type AmountEncoder interface {
+	// Name is used in the stats
+	Name() string
+	// Cost is the number of payload bits (not counting the selector) that Encode would use.
+	// Not ok means this encoder can't encode the amount.
+	Cost(ctx AmountContext, amount int64) (int, bool)
+	// Encode returns the payload bits for an amount (only called when Cost was ok)
+	Encode(ctx AmountContext, amount int64) *huffman.BitWriter
+	// Decode reads back a payload written by Encode
+	Decode(ctx AmountContext, r *huffman.BitReader) (int64, error)
+}
+
+// AmountQuoter is optional. It describes an encoded amount for the podiums.
+type AmountQuoter interface {
+	Quote(ctx AmountContext, amount int64) string
+}
+
+// RansCoster is optional. It is what the same payload would cost with a rANS coder.
+type RansCoster interface {
+	RansCost(ctx AmountContext, amount int64) float64
+}
+
+// EncoderTables are the tables built by the earlier stages of a pass, for the encoders to share
+type EncoderTables struct {
+	EpochToCelebCodes      []map[int64]huffman.BitCode
+	ExpCodes               map[int64]huffman.BitCode
+	ResidualCodesByExp     []map[int64]huffman.BitCode
+	MagnitudeCodes         map[int64]huffman.BitCode
+	CombinedCodes          map[int64]huffman.BitCode
+	MicroEpochToPhasePeaks [][]float64
+	RansModels             *RansModels // Can be nil
+}
+
+// AmountEncoderFactory builds an encoder from the tables of a pass
+type AmountEncoderFactory func(tables *EncoderTables) AmountEncoder
+
+// The built in encoders are registered in the order of their CHOICE_ constants
+var registeredEncoders = []AmountEncoderFactory{
+	newCelebEncoder,
+	newGhostEncoder,
+	newLiteralEncoder,
+	newRestEncoder,
+}
+
+// RegisterAmountEncoder adds an experimental encoder, and returns its choice number.
+// Register before building any SelectorCodes or ChoiceFrequencies, as they are sized by NumChoices.
+func RegisterAmountEncoder(factory AmountEncoderFactory) int {
+	registeredEncoders = append(registeredEncoders, factory)
+	return len(registeredEncoders) - 1
+}
+
+// NumChoices is the number of registered encoders, and so the number of different selectors
+func NumChoices() int {
+	return len(registeredEncoders)
+}
+
+// NewAmountEncoders builds every registered encoder, in choice order
+func NewAmountEncoders(tables *EncoderTables) []AmountEncoder {
+	encoders := make([]AmountEncoder, len(registeredEncoders))
+	for choice, factory := range registeredEncoders {
+		encoders[choice] = factory(tables)
+	}
+	return encoders
+}
+
+var ErrNoEncoder = errors.New("no encoder could encode the amount")
+
+// cheapestChoice tries every encoder on an amount and returns the choice with the fewest bits,
+// counting the selector that would go in front (which depends on the previous choice)
+func cheapestChoice(encoders []AmountEncoder, selectors *SelectorCodes, ctx AmountContext, previous int, amount int64) (int, error) {
+	choice := -1
+	cheapest := 0
+	for c, encoder := range encoders {
+		payloadBits, ok := encoder.Cost(ctx, amount)
+		if !ok {
+			continue
+		}
+		cost := selectors.Code(ctx.EpochID, previous, c).Length + payloadBits
+		if choice < 0 || cost < cheapest {
+			choice = c
+			cheapest = cost
+		}
+	}
+	if choice < 0 {
+		return 0, ErrNoEncoder
+	}
+	return choice, nil
+}
@@ -0,0 +1,15 @@
+package compress
+
+import (
+	"github.com/KitchenMishap/pudding-huffman/amounts"
+)
+
+// BlockTransAmounts puts together the outputs of every transaction in a block with its fees (see
+// amounts.Source). The coinbase is the first transaction; its "fees" are whatever the miner didn't claim.
+func BlockTransAmounts(block *amounts.Block, fees []int64) []TransAmounts {
+	result := make([]TransAmounts, len(block.Trans))
+	for t, txoAmounts := range block.Trans {
+		result[t] = TransAmounts{Outputs: txoAmounts, Fees: fees[t], IsCoinbase: t == 0}
+	}
+	return result
+}
@@ -0,0 +1,85 @@
+package compress
+
+import (
+	"github.com/KitchenMishap/pudding-huffman/rans"
+	"math"
+)
+
+// RansModels are the rANS equivalents of the Huffman code tables, built from the same frequency maps.
+// They let the simulation report how much an entropy coder that doesn't round to whole bits would save.
+type RansModels struct {
+	epochToCeleb  []*rans.Model
+	exp           *rans.Model
+	residualByExp []*rans.Model
+	magnitude     *rans.Model
+	combined      *rans.Model
+}
+
+// NewRansModels takes the frequency maps that the Huffman tables were built from. A nil map gives a nil model.
+func NewRansModels(epochToCelebFreqs []map[int64]int64,
+	expFreqs map[int64]int64,
+	residualFreqsByExp []map[int64]int64,
+	magnitudeFreqs map[int64]int64,
+	combinedFreqs map[int64]int64) (*RansModels, error) {
+
+	var err error
+	models := RansModels{}
+	models.epochToCeleb = make([]*rans.Model, len(epochToCelebFreqs))
+	for eID, freqs := range epochToCelebFreqs {
+		if models.epochToCeleb[eID], err = newRansModel(freqs); err != nil {
+			return nil, err
+		}
+	}
+	if models.exp, err = newRansModel(expFreqs); err != nil {
+		return nil, err
+	}
+	models.residualByExp = make([]*rans.Model, len(residualFreqsByExp))
+	for exp, freqs := range residualFreqsByExp {
+		if models.residualByExp[exp], err = newRansModel(freqs); err != nil {
+			return nil, err
+		}
+	}
+	if models.magnitude, err = newRansModel(magnitudeFreqs); err != nil {
+		return nil, err
+	}
+	if models.combined, err = newRansModel(combinedFreqs); err != nil {
+		return nil, err
+	}
+	return &models, nil
+}
+
+func newRansModel(freqs map[int64]int64) (*rans.Model, error) {
+	if len(freqs) == 0 {
+		return nil, nil
+	}
+	return rans.NewModel(freqs, rans.DEFAULT_SCALE_BITS)
+}
+
+func modelCost(model *rans.Model, symbol int64) float64 {
+	if model == nil {
+		return math.Inf(1)
+	}
+	cost, _ := model.CostBits(symbol) // +Inf if missing
+	return cost
+}
+
+// The costs below are for the payload only, not the selector
+
+func (m *RansModels) celebCost(epochID int64, amount int64) float64 {
+	return modelCost(m.epochToCeleb[epochID], amount)
+}
+
+func (m *RansModels) ghostCost(combined int64, e int, residual int64) float64 {
+	if e < 0 || e >= len(m.residualByExp) {
+		return math.Inf(1)
+	}
+	return modelCost(m.combined, combined) + modelCost(m.exp, int64(e)) + modelCost(m.residualByExp[e], residual)
+}
+
+func (m *RansModels) literalCost(mag int64) float64 {
+	payload := float64(0)
+	if mag > 0 {
+		payload = float64(mag - 1) // The leading 1 bit is implied
+	}
+	return modelCost(m.magnitude, mag) + payload
+}
@@ -0,0 +1,172 @@
+package compress
+
+import (
+	"github.com/KitchenMishap/pudding-huffman/huffman"
+	"math/bits"
+)
+
+// Every encoded amount starts with a selector saying how it was encoded. These are the choices of the
+// built in encoders (see encoders.go). Experimental encoders get the choices after these.
+const CHOICE_CELEB = 0
+const CHOICE_GHOST = 1
+const CHOICE_LITERAL = 2
+const CHOICE_REST = 3
+
+// CHOICE_START is the "previous choice" for the first amount of a transaction
+const CHOICE_START = -1
+
+// ChoiceFrequencies are gathered by the simulation, to build adaptive selector codes from
+type ChoiceFrequencies struct {
+	Global        []int64
+	PerEpoch      [][]int64
+	AfterPrevious [][]int64 // [previous choice + 1 (so CHOICE_START is row 0)][choice]
+}
+
+func NewChoiceFrequencies(epochs int64, numChoices int) ChoiceFrequencies {
+	cf := ChoiceFrequencies{
+		Global:        make([]int64, numChoices),
+		PerEpoch:      make([][]int64, epochs),
+		AfterPrevious: make([][]int64, numChoices+1),
+	}
+	for eID := range cf.PerEpoch {
+		cf.PerEpoch[eID] = make([]int64, numChoices)
+	}
+	for p := range cf.AfterPrevious {
+		cf.AfterPrevious[p] = make([]int64, numChoices)
+	}
+	return cf
+}
+
+func (cf *ChoiceFrequencies) Add(epochID int64, previous int, choice int) {
+	cf.Global[choice]++
+	cf.PerEpoch[epochID][choice]++
+	cf.AfterPrevious[previous+1][choice]++
+}
+
+func (cf *ChoiceFrequencies) Merge(other *ChoiceFrequencies) {
+	for c := range cf.Global {
+		cf.Global[c] += other.Global[c]
+		for eID := range cf.PerEpoch {
+			cf.PerEpoch[eID][c] += other.PerEpoch[eID][c]
+		}
+		for p := range cf.AfterPrevious {
+			cf.AfterPrevious[p][c] += other.AfterPrevious[p][c]
+		}
+	}
+}
+
+type SelectorMode int
+
+const SELECTORS_FIXED SelectorMode = 0          // The choice number in binary (2 bits for the built in four)
+const SELECTORS_GLOBAL SelectorMode = 1         // One Huffman code for the whole chain
+const SELECTORS_PER_EPOCH SelectorMode = 2      // A Huffman code per epoch
+const SELECTORS_AFTER_PREVIOUS SelectorMode = 3 // A Huffman code for each choice of the previous amount
+const NUM_SELECTOR_MODES = 4
+
+var SELECTOR_MODE_NAMES = [NUM_SELECTOR_MODES]string{"Fixed", "Global", "PerEpoch", "AfterPrevious"}
+
+// SelectorCodes holds a selector code table for every mode. Mode is the one actually used to encode;
+// the others can still be costed, to report what they would have saved.
+type SelectorCodes struct {
+	Mode          SelectorMode
+	fixedBits     int // Enough bits for any choice number
+	global        map[int64]huffman.BitCode
+	perEpoch      []map[int64]huffman.BitCode
+	afterPrevious []map[int64]huffman.BitCode // [previous choice + 1]
+
+	// For the decoder
+	globalDecoder        *huffman.Decoder
+	perEpochDecoders     []*huffman.Decoder
+	afterPreviousDecoder []*huffman.Decoder
+}
+
+func fixedSelectorBits(numChoices int) int {
+	return bits.Len(uint(numChoices - 1))
+}
+
+// FixedSelectorCodes are the fixed length selectors, with nothing adaptive to compare against
+func FixedSelectorCodes(numChoices int) *SelectorCodes {
+	return &SelectorCodes{Mode: SELECTORS_FIXED, fixedBits: fixedSelectorBits(numChoices)}
+}
+
+// NewSelectorCodes builds Huffman coded selectors from gathered frequencies
+func NewSelectorCodes(freqs *ChoiceFrequencies, mode SelectorMode) (*SelectorCodes, error) {
+	var err error
+	s := SelectorCodes{Mode: mode, fixedBits: fixedSelectorBits(len(freqs.Global))}
+	if s.global, err = selectorHuffman(freqs.Global); err != nil {
+		return nil, err
+	}
+	s.globalDecoder = huffman.NewDecoder(s.global, huffman.DEFAULT_TABLE_BITS)
+	s.perEpoch = make([]map[int64]huffman.BitCode, len(freqs.PerEpoch))
+	s.perEpochDecoders = make([]*huffman.Decoder, len(freqs.PerEpoch))
+	for eID := range freqs.PerEpoch {
+		if s.perEpoch[eID], err = selectorHuffman(freqs.PerEpoch[eID]); err != nil {
+			return nil, err
+		}
+		s.perEpochDecoders[eID] = huffman.NewDecoder(s.perEpoch[eID], huffman.DEFAULT_TABLE_BITS)
+	}
+	s.afterPrevious = make([]map[int64]huffman.BitCode, len(freqs.AfterPrevious))
+	s.afterPreviousDecoder = make([]*huffman.Decoder, len(freqs.AfterPrevious))
+	for p := range freqs.AfterPrevious {
+		if s.afterPrevious[p], err = selectorHuffman(freqs.AfterPrevious[p]); err != nil {
+			return nil, err
+		}
+		s.afterPreviousDecoder[p] = huffman.NewDecoder(s.afterPrevious[p], huffman.DEFAULT_TABLE_BITS)
+	}
+	return &s, nil
+}
+
+func selectorHuffman(counts []int64) (map[int64]huffman.BitCode, error) {
+	freqs := make(map[int64]int64, len(counts))
+	for c := range counts {
+		freqs[int64(c)] = counts[c] + 1 // Every choice must stay possible, even if it was never seen
+	}
+	return huffman.BuildCodes(freqs, 0)
+}
+
+// CodeFor is the selector code for a choice under any mode (fixed, if the mode has no tables)
+func (s *SelectorCodes) CodeFor(mode SelectorMode, epochID int64, previous int, choice int) huffman.BitCode {
+	switch mode {
+	case SELECTORS_GLOBAL:
+		if s.global != nil {
+			return s.global[int64(choice)]
+		}
+	case SELECTORS_PER_EPOCH:
+		if epochID < int64(len(s.perEpoch)) {
+			return s.perEpoch[epochID][int64(choice)]
+		}
+	case SELECTORS_AFTER_PREVIOUS:
+		if s.afterPrevious != nil {
+			return s.afterPrevious[previous+1][int64(choice)]
+		}
+	}
+	return huffman.BitCode{Bits: uint64(choice), Length: s.fixedBits}
+}
+
+// Code is the selector code for a choice under the mode actually in use
+func (s *SelectorCodes) Code(epochID int64, previous int, choice int) huffman.BitCode {
+	return s.CodeFor(s.Mode, epochID, previous, choice)
+}
+
+// Decode reads a selector written with Code
+func (s *SelectorCodes) Decode(r *huffman.BitReader, epochID int64, previous int) (int, error) {
+	var decoder *huffman.Decoder
+	switch s.Mode {
+	case SELECTORS_GLOBAL:
+		decoder = s.globalDecoder
+	case SELECTORS_PER_EPOCH:
+		if epochID < int64(len(s.perEpochDecoders)) {
+			decoder = s.perEpochDecoders[epochID]
+		}
+	case SELECTORS_AFTER_PREVIOUS:
+		if s.afterPreviousDecoder != nil {
+			decoder = s.afterPreviousDecoder[previous+1]
+		}
+	}
+	if decoder == nil {
+		choice, err := r.ReadBits(s.fixedBits) // The fixed selectors are just the choice in binary
+		return int(choice), err
+	}
+	choice, err := decoder.Decode(r)
+	return int(choice), err
+}
@@ -4,212 +4,132 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/KitchenMishap/pudding-huffman/calendar"
 	"github.com/KitchenMishap/pudding-huffman/huffman"
 	"github.com/KitchenMishap/pudding-huffman/kmeans"
-	"github.com/KitchenMishap/pudding-shed/chainreadinterface"
-	"golang.org/x/sync/errgroup"
+	"github.com/KitchenMishap/pudding-huffman/scanner"
 	"math"
 	"math/bits"
-	"math/rand"
-	"runtime"
-	"strconv"
 	"sync"
-	"sync/atomic"
-	"time"
 )
 
 type CompressionStats struct {
-	TotalBits     uint64
-	LiteralHits   uint64
-	LiteralBits   uint64
-	CelebrityHits uint64
-	CelebrityBits uint64
-	GhostHits     uint64
-	GhostBits     uint64
-	RestHits      uint64
-	RestBits      uint64
+	TotalBits    uint64
+	Encoders     []EncoderStats // In choice order (see encoders.go)
+	EncodedBits  uint64         // Bits actually written (and read back) by the AmountCodec
+	EncodedBytes uint64         // As above, but including the padding at the end of each block
+
+	// Coinbase transactions (their amounts are ALSO counted in the categories above)
+	CoinbaseHits         uint64
+	CoinbaseBits         uint64 // All the bits of the coinbase transactions, including the flags
+	CoinbaseFullyClaimed uint64
+
+	// What the same choices would cost with a rANS coder (see RansModels). Zero if there were no models.
+	TotalRansBits float64
+
+	// Selectors (which are included in the bits above)
+	SelectorBits       uint64                     // With the selector codes actually used
+	SelectorBitsByMode [NUM_SELECTOR_MODES]uint64 // What each mode would have cost, for the same choices
+	Choices            ChoiceFrequencies          // To build adaptive selector codes from, for next time
 }
 
-func ParallelAmountStatistics(chain chainreadinterface.IBlockChain,
-	handles chainreadinterface.IHandleCreator,
-	blocks int64,
-	blocksPerEpoch int64,
-	epochToCelebCodes []map[int64]huffman.BitCode,
-	max_base_10_exp int) (CompressionStats, []int64, []int64, error) {
+// EncoderStats are the amounts encoded by one of the registered encoders (selectors included)
+type EncoderStats struct {
+	Name     string
+	Hits     uint64
+	Bits     uint64
+	RansBits float64 // What the same amounts would cost with a rANS coder
+}
 
-	sJob := "Stage 1: ParallelAmountStatistics() (PARALLEL by block)"
-	fmt.Printf("%s\n", sJob)
-	tJob := time.Now()
+func newEncoderStats(encoders []AmountEncoder) []EncoderStats {
+	stats := make([]EncoderStats, len(encoders))
+	for choice, encoder := range encoders {
+		stats[choice].Name = encoder.Name()
+	}
+	return stats
+}
 
-	blocksDone := uint64(0) // atomic int
+func ParallelAmountStatistics(ctx context.Context, scan *scanner.Scanner,
+	epochs *calendar.Epochs,
+	epochToCelebCodes []map[int64]huffman.BitCode,
+	max_base_10_exp int) (CompressionStats, []int64, []int64, error) {
 
-	workersDivider := 1
-	numWorkers := runtime.NumCPU() / workersDivider
-	if numWorkers > 8 {
-		numWorkers -= 4 // Save some for OS
-	}
-	//numWorkers = 1 // Serial test! I may be some time
+	blocks := epochs.BlockCount()
+	stage := scan.Reporter().Start("Stage 1: ParallelAmountStatistics() (PARALLEL by block)", blocks)
+	defer stage.Finish()
 
-	// Channels for distribution and collection
-	jobsChan := make(chan int64, 100) // Block numbers get squirted into here
 	type workerResult struct {
 		stats    CompressionStats
 		mags     []int64 // Base-2 magnitudes (for literals)
 		expFreqs []int64 // Base-10 exponents (for K-Means)
 	}
-	resultsChan := make(chan workerResult, numWorkers)
-	var wg sync.WaitGroup
-
-	// Create an errgroup and a context
-	g, ctx := errgroup.WithContext(context.Background())
+	finalStats := CompressionStats{}
+	finalMags := make([]int64, 65)
+	finalExpFreqs := make([]int64, max_base_10_exp)
 
-	for w := 0; w < numWorkers; w++ {
-		wg.Add(1)
-		g.Go(func() error { // Use the errgroup instead of "go func() {"
-			defer wg.Done()
-			local := workerResult{
+	err := scanner.ByBlock(ctx, scan, 0, blocks,
+		func() *workerResult {
+			return &workerResult{
 				mags:     make([]int64, 65),
 				expFreqs: make([]int64, max_base_10_exp),
 			}
-
-			for blockIdx := range jobsChan {
-				// Check if another worker already failed
-				select {
-				case <-ctx.Done():
-					return ctx.Err()
-				default:
+		},
+		func(local *workerResult, trans *scanner.Trans) error {
+			epochID := epochs.Of(trans.Block.Height)
+			for _, sats := range trans.Amounts {
+				amount := sats
+
+				// Stage 1: Celebrity
+				if _, ok := epochToCelebCodes[epochID][amount]; ok {
+					//local.stats.CelebrityHits++	No statistics in this run!
+					continue
 				}
 
-				epochID := blockIdx / blocksPerEpoch
-
-				blockHandle, err := handles.BlockHandleByHeight(int64(blockIdx))
-				if err != nil {
-					return err
-				}
-				block, err := chain.BlockInterface(blockHandle)
-				if err != nil {
-					return err
-				}
-				tCount, err := block.TransactionCount()
-				if err != nil {
-					return err
-				}
-				for t := int64(0); t < tCount; t++ {
-					transHandle, err := block.NthTransaction(t)
-					if err != nil {
-						return err
-					}
-					trans, err := chain.TransInterface(transHandle)
-					if err != nil {
-						return err
-					}
-					txoAmounts, err := trans.AllTxoSatoshis()
-					if err != nil {
-						return err
-					}
-					for _, sats := range txoAmounts {
-						amount := sats
-
-						// Stage 1: Celebrity
-						if _, ok := epochToCelebCodes[epochID][amount]; ok {
-							//local.stats.CelebrityHits++	No statistics in this run!
-							continue
-						}
-
-						// (The new) Stage 2: Literal (Initial Pass)
-						//local.stats.LiteralHits++			No statistics in this run!
-						local.mags[bits.Len64(uint64(amount))]++ // Increment for EVERY amount including zero
-						if amount > 0 {                          // Guard against log10(0)
-							exponent := int(math.Floor(math.Log10(float64(amount))))
-							if exponent >= 0 && exponent < len(local.expFreqs) {
-								local.expFreqs[exponent]++
-							}
-						}
+				// (The new) Stage 2: Literal (Initial Pass)
+				//local.stats.LiteralHits++			No statistics in this run!
+				local.mags[bits.Len64(uint64(amount))]++ // Increment for EVERY amount including zero
+				if amount > 0 {                          // Guard against log10(0)
+					exponent := int(math.Floor(math.Log10(float64(amount))))
+					if exponent >= 0 && exponent < len(local.expFreqs) {
+						local.expFreqs[exponent]++
 					}
-				} // For transaction
-				done := atomic.AddUint64(&blocksDone, 1)
-				if done%100000 == 0 || done == uint64(blocks) {
-					fmt.Printf("\r\tProgress: %.1f   ", float64(done*100)/float64(blocks))
 				}
-			} // For block
-			resultsChan <- local
+			}
 			return nil
-		})
-	}
-
-	// Feed the Channel (The Producer). This is now errgroup context-aware
-	go func() {
-		defer close(jobsChan)
-		for b := int64(0); b < blocks; b++ {
-			select { // Note: NOT a switch statement!
-			case jobsChan <- b: // This happens if a worker is free to be fed an epoch ID
-			case <-ctx.Done(): // This happens if a worker returned an err
-				return
+		},
+		func(res *workerResult) {
+			// No statistics for this run!
+			//finalStats.CelebrityHits += res.stats.CelebrityHits
+			//finalStats.LiteralHits += res.stats.LiteralHits
+
+			for i := 0; i < 65; i++ {
+				finalMags[i] += res.mags[i]
+			}
+			for i := 0; i < max_base_10_exp; i++ {
+				finalExpFreqs[i] += res.expFreqs[i]
 			}
-		}
-	}()
-	// Wait for completion and handle the error
-	if err := g.Wait(); err != nil {
+		},
+		stage.Add)
+	if err != nil {
 		return CompressionStats{}, nil, nil, err
 	}
 
-	wg.Wait()
-	close(resultsChan)
-	fmt.Printf("\n")
-	jobElapsed := time.Since(tJob)
-	fmt.Printf("\t%s: Job took: [%5.1f min]\n", sJob, jobElapsed.Minutes())
-
-	// --- REDUCE PHASE ---
-	sJob = "Stage 1: ParallelAmountStatistics() (SERIAL Reduction)"
-	fmt.Printf("%s\n", sJob)
-	tJob = time.Now()
-
-	finalStats := CompressionStats{}
-	finalMags := make([]int64, 65)
-	finalExpFreqs := make([]int64, max_base_10_exp)
-
-	for res := range resultsChan {
-		// No statistics for this run!
-		//finalStats.CelebrityHits += res.stats.CelebrityHits
-		//finalStats.LiteralHits += res.stats.LiteralHits
-
-		for i := 0; i < 65; i++ {
-			finalMags[i] += res.mags[i]
-		}
-		for i := 0; i < max_base_10_exp; i++ {
-			finalExpFreqs[i] += res.expFreqs[i]
-		}
-	}
-
-	jobElapsed = time.Since(tJob)
-	fmt.Printf("\t%s: Job took: [%5.1f min]\n", sJob, jobElapsed.Minutes())
-
 	return finalStats, finalMags, finalExpFreqs, nil
 }
 
-func ParallelGatherResidualFrequenciesByExp10(chain chainreadinterface.IBlockChain, handles chainreadinterface.IHandleCreator,
-	blocksPerEpoch int64,
-	blocksPerMicroEpoch int64,
-	blocks int64,
+func ParallelGatherResidualFrequenciesByExp10(ctx context.Context, scan *scanner.Scanner,
+	epochs *calendar.Epochs,
+	microEpochs *calendar.Epochs,
 	epochToCelebCodes []map[int64]huffman.BitCode,
 	microEpochToPhasePeaks [][]float64,
 	max_base_10_exp int) ([20]map[int64]int64, // First result: outer array index is the exponent (number of decimal zeros). Inner map is freq for each possible residual
-	map[int64]int64) { // Second result: frequencies of combined peak/harmonic index
-
-	tJob := time.Now()
-	sJob := "Stage 1.5, gather frequencies of residuals by exp magnitude (PARALLEL by block)"
-	fmt.Printf("%s\n", sJob)
+	map[int64]int64, // Second result: frequencies of combined peak/harmonic index
+	error) {
 
-	fmt.Printf("\tParallel phase...\n")
-	workersDivider := 1
-	numWorkers := runtime.NumCPU() / workersDivider
-	if numWorkers > 8 {
-		numWorkers -= 4 // Save some for OS
-	}
-	//numWorkers = 1 // Serial test! I may be some time
+	blocks := microEpochs.BlockCount()
+	stage := scan.Reporter().Start("Stage 1.5, gather frequencies of residuals by exp magnitude (PARALLEL by block)", blocks)
+	defer stage.Finish()
 
-	// Channels for distribution and collection
-	jobsChan := make(chan int64, 100) // Block numbers get squirted into here
 	if max_base_10_exp != 20 {
 		panic("You changed a constant!")
 	}
@@ -218,473 +138,311 @@ func ParallelGatherResidualFrequenciesByExp10(chain chainreadinterface.IBlockCha
 		localResidualsByExp [20]map[int64]int64
 		localCombinedFreq   map[int64]int64
 	}
-	resultsChan := make(chan workerResult, numWorkers)
-	var wg sync.WaitGroup
-
-	// Create an errgroup and a context
-	g, ctx := errgroup.WithContext(context.Background())
-
-	blocksDone := int64(0) // atomic
-
-	for w := 0; w < numWorkers; w++ {
-		wg.Add(1)
-		g.Go(func() error { // Use the errgroup instead of "go func() {"
-			defer wg.Done()
+	finalResidualsByExp := [20]map[int64]int64{}
+	for i := 0; i < max_base_10_exp; i++ {
+		finalResidualsByExp[i] = make(map[int64]int64)
+	}
+	finalCombinedFreqs := make(map[int64]int64)
 
-			if max_base_10_exp != 20 {
-				panic("You changed a constant!")
-			}
+	err := scanner.ByBlock(ctx, scan, 0, blocks,
+		func() *workerResult {
 			local := workerResult{}
 			local.localCombinedFreq = make(map[int64]int64)
 			for i := 0; i < max_base_10_exp; i++ {
 				local.localResidualsByExp[i] = make(map[int64]int64, MAX_PHASE_PEAKS)
 			}
+			return &local
+		},
+		func(local *workerResult, trans *scanner.Trans) error {
+			epochID := epochs.Of(trans.Block.Height)
+			microEpochID := microEpochs.Of(trans.Block.Height)
+			for _, sats := range trans.Amounts {
+				amount := sats
+
+				// Stage 1: Celebrity
+				if _, ok := epochToCelebCodes[epochID][amount]; ok {
+					continue
+				}
 
-			for blockIdx := range jobsChan {
-				// Check if another worker already failed
-				select {
-				case <-ctx.Done():
-					return ctx.Err()
-				default:
+				if microEpochToPhasePeaks[microEpochID] == nil || len(microEpochToPhasePeaks[microEpochID]) == 0 {
+					// This is probably an "early" week (epoch) where there weren't enough amount peaks to
+					// do the k-means analysis on (other than common "celebrity" amounts which bypass this already)
+					continue
 				}
 
-				epochID := blockIdx / blocksPerEpoch
-				microEpochID := blockIdx / blocksPerMicroEpoch
+				e, peak, harmonic, r := kmeans.ExpPeakResidual(amount, microEpochToPhasePeaks[microEpochID])
+				combined := peak*3 + harmonic
+				local.localCombinedFreq[int64(combined)]++
 
-				blockHandle, err := handles.BlockHandleByHeight(int64(blockIdx))
-				if err != nil {
-					return err
-				}
-				block, err := chain.BlockInterface(blockHandle)
-				if err != nil {
-					return err
-				}
-				tCount, err := block.TransactionCount()
-				if err != nil {
-					return err
+				if e >= 0 && e < max_base_10_exp {
+					local.localResidualsByExp[e][r]++
 				}
-				for t := int64(0); t < tCount; t++ {
-					transHandle, err := block.NthTransaction(t)
-					if err != nil {
-						return err
-					}
-					trans, err := chain.TransInterface(transHandle)
-					if err != nil {
-						return err
-					}
-					txoAmounts, err := trans.AllTxoSatoshis()
-					if err != nil {
-						return err
-					}
-					for _, sats := range txoAmounts {
-						amount := sats
-						// END new iteration code
-
-						// Stage 1: Celebrity
-						if _, ok := epochToCelebCodes[epochID][amount]; ok {
-							continue
-						}
-
-						if microEpochToPhasePeaks[microEpochID] == nil || len(microEpochToPhasePeaks[microEpochID]) == 0 {
-							// This is probably an "early" week (epoch) where there weren't enough amount peaks to
-							// do the k-means analysis on (other than common "celebrity" amounts which bypass this already)
-							continue
-						}
-
-						e, peak, harmonic, r := kmeans.ExpPeakResidual(amount, microEpochToPhasePeaks[microEpochID])
-						combined := peak*3 + harmonic
-						local.localCombinedFreq[int64(combined)]++
-
-						if e >= 0 && e < max_base_10_exp {
-							local.localResidualsByExp[e][r]++
-						}
-					}
-				} // for tranaction
-				done := atomic.AddInt64((*int64)(&blocksDone), 1)
-				fmt.Printf("\r\tProgress %5.1f   ", float64(done*100)/float64(blocksDone))
-			} // for block
-			resultsChan <- local
-			return nil
-		})
-	}
-
-	// Feed the workers
-	go func() {
-		defer close(jobsChan)
-		for b := int64(0); b < blocks; b++ {
-			select { // Note: NOT a switch statement!
-			case jobsChan <- b: // This happens if a worker is free to be fed an epoch ID
-			case <-ctx.Done(): // This happens if a worker returned an err
-				return
 			}
-		}
-	}()
-
-	wg.Wait()
-	close(resultsChan)
-
-	fmt.Printf("\n")
-	jobElapsed := time.Since(tJob)
-	fmt.Printf("\t%s: Job took: [%5.1f min]\n", sJob, jobElapsed.Minutes())
-
-	tJob = time.Now()
-	sJob = "\t(Serial Reduction)"
-	fmt.Printf("%s\n", sJob)
-
-	if max_base_10_exp != 20 {
-		panic("You changed a constant!")
-	}
-	finalResidualsByExp := [20]map[int64]int64{}
-	for i := 0; i < max_base_10_exp; i++ {
-		finalResidualsByExp[i] = make(map[int64]int64)
-	}
-	finalCombinedFreqs := make(map[int64]int64)
-
-	for res := range resultsChan {
-		// Merge the 20 exponent maps from this worker
-		for e := 0; e < max_base_10_exp; e++ {
-			for r, count := range res.localResidualsByExp[e] {
-				finalResidualsByExp[e][r] += count
+			return nil
+		},
+		func(res *workerResult) {
+			// Merge the 20 exponent maps from this worker
+			for e := 0; e < max_base_10_exp; e++ {
+				for r, count := range res.localResidualsByExp[e] {
+					finalResidualsByExp[e][r] += count
+				}
 			}
-		}
-		for combined := 0; combined < 24; combined++ {
-			if freq, ok := res.localCombinedFreq[int64(combined)]; ok {
-				finalCombinedFreqs[int64(combined)] += freq
+			for combined := 0; combined < 24; combined++ {
+				if freq, ok := res.localCombinedFreq[int64(combined)]; ok {
+					finalCombinedFreqs[int64(combined)] += freq
+				}
 			}
-		}
+		},
+		stage.Add)
+	if err != nil {
+		return [20]map[int64]int64{}, nil, err
 	}
 
-	jobElapsed = time.Since(tJob)
-	fmt.Printf("\t%s: Job took: [%5.1f min]\n", sJob, jobElapsed.Minutes())
-
-	return finalResidualsByExp, finalCombinedFreqs
-}
-
-func bucketCount(beans int64, beansPerBucket int64) int64 {
-	return (beans + beansPerBucket - 1) / beansPerBucket
+	return finalResidualsByExp, finalCombinedFreqs, nil
 }
 
 const MAX_PHASE_PEAKS = 1000
 const CSV_COLUMNS = 3
 
-func ParallelSimulateCompressionWithKMeans(chain chainreadinterface.IBlockChain, handles chainreadinterface.IHandleCreator,
-	blocksPerEpoch int64,
-	blocksPerMicroEpoch int64,
-	blocks int64,
-	epochToCelebCodes []map[int64]huffman.BitCode,
-	expCodes map[int64]huffman.BitCode,
-	residualCodesByExp []map[int64]huffman.BitCode,
-	magnitudeCodes map[int64]huffman.BitCode,
-	combinedCodes map[int64]huffman.BitCode,
-	microEpochToPhasePeaks [][]float64) (CompressionStats, [][CSV_COLUMNS]int64, *[2000000000]byte) {
+// The simulation reads the outputs and fees of each block from the scanner's source (see amounts.Source)
+func ParallelSimulateCompressionWithKMeans(ctx context.Context, scan *scanner.Scanner,
+	epochs *calendar.Epochs,
+	microEpochs *calendar.Epochs,
+	tables *EncoderTables,
+	selectorCodes *SelectorCodes) (CompressionStats, [][CSV_COLUMNS]int64, *kmeans.ExclusionIndex, error) {
+
+	// The real encoder/decoder, used to check that every block survives a round trip.
+	// The simulation costs the same encoders.
+	codec := NewAmountCodec(epochs, microEpochs, tables, selectorCodes)
+	encoders := codec.Encoders()
+	microEpochToPhasePeaks := tables.MicroEpochToPhasePeaks
 
 	mutex := &sync.Mutex{}
-	podiumForLiterals := huffman.NewPodium()
-	podiumForCelebrities := huffman.NewPodium()
-	podiumForGhosts := huffman.NewPodium()
-	podiumForRest := huffman.NewPodium()
+	podiums := make([]*huffman.Podium, len(encoders)) // One per encoder
+	for choice := range podiums {
+		podiums[choice] = huffman.NewPodium()
+	}
 	podiumForEverything := huffman.NewPodium()
 
-	completed := int64(0) // Atomic int
-
-	microEpochs := bucketCount(blocks, blocksPerMicroEpoch)
+	blocks := microEpochs.BlockCount()
+	stage := scan.Reporter().Start("Simulating compression (PARALLEL by block)", blocks)
+	defer stage.Finish()
 
-	workersDivider := 1
-	numWorkers := runtime.NumCPU() / workersDivider
-	if numWorkers > 8 {
-		numWorkers -= 4 // Save some for OS
+	// Sized by the transactions in the chain
+	latestTrans, err := scan.Chain().Blockchain().LatestTransaction()
+	if err != nil {
+		return CompressionStats{}, nil, nil, err
+	}
+	if !latestTrans.HeightSpecified() {
+		return CompressionStats{}, nil, nil, errors.New("transaction height not specified")
 	}
-	//numWorkers = 1 // Serial test! I may be some time
+	transToExcludedOutput := kmeans.NewExclusionIndex(latestTrans.Height() + 1)
 
-	jobsChan := make(chan int64, 100)
 	type workerResult struct {
 		stats         CompressionStats
 		peakStrengths [][CSV_COLUMNS]int64
+		transactions  []TransAmounts // The outputs and fees of the block being visited
 	}
-	resultsChan := make(chan workerResult, numWorkers)
-	var wg sync.WaitGroup
-
-	// Create an errgroup and a context
-	g, ctx := errgroup.WithContext(context.Background())
-
-	transToExcludedOutput := [2000000000]byte{}
+	globalStats := CompressionStats{}
+	globalStats.Choices = NewChoiceFrequencies(epochs.Count(), len(encoders))
+	globalStats.Encoders = newEncoderStats(encoders)
+	globalStrengths := make([][CSV_COLUMNS]int64, microEpochs.Count())
 
-	for w := 0; w < numWorkers; w++ {
-		wg.Add(1)
-		g.Go(func() error { // Use the errgroup instead of "go func() {"
-			defer wg.Done()
+	err = scanner.ByBlock(ctx, scan, 0, blocks,
+		func() *workerResult {
 			local := workerResult{
-				peakStrengths: make([][CSV_COLUMNS]int64, microEpochs),
+				peakStrengths: make([][CSV_COLUMNS]int64, microEpochs.Count()),
 			}
-
-			for blockIdx := range jobsChan {
-				// Check if another worker already failed
-				select {
-				case <-ctx.Done():
-					return ctx.Err()
-				default:
+			local.stats.Choices = NewChoiceFrequencies(epochs.Count(), len(encoders))
+			local.stats.Encoders = newEncoderStats(encoders)
+			return &local
+		},
+		func(local *workerResult, trans *scanner.Trans) error {
+			blockIdx := trans.Block.Height
+			t := trans.Index
+			if t == 0 {
+				// A new block (each is visited by one worker, in order). The fees were worked out from the txos
+				// each transaction spends, once (see amounts.Extract). The coinbase needs them all, as it claims
+				// the subsidy plus the block's fees.
+				fees, err := scan.Source().BlockFees(blockIdx)
+				if err != nil {
+					return err
 				}
+				local.transactions = BlockTransAmounts(trans.Block, fees)
+			}
 
-				epochID := blockIdx / blocksPerEpoch
-				microEpochID := blockIdx / blocksPerMicroEpoch
+			epochID := epochs.Of(blockIdx)
+			microEpochID := microEpochs.Of(blockIdx)
+			amountCtx := AmountContext{EpochID: epochID, MicroEpochID: microEpochID}
+
+			outputsAndFeesAmounts := make([]int64, 0, 100)
+
+			transIndex := trans.Height()
+			transToExcludedOutput.Set(transIndex, kmeans.NO_EXCLUSION) // Until we find an actual output to be excluded
+			// There is an extra amount we have to encode... fees.
+			// This is because fees are needed to infer the output that gets the two bit "the rest" code.
+			// For a transaction with n outputs, the encoded fees are added after the n outpus' codes
+			// (but a fully claimed coinbase has no fees to encode, see coinbase.go)
+			outputsAndFeesAmounts = append(outputsAndFeesAmounts, EncodedAmounts(local.transactions[t])...)
+			isCoinbase := local.transactions[t].IsCoinbase
+
+			// We have all the outputs and the fees for the transaction
+			// Work out the bit cost for every one of these (BEFORE we choose which is most bit-expensive)
+			// Every registered encoder is tried (see encoders.go), and the cheapest wins. The cost
+			// includes the selector that goes in front, which depends on the choice
+			// (and, for adaptive selectors, on the epoch and the previous choice).
+			outputsAndFeesEncodingChoice := make([]int, len(outputsAndFeesAmounts))
+			outputsAndFeesCosts := make([]int, len(outputsAndFeesAmounts))
+			previousChoice := CHOICE_START
+			for c, amount := range outputsAndFeesAmounts {
+				// Peak strengths are for oracle price prediction. They count every amount that COULD be a
+				// ghost, whichever encoding wins
+				if amount > 0 && len(microEpochToPhasePeaks[microEpochID]) > 0 {
+					e, peakIdx, _, r := kmeans.ExpPeakResidual(amount, microEpochToPhasePeaks[microEpochID])
+					if _, ok := tables.ResidualCodesByExp[e][r]; ok && peakIdx < CSV_COLUMNS {
+						local.peakStrengths[microEpochID][peakIdx]++ // Yes this IS supposed to be here. It's for oracle price prediction
+					}
+				}
 
-				blockHandle, err := handles.BlockHandleByHeight(int64(blockIdx))
+				choice, err := cheapestChoice(encoders, selectorCodes, amountCtx, previousChoice, amount)
 				if err != nil {
 					return err
 				}
-				block, err := chain.BlockInterface(blockHandle)
-				if err != nil {
-					return err
+				payloadBits, _ := encoders[choice].Cost(amountCtx, amount)
+				outputsAndFeesEncodingChoice[c] = choice
+				outputsAndFeesCosts[c] = selectorCodes.Code(epochID, previousChoice, choice).Length + payloadBits
+				previousChoice = choice
+			}
+			// Find the most costly output (or fees) of this transaction in terms of bitcount
+			mostExpensive := int(0)
+			loser := -1
+			for c, cost := range outputsAndFeesCosts {
+				if cost > mostExpensive {
+					mostExpensive = cost
+					loser = c
 				}
-				tCount, err := block.TransactionCount()
-				if err != nil {
-					return err
+			}
+			if loser < 0 {
+				return ErrNothingToEncode // As the codec would find (see EncodeBlock)
+			}
+			outputsAndFeesEncodingChoice[loser] = CHOICE_REST // Nothing else is needed for this output!
+
+			// Now the choices are final, put the selectors in front of the payloads
+			outputsAndFeesCodes := make([]*huffman.BitWriter, len(outputsAndFeesAmounts))
+			outputsAndFeesRansCosts := make([]float64, len(outputsAndFeesAmounts))
+			previousChoice = CHOICE_START
+			for c, amount := range outputsAndFeesAmounts {
+				choice := outputsAndFeesEncodingChoice[c]
+				selector := selectorCodes.Code(epochID, previousChoice, choice)
+				withSelector := huffman.JoinBitCodes(selector)
+				withSelector.AppendWriter(encoders[choice].Encode(amountCtx, amount))
+				outputsAndFeesCodes[c] = withSelector
+
+				// What every selector mode would have cost for the same choices
+				local.stats.Choices.Add(epochID, previousChoice, choice)
+				for mode := SelectorMode(0); mode < NUM_SELECTOR_MODES; mode++ {
+					local.stats.SelectorBitsByMode[mode] += uint64(selectorCodes.CodeFor(mode, epochID, previousChoice, choice).Length)
 				}
-				for t := int64(0); t < tCount; t++ {
-					outputsAndFeesAmounts := make([]int64, 0, 100)
-
-					transHandle, err := block.NthTransaction(t)
-					if err != nil {
-						return err
-					}
-					if !transHandle.HeightSpecified() {
-						return errors.New("transaction height not specified")
-					}
-					transIndex := transHandle.Height()
-					transToExcludedOutput[transIndex] = 255 // Unitl we find an actual output to be excluded
-					trans, err := chain.TransInterface(transHandle)
-					if err != nil {
-						return err
+				local.stats.SelectorBits += uint64(selector.Length)
+				if tables.RansModels != nil {
+					// The same choices costed with rANS
+					if coster, ok := encoders[choice].(RansCoster); ok {
+						outputsAndFeesRansCosts[c] = coster.RansCost(amountCtx, amount)
 					}
-					txoAmounts, err := trans.AllTxoSatoshis()
-					if err != nil {
-						return err
-					}
-					for _, sats := range txoAmounts {
-						amount := sats
-						outputsAndFeesAmounts = append(outputsAndFeesAmounts, amount)
-					}
-					// There is an extra amount we have to encode... fees.
-					// This is because fees are needed to infer the output that gets the two bit "the rest" code.
-					// For a transaction with n outputs, the encoded fees are added after the n outpus' codes
-					fees := rand.Intn(1000) + 1000 // Just a simulation for now... ToDo
-					outputsAndFeesAmounts = append(outputsAndFeesAmounts, int64(fees))
-
-					// We have all the outputs and the fees for the transaction
-					// Work out the bit cost for every one of these (BEFORE we choose which is most bit-expensive)
-					bigCode := huffman.BitCode{0xFFFFFFFFFFFFFFFF, 64}
-					celebSelector := huffman.BitCode{0b00, 2}
-					ghostSelector := huffman.BitCode{0b01, 2}
-					literalSelector := huffman.BitCode{0b10, 2}
-					restSelector := huffman.BitCode{0b11, 2}
-
-					outputsAndFeesCodes := make([]huffman.BitCode, len(outputsAndFeesAmounts))
-					outputsAndFeesEncodingChoice := make([]huffman.BitCode, len(outputsAndFeesAmounts))
-					outputsAndFeesQuotes := make([]string, len(outputsAndFeesAmounts))
-					for c, amount := range outputsAndFeesAmounts {
-
-						// Stage 1: Celebrity cost
-						// Intended to capture common numbers of satoshis like 50BTC and 0 sats
-						// The celebrity codes are now PER EPOCH
-						celebCode := bigCode
-						celebQuote := "?"
-						if aCode, ok := epochToCelebCodes[epochID][amount]; ok {
-							celebCode = huffman.JoinBitCodes(celebSelector, aCode)
-							if amount >= 100000 {
-								celebQuote = "Celeb BTC amount: " + strconv.FormatFloat(float64(amount)/100000000, 'f', 8, 64) + " BTC"
-							} else {
-								celebQuote = "Celeb BTC amount: " + strconv.FormatInt(amount, 10) + " sats"
-							}
-						}
-
-						// Stage 2: Ghost cost (maxint means ghost status not available)
-						// Intended to capture the "ghosts" of round numbers in fiat-land, when they are converted to satoshis
-						ghostCode := bigCode
-						ghostQuote := "?"
-						// Amount 0 will trigger a log10(0) and things will go wrong. But we know amount 0 will
-						// be treated as a celeb or literal so we're not interested in the "ghost" cost of a zero
-						if amount > 0 && microEpochToPhasePeaks[microEpochID] != nil && len(microEpochToPhasePeaks[microEpochID]) > 0 {
-							e, peakIdx, harmonic, r := kmeans.ExpPeakResidual(amount, microEpochToPhasePeaks[microEpochID])
-							if rCode, ok := residualCodesByExp[e][r]; ok {
-								// Now we have a huffman code for the combination of peak index and harmonic index.
-								// This is the initial cost...
-								combinedCode := combinedCodes[int64(3*peakIdx+harmonic)]
-								if peakIdx < CSV_COLUMNS {
-									local.peakStrengths[epochID][peakIdx]++ // Yes this IS supposed to be here. It's for oracle price prediction
-								}
-								if eCode, ok := expCodes[int64(e)]; ok {
-									ghostCode = huffman.JoinBitCodes(ghostSelector, combinedCode, eCode, rCode)
-									// 4 digit peak value in sats
-									digitsSats := int64(math.Round(math.Pow(10, microEpochToPhasePeaks[microEpochID][peakIdx]) * 1000))
-									ghostQuote = strconv.FormatInt(digitsSats, 10) + "sats (being harmonic "
-									ghostQuote += strconv.FormatInt(int64(harmonic), 10) + " of peak "
-									ghostQuote += strconv.FormatInt(int64(peakIdx), 10) + ") of the era, x 10e"
-									ghostQuote += strconv.FormatInt(int64(e-3), 10) + " and residual "
-									ghostQuote += strconv.FormatInt(r, 10)
-								} else {
-									panic("missing exp code")
-								}
-							}
-						}
-
-						// Stage 3: Magnitude-encoded Literal cost. Always available.
-						literalCode := bigCode
-						literalQuote := "?"
-						mag := int64(bits.Len64(uint64(amount))) // Number of bits in the literal (after the binary 0's)
-						// COULD BE 0 BITS! BE AWARE!
-						// One bit saving is clever. Because we can assume "0" is a celebrity (in fact we found that
-						// it's the most popular celebrity!), we know that amount is non zero. So we don't need
-						// to store mag bits, because we ALWAYS ALREADY KNOW that the first bit will be a 1. Why store it?
-						const oneBitSaving = 1
-						magCode := magnitudeCodes[mag] // A huffman code telling us the magnitude (number of bits)
-						var bts uint64
-						var bitsCount int
-						var bitsCode huffman.BitCode
-						if mag > 0 {
-							bts = uint64(amount ^ (1 << (mag - 1))) // Take off the clever missing 1
-							bitsCount = int(mag - oneBitSaving)
-							bitsCode = huffman.BitCode{bts, bitsCount}
-						} else {
-							// The magnitude is zero. The number is zero bits long. The NUMBER IS ZERO. There are no bits
-							bitsCode = huffman.BitCode{0, 0}
-						}
-						literalCode = huffman.JoinBitCodes(literalSelector, magCode, bitsCode)
-						literalQuote = "Literal: " + strconv.FormatInt(amount, 10) + " sats"
-
-						// Choose whichever choice of encoding is cheapest
-						choice := literalSelector
-						chosenCode := literalCode
-						chosenQuote := literalQuote
-						if celebCode.Length < chosenCode.Length {
-							choice = celebSelector
-							chosenCode = celebCode
-							chosenQuote = celebQuote
-						}
-						if ghostCode.Length < chosenCode.Length {
-							choice = ghostSelector
-							chosenCode = ghostCode
-							chosenQuote = ghostQuote
-						}
-
-						outputsAndFeesCodes[c] = chosenCode
-						outputsAndFeesEncodingChoice[c] = choice
-						outputsAndFeesQuotes[c] = chosenQuote
-					}
-					// Find the most costly output (or fees) of this transaction in terms of bitcount
-					mostExpensive := int(0)
-					loser := -1
-					for c, code := range outputsAndFeesCodes {
-						if code.Length > mostExpensive {
-							mostExpensive = code.Length
-							loser = c
-						}
-					}
-					outputsAndFeesCodes[loser] = restSelector // Nothing else is needed for this output!
-					outputsAndFeesEncodingChoice[loser] = restSelector
-					outputsAndFeesQuotes[loser] = "Rest: You can work out this amount from the rest of the transaction"
-
-					transactionBitcount := 0
-					mutex.Lock()
-					for c, code := range outputsAndFeesCodes {
-						transactionBitcount += code.Length
-						if outputsAndFeesEncodingChoice[c] == literalSelector {
-							local.stats.LiteralHits++
-							local.stats.LiteralBits += uint64(code.Length)
-							podiumForLiterals.Submit(code, outputsAndFeesQuotes[c])
-						}
-						if outputsAndFeesEncodingChoice[c] == celebSelector {
-							local.stats.CelebrityHits++
-							local.stats.CelebrityBits += uint64(code.Length)
-							podiumForCelebrities.Submit(code, outputsAndFeesQuotes[c])
-						}
-						if outputsAndFeesEncodingChoice[c] == ghostSelector {
-							local.stats.GhostHits++
-							local.stats.GhostBits += uint64(code.Length)
-							podiumForGhosts.Submit(code, outputsAndFeesQuotes[c])
-						}
-						if outputsAndFeesEncodingChoice[c] == restSelector {
-							local.stats.RestHits++
-							local.stats.RestBits += uint64(code.Length)
-							podiumForRest.Submit(code, outputsAndFeesQuotes[c])
-							// For this transaction (using the transaction's height as an index), we
-							// make a note of which transaction output (c) is to be excluded from the next
-							// round of ghost k-means peak estimation. We have room to store this as a byte.
-							// For a transaction with n outputs, if we specify a greater number (ie we store >=n),
-							// this means DO NOT EXCLUDE ANY OUTPUT. Also, regardless of n, 255 is a special value
-							// that also means "do not exclude any output"
-							if c < 255 {
-								// make a note to exclude output c from next k-means ghost peak estimation phase
-								transToExcludedOutput[transIndex] = byte(c)
-							} else {
-								// Not enough room in the byte to encode c.
-								// We are forced to use the special code 255 which always means "do not exclude any"
-								transToExcludedOutput[transIndex] = 255
-							}
-						}
-					}
-					mutex.Unlock()
-
-					local.stats.TotalBits += uint64(transactionBitcount)
+					outputsAndFeesRansCosts[c] += float64(selector.Length)
+				}
+				previousChoice = choice
+			}
 
-				} // For transactions
+			transactionBitcount := 0
+			if isCoinbase {
+				transactionBitcount += COINBASE_FLAG_BITS
+				if tables.RansModels != nil {
+					local.stats.TotalRansBits += COINBASE_FLAG_BITS
+				}
+			}
+			mutex.Lock()
+			for c, code := range outputsAndFeesCodes {
+				choice := outputsAndFeesEncodingChoice[c]
+				transactionBitcount += code.Len()
+				local.stats.TotalRansBits += outputsAndFeesRansCosts[c]
+				local.stats.Encoders[choice].Hits++
+				local.stats.Encoders[choice].Bits += uint64(code.Len())
+				local.stats.Encoders[choice].RansBits += outputsAndFeesRansCosts[c]
+				quote := "?"
+				if quoter, ok := encoders[choice].(AmountQuoter); ok {
+					quote = quoter.Quote(amountCtx, outputsAndFeesAmounts[c])
+				}
+				podiums[choice].Submit(code, quote)
+				podiumForEverything.Submit(code, quote) // The same codes, whichever encoder won
+				if choice == CHOICE_REST {
+					// For this transaction (using the transaction's height as an index), we
+					// make a note of which transaction output (c) is to be excluded from the next
+					// round of ghost k-means peak estimation. For a transaction with n outputs,
+					// c == n is the fees, which aren't an output, so nothing is excluded.
+					transToExcludedOutput.Set(transIndex, c)
+				}
+			}
+			mutex.Unlock()
+
+			local.stats.TotalBits += uint64(transactionBitcount)
+			if isCoinbase {
+				local.stats.CoinbaseHits++
+				local.stats.CoinbaseBits += uint64(transactionBitcount)
+				if local.transactions[t].FullyClaimed() {
+					local.stats.CoinbaseFullyClaimed++
+				}
+			}
 
-				// Report progress on completion
-				done := atomic.AddInt64(&completed, 1)
-				if done%10000 == 0 || done == blocks {
-					fmt.Printf("\r\tProgress: %.1f%%    ", float64(100*done)/float64(blocks))
+			if t == len(trans.Block.Trans)-1 {
+				// The block is done. Now do it for real, and check we can get the amounts back
+				bitLen, byteLen, err := codec.RoundTripBlock(blockIdx, local.transactions)
+				if err != nil {
+					return err
 				}
+				local.stats.EncodedBits += uint64(bitLen)
+				local.stats.EncodedBytes += uint64(byteLen)
 			}
-			resultsChan <- local
 			return nil
-		})
-	}
-	go func() {
-		defer close(jobsChan)
-		for b := int64(0); b < blocks; b++ {
-			select { // Note: NOT a switch statement!
-			case jobsChan <- b: // This happens if a worker is free to be fed an epoch ID
-			case <-ctx.Done(): // This happens if a worker returned an err
-				return
+		},
+		func(res *workerResult) {
+			globalStats.TotalBits += res.stats.TotalBits
+			globalStats.EncodedBits += res.stats.EncodedBits
+			globalStats.EncodedBytes += res.stats.EncodedBytes
+			globalStats.CoinbaseHits += res.stats.CoinbaseHits
+			globalStats.CoinbaseBits += res.stats.CoinbaseBits
+			globalStats.CoinbaseFullyClaimed += res.stats.CoinbaseFullyClaimed
+			globalStats.TotalRansBits += res.stats.TotalRansBits
+			globalStats.SelectorBits += res.stats.SelectorBits
+			for mode := 0; mode < NUM_SELECTOR_MODES; mode++ {
+				globalStats.SelectorBitsByMode[mode] += res.stats.SelectorBitsByMode[mode]
+			}
+			globalStats.Choices.Merge(&res.stats.Choices)
+			for choice := range globalStats.Encoders {
+				globalStats.Encoders[choice].Hits += res.stats.Encoders[choice].Hits
+				globalStats.Encoders[choice].Bits += res.stats.Encoders[choice].Bits
+				globalStats.Encoders[choice].RansBits += res.stats.Encoders[choice].RansBits
 			}
-		}
-	}()
-
-	wg.Wait()
-	close(resultsChan)
-	fmt.Printf("\nDone that now\n")
 
-	// Final Reduction
-	globalStats := CompressionStats{}
-	globalStrengths := make([][CSV_COLUMNS]int64, microEpochs)
-	for res := range resultsChan {
-		globalStats.TotalBits += res.stats.TotalBits
-		globalStats.CelebrityHits += res.stats.CelebrityHits
-		globalStats.CelebrityBits += res.stats.CelebrityBits
-		globalStats.GhostHits += res.stats.GhostHits
-		globalStats.GhostBits += res.stats.GhostBits
-		globalStats.LiteralHits += res.stats.LiteralHits
-		globalStats.LiteralBits += res.stats.LiteralBits
-		globalStats.RestHits += res.stats.RestHits
-		globalStats.RestBits += res.stats.RestBits
-
-		for me := int64(0); me < microEpochs; me++ {
-			for p := 0; p < CSV_COLUMNS; p++ {
-				globalStrengths[me][p] += res.peakStrengths[me][p]
+			for me := int64(0); me < microEpochs.Count(); me++ {
+				for p := 0; p < CSV_COLUMNS; p++ {
+					globalStrengths[me][p] += res.peakStrengths[me][p]
+				}
 			}
-		}
+		},
+		stage.Add)
+	if err != nil {
+		return CompressionStats{}, nil, nil, err
 	}
+	stage.Finish()
 
 	n := 10
-	fmt.Printf("Top %d OVERALL codes (Literal, Celebrity, Ghost, TheRest\n", n)
+	fmt.Printf("Top %d OVERALL codes (of every encoder):\n", n)
 	podiumForEverything.Rank(n)
-	fmt.Printf("Top %d Literal codes:\n", n)
-	podiumForLiterals.Rank(n)
-	fmt.Printf("Top %d Celebrity codes:\n", n)
-	podiumForCelebrities.Rank(n)
-	fmt.Printf("Top %d Ghost codes:\n", n)
-	podiumForGhosts.Rank(n)
-	fmt.Printf("Top %d TheRest codess:\n", n)
-	podiumForGhosts.Rank(n)
-
-	return globalStats, globalStrengths, &transToExcludedOutput
+	for choice, encoder := range encoders {
+		fmt.Printf("Top %d %s codes:\n", n, encoder.Name())
+		podiums[choice].Rank(n)
+	}
+
+	return globalStats, globalStrengths, transToExcludedOutput, nil
 }
@@ -0,0 +1,264 @@
+package compress
+
+import (
+	"errors"
+	"fmt"
+	"github.com/KitchenMishap/pudding-huffman/huffman"
+	"github.com/KitchenMishap/pudding-huffman/kmeans"
+	"math"
+	"math/bits"
+	"strconv"
+)
+
+// --- The Built In Amount Encoders ---
+
+// Stage 1: Celebrity
+// Intended to capture common numbers of satoshis like 50BTC and 0 sats
+// The celebrity codes are PER EPOCH
+type celebEncoder struct {
+	epochToCelebCodes    []map[int64]huffman.BitCode
+	epochToCelebDecoders []*huffman.Decoder
+	ransModels           *RansModels
+}
+
+func newCelebEncoder(tables *EncoderTables) AmountEncoder {
+	e := celebEncoder{epochToCelebCodes: tables.EpochToCelebCodes, ransModels: tables.RansModels}
+	e.epochToCelebDecoders = make([]*huffman.Decoder, len(tables.EpochToCelebCodes))
+	for eID, codes := range tables.EpochToCelebCodes {
+		e.epochToCelebDecoders[eID] = huffman.NewDecoder(codes, huffman.DEFAULT_TABLE_BITS)
+	}
+	return &e
+}
+
+func (e *celebEncoder) Name() string { return "Celebrity" }
+
+func (e *celebEncoder) Cost(ctx AmountContext, amount int64) (int, bool) {
+	aCode, ok := e.epochToCelebCodes[ctx.EpochID][amount]
+	return aCode.Length, ok
+}
+
+func (e *celebEncoder) Encode(ctx AmountContext, amount int64) *huffman.BitWriter {
+	return huffman.JoinBitCodes(e.epochToCelebCodes[ctx.EpochID][amount])
+}
+
+func (e *celebEncoder) Decode(ctx AmountContext, r *huffman.BitReader) (int64, error) {
+	return e.epochToCelebDecoders[ctx.EpochID].Decode(r)
+}
+
+func (e *celebEncoder) Quote(ctx AmountContext, amount int64) string {
+	if amount >= 100000 {
+		return "Celeb BTC amount: " + strconv.FormatFloat(float64(amount)/100000000, 'f', 8, 64) + " BTC"
+	}
+	return "Celeb BTC amount: " + strconv.FormatInt(amount, 10) + " sats"
+}
+
+func (e *celebEncoder) RansCost(ctx AmountContext, amount int64) float64 {
+	if e.ransModels == nil {
+		return 0
+	}
+	return e.ransModels.celebCost(ctx.EpochID, amount)
+}
+
+// Stage 2: Ghost
+// Intended to capture the "ghosts" of round numbers in fiat-land, when they are converted to satoshis
+type ghostEncoder struct {
+	expCodes               map[int64]huffman.BitCode
+	residualCodesByExp     []map[int64]huffman.BitCode
+	combinedCodes          map[int64]huffman.BitCode
+	microEpochToPhasePeaks [][]float64
+	ransModels             *RansModels
+
+	expDecoder            *huffman.Decoder
+	residualDecodersByExp []*huffman.Decoder
+	combinedDecoder       *huffman.Decoder
+}
+
+func newGhostEncoder(tables *EncoderTables) AmountEncoder {
+	e := ghostEncoder{
+		expCodes:               tables.ExpCodes,
+		residualCodesByExp:     tables.ResidualCodesByExp,
+		combinedCodes:          tables.CombinedCodes,
+		microEpochToPhasePeaks: tables.MicroEpochToPhasePeaks,
+		ransModels:             tables.RansModels,
+	}
+	e.expDecoder = huffman.NewDecoder(tables.ExpCodes, huffman.DEFAULT_TABLE_BITS)
+	e.residualDecodersByExp = make([]*huffman.Decoder, len(tables.ResidualCodesByExp))
+	for exp, codes := range tables.ResidualCodesByExp {
+		e.residualDecodersByExp[exp] = huffman.NewDecoder(codes, huffman.DEFAULT_TABLE_BITS)
+	}
+	e.combinedDecoder = huffman.NewDecoder(tables.CombinedCodes, huffman.DEFAULT_TABLE_BITS)
+	return &e
+}
+
+func (e *ghostEncoder) Name() string { return "Fiat Ghost" }
+
+// codes finds the combined (peak and harmonic), exponent and residual codes for an amount
+func (e *ghostEncoder) codes(ctx AmountContext, amount int64) (combinedCode, eCode, rCode huffman.BitCode, ok bool) {
+	peaks := e.microEpochToPhasePeaks[ctx.MicroEpochID]
+	// Amount 0 will trigger a log10(0) and things will go wrong. But we know amount 0 will
+	// be treated as a celeb or literal so we're not interested in the "ghost" cost of a zero
+	if amount <= 0 || len(peaks) == 0 {
+		return
+	}
+	exp, peakIdx, harmonic, r := kmeans.ExpPeakResidual(amount, peaks)
+	rCode, rOk := e.residualCodesByExp[exp][r]
+	combinedCode, cOk := e.combinedCodes[int64(3*peakIdx+harmonic)]
+	eCode, eOk := e.expCodes[int64(exp)]
+	return combinedCode, eCode, rCode, rOk && cOk && eOk
+}
+
+func (e *ghostEncoder) Cost(ctx AmountContext, amount int64) (int, bool) {
+	combinedCode, eCode, rCode, ok := e.codes(ctx, amount)
+	return combinedCode.Length + eCode.Length + rCode.Length, ok
+}
+
+func (e *ghostEncoder) Encode(ctx AmountContext, amount int64) *huffman.BitWriter {
+	combinedCode, eCode, rCode, _ := e.codes(ctx, amount)
+	return huffman.JoinBitCodes(combinedCode, eCode, rCode)
+}
+
+func (e *ghostEncoder) Decode(ctx AmountContext, r *huffman.BitReader) (int64, error) {
+	peaks := e.microEpochToPhasePeaks[ctx.MicroEpochID]
+	combined, err := e.combinedDecoder.Decode(r)
+	if err != nil {
+		return 0, err
+	}
+	exp, err := e.expDecoder.Decode(r)
+	if err != nil {
+		return 0, err
+	}
+	if exp < 0 || int(exp) >= len(e.residualDecodersByExp) {
+		return 0, fmt.Errorf("ghost exponent %d out of range", exp)
+	}
+	residual, err := e.residualDecodersByExp[exp].Decode(r)
+	if err != nil {
+		return 0, err
+	}
+	peakIdx := combined / 3
+	if peakIdx < 0 || int(peakIdx) >= len(peaks) {
+		return 0, fmt.Errorf("ghost peak %d out of range", peakIdx)
+	}
+	// Exactly as kmeans.ExpPeakResidual works out the peak amount
+	peakAmount := int64(math.Round(math.Pow(10, peaks[peakIdx]+float64(exp))))
+	return peakAmount + residual, nil
+}
+
+func (e *ghostEncoder) Quote(ctx AmountContext, amount int64) string {
+	peaks := e.microEpochToPhasePeaks[ctx.MicroEpochID]
+	exp, peakIdx, harmonic, r := kmeans.ExpPeakResidual(amount, peaks)
+	// 4 digit peak value in sats
+	digitsSats := int64(math.Round(math.Pow(10, peaks[peakIdx]) * 1000))
+	quote := strconv.FormatInt(digitsSats, 10) + "sats (being harmonic "
+	quote += strconv.FormatInt(int64(harmonic), 10) + " of peak "
+	quote += strconv.FormatInt(int64(peakIdx), 10) + ") of the era, x 10e"
+	quote += strconv.FormatInt(int64(exp-3), 10) + " and residual "
+	quote += strconv.FormatInt(r, 10)
+	return quote
+}
+
+func (e *ghostEncoder) RansCost(ctx AmountContext, amount int64) float64 {
+	if e.ransModels == nil {
+		return 0
+	}
+	peaks := e.microEpochToPhasePeaks[ctx.MicroEpochID]
+	exp, peakIdx, harmonic, r := kmeans.ExpPeakResidual(amount, peaks)
+	return e.ransModels.ghostCost(int64(3*peakIdx+harmonic), exp, r)
+}
+
+// Stage 3: Magnitude-encoded Literal. Always available.
+// One bit saving is clever. Because we can assume "0" is a celebrity (in fact we found that
+// it's the most popular celebrity!), we know that amount is non zero. So we don't need
+// to store mag bits, because we ALWAYS ALREADY KNOW that the first bit will be a 1. Why store it?
+// (A zero has magnitude zero, and no bits at all)
+type literalEncoder struct {
+	magnitudeCodes   map[int64]huffman.BitCode
+	magnitudeDecoder *huffman.Decoder
+	ransModels       *RansModels
+}
+
+func newLiteralEncoder(tables *EncoderTables) AmountEncoder {
+	return &literalEncoder{
+		magnitudeCodes:   tables.MagnitudeCodes,
+		magnitudeDecoder: huffman.NewDecoder(tables.MagnitudeCodes, huffman.DEFAULT_TABLE_BITS),
+		ransModels:       tables.RansModels,
+	}
+}
+
+func (e *literalEncoder) Name() string { return "Literal Satoshis" }
+
+// magnitude is the number of bits in the literal (after the binary 0's). COULD BE 0 BITS! BE AWARE!
+func magnitude(amount int64) int64 {
+	return int64(bits.Len64(uint64(amount)))
+}
+
+func (e *literalEncoder) Cost(ctx AmountContext, amount int64) (int, bool) {
+	mag := magnitude(amount)
+	if mag == 0 {
+		return e.magnitudeCodes[mag].Length, true
+	}
+	return e.magnitudeCodes[mag].Length + int(mag-1), true
+}
+
+func (e *literalEncoder) Encode(ctx AmountContext, amount int64) *huffman.BitWriter {
+	mag := magnitude(amount)
+	literal := huffman.JoinBitCodes(e.magnitudeCodes[mag]) // A huffman code telling us the magnitude (number of bits)
+	if mag > 0 {
+		literal.AppendBits(uint64(amount^(1<<(mag-1))), int(mag-1)) // Take off the clever missing 1
+	}
+	return literal
+}
+
+func (e *literalEncoder) Decode(ctx AmountContext, r *huffman.BitReader) (int64, error) {
+	mag, err := e.magnitudeDecoder.Decode(r)
+	if err != nil {
+		return 0, err
+	}
+	if mag == 0 {
+		return 0, nil
+	}
+	payload, err := r.ReadBits(int(mag - 1))
+	if err != nil {
+		return 0, err
+	}
+	return int64(payload | (1 << (mag - 1))), nil
+}
+
+func (e *literalEncoder) Quote(ctx AmountContext, amount int64) string {
+	return "Literal: " + strconv.FormatInt(amount, 10) + " sats"
+}
+
+func (e *literalEncoder) RansCost(ctx AmountContext, amount int64) float64 {
+	if e.ransModels == nil {
+		return 0
+	}
+	return e.ransModels.literalCost(magnitude(amount))
+}
+
+// The Rest
+// The most expensive amount of each transaction costs nothing but its selector, because it can be worked out
+// from the input total and the other amounts. So it is never chosen on cost; the caller picks it afterwards.
+type restEncoder struct{}
+
+func newRestEncoder(tables *EncoderTables) AmountEncoder {
+	return restEncoder{}
+}
+
+func (restEncoder) Name() string { return "The Rest" }
+
+func (restEncoder) Cost(ctx AmountContext, amount int64) (int, bool) {
+	return 0, false
+}
+
+func (restEncoder) Encode(ctx AmountContext, amount int64) *huffman.BitWriter {
+	return huffman.NewBitWriter() // Nothing else is needed for this amount!
+}
+
+var ErrRestNotDecodable = errors.New("the rest is inferred from the transaction, not decoded")
+
+func (restEncoder) Decode(ctx AmountContext, r *huffman.BitReader) (int64, error) {
+	return 0, ErrRestNotDecodable
+}
+
+func (restEncoder) Quote(ctx AmountContext, amount int64) string {
+	return "Rest: You can work out this amount from the rest of the transaction"
+}
@@ -0,0 +1,261 @@
+package evaluate
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/KitchenMishap/pudding-huffman/atomicfile"
+	"github.com/KitchenMishap/pudding-huffman/blockchain"
+	"github.com/KitchenMishap/pudding-huffman/calendar"
+	"github.com/KitchenMishap/pudding-huffman/kmeans"
+	"github.com/KitchenMishap/pudding-shed/chainreadinterface"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// DEFAULT_TOLERANCE is a phase error of 0.01, which is about 2.3% in price
+const DEFAULT_TOLERANCE = 0.01
+
+// OUTLIER_FACTOR times the tolerance makes a micro-epoch an outlier
+const OUTLIER_FACTOR = 5
+
+// MicroEpochResult compares the detected anchor peak of one micro-epoch with the reference price
+type MicroEpochResult struct {
+	MicroEpoch  int
+	Date        time.Time
+	Detected    float64 // Phase of the anchor peak in Oracle.csv
+	Expected    float64 // Phase of the reference price (see kmeans.PhaseOfPrice)
+	Error       float64 // Distance round the clock face, 0 to 0.5
+	Hit         bool    // Within tolerance
+	HarmonicHit bool    // Not a hit, but within tolerance of the 2 or 5 spoke (the wrong anchor was chosen)
+}
+
+// OutlierPeriod is a run of consecutive outlier micro-epochs
+type OutlierPeriod struct {
+	Start       time.Time
+	End         time.Time
+	MicroEpochs int
+	WorstError  float64
+}
+
+type Report struct {
+	Tolerance    float64
+	Results      []MicroEpochResult
+	Hits         int
+	HarmonicHits int
+	MeanError    float64
+	MedianError  float64
+	RMSError     float64
+	Outliers     []OutlierPeriod // Longest first
+}
+
+// LoadOracleAnchors reads the anchor peak of each micro-epoch from Oracle.csv (see jobs.exportOracleCSV)
+func LoadOracleAnchors(filename string) (map[int]float64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	anchorColumn := -1
+	if len(rows) > 0 {
+		for column, name := range rows[0] {
+			if name == "Anchor" {
+				anchorColumn = column
+			}
+		}
+	}
+	if anchorColumn < 0 {
+		return nil, fmt.Errorf("%s has no Anchor column", filename)
+	}
+	anchors := make(map[int]float64, len(rows))
+	for _, row := range rows[1:] {
+		me, err := strconv.Atoi(row[0])
+		if err != nil {
+			return nil, err
+		}
+		anchor, err := strconv.ParseFloat(row[anchorColumn], 64)
+		if err != nil || math.IsNaN(anchor) {
+			continue // No peaks were found for this micro-epoch
+		}
+		anchors[me] = anchor
+	}
+	return anchors, nil
+}
+
+// MicroEpochTimes is the time of the middle block of each micro-epoch, from the block timestamps
+func MicroEpochTimes(chain chainreadinterface.IBlockChain, handles chainreadinterface.IHandleCreator, microEpochs *calendar.Epochs) ([]time.Time, error) {
+	times := make([]time.Time, microEpochs.Count())
+	for me := range times {
+		first, end := microEpochs.Blocks(int64(me))
+		height := (first + end) / 2
+		blockHandle, err := handles.BlockHandleByHeight(height)
+		if err != nil {
+			return nil, err
+		}
+		block, err := chain.BlockInterface(blockHandle)
+		if err != nil {
+			return nil, err
+		}
+		ints, err := block.NonEssentialInts()
+		if err != nil {
+			return nil, err
+		}
+		secs, ok := (*ints)["time"]
+		if !ok {
+			return nil, fmt.Errorf("block %d has no time", height)
+		}
+		times[me] = time.Unix(secs, 0).UTC()
+	}
+	return times, nil
+}
+
+// Evaluate compares the detected anchors with the reference prices
+func Evaluate(anchors map[int]float64, times []time.Time, refs []ReferencePrice, tolerance float64) Report {
+	report := Report{Tolerance: tolerance}
+	spokes := []float64{math.Log10(2), math.Log10(5)}
+	for me, t := range times {
+		detected, ok := anchors[me]
+		if !ok {
+			continue
+		}
+		price, ok := PriceOn(refs, t)
+		if !ok {
+			continue
+		}
+		res := MicroEpochResult{MicroEpoch: me, Date: t, Detected: detected, Expected: kmeans.PhaseOfPrice(price)}
+		res.Error = kmeans.PhaseDistance(detected, res.Expected)
+		res.Hit = res.Error <= tolerance
+		if !res.Hit {
+			for _, spoke := range spokes {
+				if kmeans.PhaseDistance(detected, res.Expected+spoke) <= tolerance {
+					res.HarmonicHit = true
+				}
+			}
+		}
+		report.Results = append(report.Results, res)
+	}
+	if len(report.Results) == 0 {
+		return report
+	}
+
+	errs := make([]float64, len(report.Results))
+	sumSquares := 0.0
+	for i, res := range report.Results {
+		errs[i] = res.Error
+		report.MeanError += res.Error
+		sumSquares += res.Error * res.Error
+		if res.Hit {
+			report.Hits++
+		}
+		if res.HarmonicHit {
+			report.HarmonicHits++
+		}
+	}
+	n := float64(len(errs))
+	report.MeanError /= n
+	report.RMSError = math.Sqrt(sumSquares / n)
+	sort.Float64s(errs)
+	report.MedianError = errs[len(errs)/2]
+
+	// Runs of consecutive outliers
+	var current *OutlierPeriod
+	previousME := -2
+	for _, res := range report.Results {
+		if res.Error <= OUTLIER_FACTOR*tolerance {
+			current = nil
+			continue
+		}
+		if current == nil || res.MicroEpoch != previousME+1 {
+			report.Outliers = append(report.Outliers, OutlierPeriod{Start: res.Date})
+			current = &report.Outliers[len(report.Outliers)-1]
+		}
+		current.End = res.Date
+		current.MicroEpochs++
+		current.WorstError = math.Max(current.WorstError, res.Error)
+		previousME = res.MicroEpoch
+	}
+	sort.SliceStable(report.Outliers, func(i, j int) bool {
+		return report.Outliers[i].MicroEpochs > report.Outliers[j].MicroEpochs
+	})
+	return report
+}
+
+func (r *Report) Print(maxOutliers int) {
+	n := len(r.Results)
+	fmt.Printf("Micro-epochs compared: %d\n", n)
+	if n == 0 {
+		return
+	}
+	fmt.Printf("Phase error: mean %.4f, median %.4f, RMS %.4f\n", r.MeanError, r.MedianError, r.RMSError)
+	fmt.Printf("Hit rate (error <= %.4f): %.1f%% (%d)\n", r.Tolerance, 100*float64(r.Hits)/float64(n), r.Hits)
+	fmt.Printf("Locked onto the 2 or 5 spoke instead: %.1f%% (%d)\n", 100*float64(r.HarmonicHits)/float64(n), r.HarmonicHits)
+	fmt.Printf("Outlier periods (error > %.4f): %d\n", OUTLIER_FACTOR*r.Tolerance, len(r.Outliers))
+	for i, o := range r.Outliers {
+		if i >= maxOutliers {
+			break
+		}
+		fmt.Printf("\t%s to %s: %d micro-epochs, worst error %.4f\n", o.Start.Format(time.DateOnly), o.End.Format(time.DateOnly), o.MicroEpochs, o.WorstError)
+	}
+}
+
+// WriteCSV writes the comparison for every micro-epoch
+func (r *Report) WriteCSV(filename string) error {
+	return atomicfile.Write(filename, func(f io.Writer) error {
+		w := csv.NewWriter(f)
+		w.Write([]string{"microEpoch", "Date", "Detected", "Expected", "Error", "Hit", "HarmonicHit"})
+		for _, res := range r.Results {
+			w.Write([]string{
+				strconv.Itoa(res.MicroEpoch),
+				res.Date.Format(time.DateOnly),
+				fmt.Sprintf("%.4f", res.Detected),
+				fmt.Sprintf("%.4f", res.Expected),
+				fmt.Sprintf("%.4f", res.Error),
+				strconv.FormatBool(res.Hit),
+				strconv.FormatBool(res.HarmonicHit),
+			})
+		}
+		w.Flush()
+		return w.Error()
+	})
+}
+
+// Run evaluates Oracle.csv (from an earlier run on the same chain) against a reference price CSV,
+// and writes the comparison for every micro-epoch to Evaluation.csv
+func Run(reader blockchain.AccessChain, referenceFile string, oracleFile string, microEpochSpec calendar.Spec, tolerance float64) error {
+	refs, err := LoadReferencePrices(referenceFile)
+	if err != nil {
+		return err
+	}
+	anchors, err := LoadOracleAnchors(oracleFile)
+	if err != nil {
+		return err
+	}
+	blockTimes, err := calendar.ChainTimes(reader.Blockchain(), reader.HandleCreator())
+	if err != nil {
+		return err
+	}
+	microEpochs, err := calendar.NewEpochs(microEpochSpec, blockTimes)
+	if err != nil {
+		return err
+	}
+	times, err := MicroEpochTimes(reader.Blockchain(), reader.HandleCreator(), microEpochs)
+	if err != nil {
+		return err
+	}
+	report := Evaluate(anchors, times, refs, tolerance)
+	if len(report.Results) == 0 {
+		return errors.New("no micro-epochs had both a detected peak and a reference price")
+	}
+	report.Print(10)
+	return report.WriteCSV("Evaluation.csv")
+}
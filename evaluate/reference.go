@@ -0,0 +1,103 @@
+package evaluate
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReferencePrice is the fiat price of one BTC on a day, from a local CSV (date, price)
+type ReferencePrice struct {
+	Date  time.Time // UTC midnight
+	Price float64
+}
+
+// Date formats we accept in the reference CSV. A plain number is taken as unix seconds.
+var dateFormats = []string{"2006-01-02", "2006-01-02 15:04:05", time.RFC3339, "2006/01/02", "02/01/2006"}
+
+func parseDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	for _, format := range dateFormats {
+		if t, err := time.Parse(format, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("can't understand date %q", s)
+}
+
+// LoadReferencePrices reads a CSV of date, price. A header row (or any row whose price isn't a number) is skipped.
+// The result is sorted by date.
+func LoadReferencePrices(filename string) ([]ReferencePrice, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]ReferencePrice, 0, len(rows))
+	for i, row := range rows {
+		if len(row) < 2 {
+			continue
+		}
+		price, err := strconv.ParseFloat(strings.TrimSpace(row[1]), 64)
+		if err != nil {
+			continue // Header
+		}
+		date, err := parseDate(row[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s row %d: %w", filename, i+1, err)
+		}
+		if price <= 0 {
+			return nil, fmt.Errorf("%s row %d: price %f isn't positive", filename, i+1, price)
+		}
+		result = append(result, ReferencePrice{Date: truncateToDay(date), Price: price})
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("%s has no prices", filename)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Date.Before(result[j].Date) })
+	return result, nil
+}
+
+func truncateToDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// MAX_REFERENCE_GAP is how far a reference price can be from the date asked for
+const MAX_REFERENCE_GAP = 3 * 24 * time.Hour
+
+// PriceOn finds the reference price nearest to a time, if there is one close enough
+func PriceOn(refs []ReferencePrice, t time.Time) (float64, bool) {
+	day := truncateToDay(t)
+	i := sort.Search(len(refs), func(i int) bool { return !refs[i].Date.Before(day) })
+	best := -1
+	if i < len(refs) {
+		best = i
+	}
+	if i > 0 && (best < 0 || day.Sub(refs[i-1].Date) < refs[best].Date.Sub(day)) {
+		best = i - 1
+	}
+	if best < 0 {
+		return 0, false
+	}
+	gap := refs[best].Date.Sub(day)
+	if gap < 0 {
+		gap = -gap
+	}
+	if gap > MAX_REFERENCE_GAP {
+		return 0, false
+	}
+	return refs[best].Price, true
+}
@@ -0,0 +1,156 @@
+package huffman
+
+import (
+	"errors"
+	"strings"
+)
+
+// --- Arbitrary Length Bit Strings ---
+
+// BitWriter is a growable string of bits, stored MSB first. Unlike a BitCode it can't overflow.
+type BitWriter struct {
+	buf    []byte
+	length int // In bits
+}
+
+func NewBitWriter() *BitWriter {
+	return &BitWriter{}
+}
+
+// AppendBits appends the lowest n bits of bits, most significant first
+func (w *BitWriter) AppendBits(bits uint64, n int) {
+	for n > 0 {
+		used := w.length % 8
+		if used == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		// Fill as much of the current byte as we can in one go
+		take := 8 - used
+		if take > n {
+			take = n
+		}
+		chunk := byte((bits >> uint(n-take)) & (1<<uint(take) - 1))
+		w.buf[len(w.buf)-1] |= chunk << uint(8-used-take)
+		w.length += take
+		n -= take
+	}
+}
+
+func (w *BitWriter) Append(code BitCode) {
+	w.AppendBits(code.Bits, code.Length)
+}
+
+func (w *BitWriter) AppendWriter(other *BitWriter) {
+	full := other.length / 8
+	for i := 0; i < full; i++ {
+		w.AppendBits(uint64(other.buf[i]), 8)
+	}
+	if rest := other.length % 8; rest > 0 {
+		w.AppendBits(uint64(other.buf[full]>>uint(8-rest)), rest)
+	}
+}
+
+// Len is the number of bits written
+func (w *BitWriter) Len() int {
+	return w.length
+}
+
+// Bytes returns the bits packed into bytes. The final byte is padded with zero bits.
+func (w *BitWriter) Bytes() []byte {
+	return w.buf
+}
+
+// BitCode returns the bits as a BitCode, if there are few enough of them to fit
+func (w *BitWriter) BitCode() (BitCode, bool) {
+	if w.length > 64 {
+		return BitCode{}, false
+	}
+	r := NewBitReader(w.buf, w.length)
+	bits, _ := r.ReadBits(w.length)
+	return BitCode{Bits: bits, Length: w.length}, true
+}
+
+// String returns the binary representation (e.g., "0011")
+func (w *BitWriter) String() string {
+	sb := strings.Builder{}
+	for i := 0; i < w.length; i++ {
+		if (w.buf[i/8]>>uint(7-i%8))&1 == 1 {
+			sb.WriteByte('1')
+		} else {
+			sb.WriteByte('0')
+		}
+	}
+	return sb.String()
+}
+
+var ErrEndOfBits = errors.New("ran out of bits")
+
+// BitReader reads back bits written by a BitWriter
+type BitReader struct {
+	data   []byte
+	length int // In bits
+	pos    int // In bits
+}
+
+// NewBitReader reads the first length bits of data. A length of -1 means all of data.
+func NewBitReader(data []byte, length int) *BitReader {
+	if length < 0 || length > len(data)*8 {
+		length = len(data) * 8
+	}
+	return &BitReader{data: data, length: length}
+}
+
+// Remaining is the number of bits not yet read
+func (r *BitReader) Remaining() int {
+	return r.length - r.pos
+}
+
+// Peek returns the next n (up to 64) bits without consuming them. Beyond the end, zero bits are supplied.
+// The second result is how many of the n bits are real.
+func (r *BitReader) Peek(n int) (uint64, int) {
+	result := uint64(0)
+	got := 0
+	pos := r.pos
+	for got < n {
+		if pos >= r.length {
+			break
+		}
+		used := pos % 8
+		take := 8 - used
+		if take > n-got {
+			take = n - got
+		}
+		if take > r.length-pos {
+			take = r.length - pos
+		}
+		chunk := (r.data[pos/8] >> uint(8-used-take)) & (1<<uint(take) - 1)
+		result = (result << uint(take)) | uint64(chunk)
+		got += take
+		pos += take
+	}
+	return result << uint(n-got), got
+}
+
+// Skip consumes n bits
+func (r *BitReader) Skip(n int) error {
+	if n > r.Remaining() {
+		r.pos = r.length
+		return ErrEndOfBits
+	}
+	r.pos += n
+	return nil
+}
+
+// ReadBits consumes n (up to 64) bits and returns them
+func (r *BitReader) ReadBits(n int) (uint64, error) {
+	if n > r.Remaining() {
+		return 0, ErrEndOfBits
+	}
+	bits, _ := r.Peek(n)
+	r.pos += n
+	return bits, nil
+}
+
+func (r *BitReader) ReadBit() (uint64, error) {
+	return r.ReadBits(1)
+}
@@ -0,0 +1,167 @@
+package huffman
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// randomCode is a random code of the given length (with junk above the length, which must be ignored)
+func randomCode(length int, rng *rand.Rand) BitCode {
+	bits := rng.Uint64()
+	if length < 64 {
+		bits &= 1<<uint(length) - 1
+	}
+	return BitCode{Bits: bits, Length: length}
+}
+
+func TestBitWriterRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		lengths []int
+	}{
+		{"nothing", []int{}},
+		{"zero bits", []int{0, 0, 0}},
+		{"one bit", []int{1}},
+		{"63 bits", []int{63}},
+		{"64 bits", []int{64}},
+		{"64 bits off a byte boundary", []int{3, 64, 5, 64}},
+		{"63 bits then 1", []int{63, 1, 63, 1}},
+		{"exactly a byte", []int{8}},
+		{"byte, then bytes across boundaries", []int{8, 7, 9, 1, 15, 17}},
+		{"single bits", []int{1, 1, 1, 1, 1, 1, 1, 1, 1}},
+		{"all lengths", func() []int {
+			lengths := make([]int, 65)
+			for i := range lengths {
+				lengths[i] = i
+			}
+			return lengths
+		}()},
+	}
+	rng := rand.New(rand.NewSource(1))
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			codes := make([]BitCode, len(test.lengths))
+			w := NewBitWriter()
+			total := 0
+			for i, length := range test.lengths {
+				codes[i] = randomCode(length, rng)
+				w.Append(codes[i])
+				total += length
+			}
+			if w.Len() != total {
+				t.Fatalf("Len() is %d, want %d", w.Len(), total)
+			}
+			if len(w.Bytes()) != (total+7)/8 {
+				t.Fatalf("%d bytes for %d bits", len(w.Bytes()), total)
+			}
+
+			r := NewBitReader(w.Bytes(), w.Len())
+			for i, code := range codes {
+				if peeked, got := r.Peek(code.Length); got != code.Length || peeked != code.Bits {
+					t.Fatalf("code %d: peeked %d bits %b, want %s", i, got, peeked, code)
+				}
+				bits, err := r.ReadBits(code.Length)
+				if err != nil {
+					t.Fatalf("code %d: %v", i, err)
+				}
+				if bits != code.Bits {
+					t.Fatalf("code %d: read %b, want %s", i, bits, code)
+				}
+			}
+			if r.Remaining() != 0 {
+				t.Fatalf("%d bits left over", r.Remaining())
+			}
+
+			if code, ok := w.BitCode(); ok != (total <= 64) {
+				t.Fatalf("BitCode() ok is %v for %d bits", ok, total)
+			} else if ok && code.String() != w.String() {
+				t.Fatalf("BitCode() is %s, want %s", code, w.String())
+			}
+		})
+	}
+}
+
+func TestBitReaderEnd(t *testing.T) {
+	w := NewBitWriter()
+	w.AppendBits(0b10110, 5) // Padded with three zero bits to a byte
+
+	r := NewBitReader(w.Bytes(), w.Len())
+	if _, err := r.ReadBits(6); err != ErrEndOfBits {
+		t.Fatalf("reading 6 of 5 bits gave %v, want ErrEndOfBits", err)
+	}
+	if r.Remaining() != 5 {
+		t.Fatalf("a failed read consumed bits, %d remaining", r.Remaining())
+	}
+	// Peeking past the end supplies zero bits, and says how many were real
+	if bits, got := r.Peek(8); bits != 0b10110000 || got != 5 {
+		t.Fatalf("peeked %b (%d real bits), want 10110000 (5)", bits, got)
+	}
+	if bits, err := r.ReadBits(5); err != nil || bits != 0b10110 {
+		t.Fatalf("read %b, %v", bits, err)
+	}
+	if _, err := r.ReadBit(); err != ErrEndOfBits {
+		t.Fatalf("reading past the end gave %v, want ErrEndOfBits", err)
+	}
+	if _, got := r.Peek(10); got != 0 {
+		t.Fatalf("peeked %d real bits past the end", got)
+	}
+	if err := r.Skip(1); err != ErrEndOfBits {
+		t.Fatalf("skipping past the end gave %v, want ErrEndOfBits", err)
+	}
+
+	// The padding isn't data
+	r = NewBitReader(w.Bytes(), w.Len())
+	if err := r.Skip(6); err != ErrEndOfBits {
+		t.Fatalf("skipping into the padding gave %v, want ErrEndOfBits", err)
+	}
+	// But with a length of -1, all of the bytes are
+	r = NewBitReader(w.Bytes(), -1)
+	if bits, err := r.ReadBits(8); err != nil || bits != 0b10110000 {
+		t.Fatalf("read %b, %v", bits, err)
+	}
+}
+
+func TestAppendBitCodes(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, lengths := range [][2]int{{0, 0}, {0, 64}, {64, 0}, {1, 63}, {63, 1}, {32, 32}, {5, 7}} {
+		a, b := randomCode(lengths[0], rng), randomCode(lengths[1], rng)
+		if joined := AppendBitCodes(a, b); joined.String() != a.String()+b.String() {
+			t.Fatalf("AppendBitCodes(%s, %s) is %s", a, b, joined)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("AppendBitCodes didn't panic on 65 bits")
+		}
+	}()
+	AppendBitCodes(randomCode(1, rng), randomCode(64, rng))
+}
+
+func TestJoinBitCodes(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for trial := 0; trial < 200; trial++ {
+		codes := make([]BitCode, rng.Intn(12))
+		for i := range codes {
+			codes[i] = randomCode(rng.Intn(65), rng)
+		}
+		// The string based join that JoinBitCodes replaced
+		sb := strings.Builder{}
+		for _, code := range codes {
+			sb.WriteString(code.String())
+		}
+		joined := JoinBitCodes(codes...)
+		if joined.String() != sb.String() {
+			t.Fatalf("JoinBitCodes(%v) is %s, want %s", codes, joined.String(), sb.String())
+		}
+
+		// And joining writers is the same as joining the codes
+		half := len(codes) / 2
+		w := JoinBitCodes(codes[:half]...)
+		w.AppendWriter(JoinBitCodes(codes[half:]...))
+		if w.String() != sb.String() || w.Len() != joined.Len() || string(w.Bytes()) != string(joined.Bytes()) {
+			t.Fatalf("AppendWriter gave %s, want %s", w.String(), sb.String())
+		}
+	}
+}
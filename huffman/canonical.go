@@ -0,0 +1,171 @@
+package huffman
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+)
+
+// --- Canonical Codes ---
+
+// A canonical code depends only on the length of each symbol's code, so only the lengths need to be
+// stored. Symbols are ordered by code length then by symbol value, and codes are handed out by counting.
+
+type symbolLength struct {
+	Value  int64
+	Length int
+}
+
+func sortedSymbolLengths(lengths map[int64]int) []symbolLength {
+	sorted := make([]symbolLength, 0, len(lengths))
+	for value, length := range lengths {
+		sorted = append(sorted, symbolLength{Value: value, Length: length})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Length != sorted[j].Length {
+			return sorted[i].Length < sorted[j].Length
+		}
+		return sorted[i].Value < sorted[j].Value
+	})
+	return sorted
+}
+
+// CodeLengths strips a code table down to the length of each code
+func CodeLengths(codes map[int64]BitCode) map[int64]int {
+	lengths := make(map[int64]int, len(codes))
+	for value, code := range codes {
+		lengths[value] = code.Length
+	}
+	return lengths
+}
+
+// CanonicalCodes hands out canonical codes for the given code lengths.
+// The lengths must come from a valid prefix code (such as a Huffman tree).
+func CanonicalCodes(lengths map[int64]int) map[int64]BitCode {
+	table := make(map[int64]BitCode, len(lengths))
+	code := uint64(0)
+	prevLength := 0
+	for _, sl := range sortedSymbolLengths(lengths) {
+		code <<= uint(sl.Length - prevLength)
+		prevLength = sl.Length
+		table[sl.Value] = BitCode{Bits: code, Length: sl.Length}
+		code++
+	}
+	return table
+}
+
+// Canonicalize replaces the codes of a table (such as from GenerateBitCodes) with canonical codes
+// of the same lengths. The compression is identical, but the table can now be shipped as lengths only.
+func Canonicalize(codes map[int64]BitCode) map[int64]BitCode {
+	return CanonicalCodes(CodeLengths(codes))
+}
+
+// --- Serialization ---
+
+// WriteCodeTable stores just the symbol+length pairs of a (canonical) code table.
+// Entries are written in canonical order: a count, then for each entry the increase in length
+// since the previous entry and the symbol (as a delta from the previous symbol of the same length).
+func WriteCodeTable(w io.Writer, codes map[int64]BitCode) error {
+	bw := bufio.NewWriter(w)
+	buf := make([]byte, binary.MaxVarintLen64)
+
+	sorted := sortedSymbolLengths(CodeLengths(codes))
+	n := binary.PutUvarint(buf, uint64(len(sorted)))
+	if _, err := bw.Write(buf[:n]); err != nil {
+		return err
+	}
+	prevLength := 0
+	prevValue := int64(0)
+	for _, sl := range sorted {
+		if sl.Length != prevLength {
+			prevValue = 0
+		}
+		n = binary.PutUvarint(buf, uint64(sl.Length-prevLength))
+		if _, err := bw.Write(buf[:n]); err != nil {
+			return err
+		}
+		n = binary.PutVarint(buf, sl.Value-prevValue)
+		if _, err := bw.Write(buf[:n]); err != nil {
+			return err
+		}
+		prevLength = sl.Length
+		prevValue = sl.Value
+	}
+	return bw.Flush()
+}
+
+var ErrCorruptCodeTable = errors.New("corrupt code table")
+
+// MAX_TABLE_HINT caps the map size we preallocate from a table's count, which could be any old rubbish if corrupt
+const MAX_TABLE_HINT = 1 << 16
+
+// ReadCodeTable reads what WriteCodeTable wrote, and rebuilds the identical canonical codes.
+// It reads byte by byte, so it stops exactly at the end of the table (a bufio.Reader is ideal).
+// A table that doesn't describe a valid prefix code (a symbol twice, or more codes than the lengths
+// have room for) gives ErrCorruptCodeTable.
+func ReadCodeTable(br io.ByteReader) (map[int64]BitCode, error) {
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	lengths := make(map[int64]int, min(count, MAX_TABLE_HINT))
+	prevLength := 0
+	prevValue := int64(0)
+	for i := uint64(0); i < count; i++ {
+		lengthDelta, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		valueDelta, err := binary.ReadVarint(br)
+		if err != nil {
+			return nil, err
+		}
+		if lengthDelta != 0 {
+			prevValue = 0
+		} else if i > 0 && valueDelta <= 0 {
+			return nil, ErrCorruptCodeTable // Within a length, the symbols must be increasing
+		}
+		if lengthDelta > 64 || prevLength+int(lengthDelta) > 64 {
+			return nil, errors.New("code length over 64 bits in code table")
+		}
+		length := prevLength + int(lengthDelta)
+		value := prevValue + valueDelta
+		if _, seen := lengths[value]; seen {
+			return nil, ErrCorruptCodeTable
+		}
+		lengths[value] = length
+		prevLength = length
+		prevValue = value
+	}
+	if !fitsPrefixCode(lengths) {
+		return nil, ErrCorruptCodeTable
+	}
+	return CanonicalCodes(lengths), nil
+}
+
+// fitsPrefixCode says whether the lengths leave room for a prefix code (the Kraft sum is at most 1).
+// It counts through the canonical codes just as CanonicalCodes does, and checks none outgrows its length.
+func fitsPrefixCode(lengths map[int64]int) bool {
+	code := uint64(0)
+	prevLength := 0
+	full := false // The codes of length 64 have wrapped round to 0
+	for _, sl := range sortedSymbolLengths(lengths) {
+		if full {
+			return false
+		}
+		shift := uint(sl.Length - prevLength)
+		if shift > 0 && code > (1<<sl.Length-1)>>shift {
+			return false // code<<shift would be 2^Length (or more), one past the last code of this length
+		}
+		code <<= shift
+		prevLength = sl.Length
+		if sl.Length < 64 && code >= 1<<sl.Length {
+			return false
+		}
+		code++
+		full = code == 0
+	}
+	return true
+}
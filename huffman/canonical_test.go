@@ -0,0 +1,165 @@
+package huffman
+
+import (
+	"bufio"
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// The escape value the jobs use (see jobs.ESCAPE_VALUE)
+const testEscapeValue = -2200000000000000
+
+// checkPrefixFree fails the test if any code is a prefix of another (including an equal code)
+func checkPrefixFree(t *testing.T, codes map[int64]BitCode) {
+	t.Helper()
+	for a, codeA := range codes {
+		for b, codeB := range codes {
+			if a == b || codeA.Length > codeB.Length {
+				continue
+			}
+			if codeB.Bits>>uint(codeB.Length-codeA.Length) == codeA.Bits {
+				t.Fatalf("code %s (for %d) is a prefix of %s (for %d)", codeA, a, codeB, b)
+			}
+		}
+	}
+}
+
+// checkCanonical fails the test unless, in order of length then value, each code follows on from the last
+// (counting up, then shifting left to the next length)
+func checkCanonical(t *testing.T, codes map[int64]BitCode) {
+	t.Helper()
+	next := uint64(0)
+	prevLength := 0
+	for i, sl := range sortedSymbolLengths(CodeLengths(codes)) {
+		if i > 0 {
+			next++
+		}
+		next <<= uint(sl.Length - prevLength)
+		prevLength = sl.Length
+		if codes[sl.Value].Bits != next {
+			t.Fatalf("code for %d is %s, want %d bits of %b", sl.Value, codes[sl.Value], sl.Length, next)
+		}
+	}
+}
+
+func TestCodeTableRoundTrip(t *testing.T) {
+	wideGaps := map[int64]int64{}
+	for i := int64(0); i < 50; i++ {
+		wideGaps[i*i*i*i*i*i*i*i*i*i] = 100 - i // Up to about 10^17 apart
+	}
+	wideGaps[-1<<62] = 3
+	rng := rand.New(rand.NewSource(1))
+	randomValues := map[int64]int64{}
+	for i := 0; i < 2000; i++ {
+		randomValues[rng.Int63()-rng.Int63()] = 1 + rng.Int63n(1000)
+	}
+
+	tests := []struct {
+		name      string
+		freqs     map[int64]int64
+		maxLength int
+	}{
+		{"single symbol", map[int64]int64{42: 7}, 24},
+		{"single negative symbol", map[int64]int64{-5: 1}, 24},
+		{"negative values and the escape", map[int64]int64{-1: 50, -2: 30, -1000: 5, testEscapeValue: 20, 0: 40, 7: 1}, 24},
+		{"wide value gaps", wideGaps, 24},
+		{"fibonacci, length limited", fibonacciFreqs(40), 20},
+		{"fibonacci, unlimited", fibonacciFreqs(40), 0},
+		{"random values", randomValues, 24},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			codes, err := BuildCodes(test.freqs, test.maxLength)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkPrefixFree(t, codes)
+			// Only length limited codes come out canonical, a plain Huffman tree's need Canonicalize
+			canonical := Canonicalize(codes)
+			if len(canonical) != len(codes) {
+				t.Fatalf("%d canonical codes, want %d", len(canonical), len(codes))
+			}
+			for value, code := range codes {
+				if canonical[value].Length != code.Length {
+					t.Fatalf("Canonicalize changed the length for %d from %d to %d", value, code.Length, canonical[value].Length)
+				}
+				if test.maxLength > 0 && canonical[value] != code {
+					t.Fatalf("Canonicalize changed the code for %d from %s to %s", value, code, canonical[value])
+				}
+			}
+			checkPrefixFree(t, canonical)
+			checkCanonical(t, canonical)
+			codes = canonical
+
+			var buf bytes.Buffer
+			if err := WriteCodeTable(&buf, codes); err != nil {
+				t.Fatal(err)
+			}
+			buf.WriteString("after") // The reader must stop exactly at the end of the table
+			r := bufio.NewReader(&buf)
+			read, err := ReadCodeTable(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(read) != len(codes) {
+				t.Fatalf("read %d codes, want %d", len(read), len(codes))
+			}
+			for value, code := range codes {
+				if read[value] != code {
+					t.Fatalf("code for %d read back as %s, want %s", value, read[value], code)
+				}
+			}
+			if rest, _ := r.ReadString(0); rest != "after" {
+				t.Fatalf("read on into %q", rest)
+			}
+		})
+	}
+}
+
+// TestCodeTableCorrupt checks that a truncated or corrupt table gives an error, rather than a panic or codes
+// that can't be decoded
+func TestCodeTableCorrupt(t *testing.T) {
+	codes, err := BuildCodes(zipfFreqs(300), 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteCodeTable(&buf, codes); err != nil {
+		t.Fatal(err)
+	}
+	table := buf.Bytes()
+
+	for n := 0; n < len(table); n++ {
+		if _, err := ReadCodeTable(bytes.NewReader(table[:n])); err == nil {
+			t.Fatalf("table truncated to %d of %d bytes was read without an error", n, len(table))
+		}
+	}
+
+	tests := []struct {
+		name  string
+		table []byte
+	}{
+		{"huge count", []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x01, 1, 0}},
+		{"code over 64 bits", []byte{1, 65, 0}},
+		{"same symbol twice", []byte{2, 1, 2, 0, 0}},
+		{"too many codes for their lengths", []byte{3, 1, 0, 0, 2, 0, 2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ReadCodeTable(bytes.NewReader(test.table)); err == nil {
+				t.Fatal("corrupt table was read without an error")
+			}
+		})
+	}
+
+	// Random damage mustn't panic (an error, or some other valid table, is fine)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		damaged := append([]byte(nil), table...)
+		damaged[rng.Intn(len(damaged))] ^= byte(1 + rng.Intn(255))
+		if read, err := ReadCodeTable(bytes.NewReader(damaged)); err == nil {
+			checkPrefixFree(t, read)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package huffman
+
+import (
+	"errors"
+)
+
+// --- Decoding ---
+
+// DEFAULT_TABLE_BITS is a lookup table of 2048 entries, enough for nearly every code we generate to be
+// decoded with a single peek
+const DEFAULT_TABLE_BITS = 11
+
+type decodeEntry struct {
+	value  int64
+	length int // 0 means no code of length <= tableBits starts with these bits
+}
+
+// Decoder decodes any prefix code table (from GenerateBitCodes, BuildCodes or ReadCodeTable).
+// Codes up to tableBits long are found with one lookup in a table indexed by the next tableBits bits.
+// Longer codes fall back to a map lookup, one length at a time.
+type Decoder struct {
+	tableBits int
+	table     []decodeEntry
+	long      map[BitCode]int64
+	maxLength int
+
+	// A code table with a single symbol has a zero length code
+	hasZeroLength bool
+	zeroValue     int64
+}
+
+func NewDecoder(codes map[int64]BitCode, tableBits int) *Decoder {
+	d := Decoder{long: make(map[BitCode]int64)}
+	for value, code := range codes {
+		if code.Length > d.maxLength {
+			d.maxLength = code.Length
+		}
+		if code.Length == 0 {
+			d.hasZeroLength = true
+			d.zeroValue = value
+		}
+	}
+	// No point in a table bigger than the longest code
+	if tableBits > d.maxLength {
+		tableBits = d.maxLength
+	}
+	d.tableBits = tableBits
+	d.table = make([]decodeEntry, 1<<uint(tableBits))
+
+	for value, code := range codes {
+		if code.Length == 0 {
+			continue
+		}
+		if code.Length > tableBits {
+			d.long[code] = value
+			continue
+		}
+		// Every index that starts with this code decodes to it
+		shift := uint(tableBits - code.Length)
+		first := code.Bits << shift
+		for i := uint64(0); i < 1<<shift; i++ {
+			d.table[first|i] = decodeEntry{value: value, length: code.Length}
+		}
+	}
+	return &d
+}
+
+var ErrInvalidCode = errors.New("bits don't match any code in the table")
+
+// Decode reads one code from r and returns its value
+func (d *Decoder) Decode(r *BitReader) (int64, error) {
+	if d.hasZeroLength {
+		return d.zeroValue, nil
+	}
+	bits, got := r.Peek(d.tableBits)
+	entry := d.table[bits]
+	if entry.length > 0 {
+		if entry.length > got {
+			return 0, ErrEndOfBits
+		}
+		return entry.value, r.Skip(entry.length)
+	}
+	// Long code
+	for length := d.tableBits + 1; length <= d.maxLength; length++ {
+		bits, got = r.Peek(length)
+		if got < length {
+			return 0, ErrEndOfBits
+		}
+		if value, ok := d.long[BitCode{Bits: bits, Length: length}]; ok {
+			return value, r.Skip(length)
+		}
+	}
+	return 0, ErrInvalidCode
+}
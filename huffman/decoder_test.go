@@ -0,0 +1,204 @@
+package huffman
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// fibonacciFreqs are the frequencies that give the deepest possible Huffman tree (n-1 levels for n symbols)
+func fibonacciFreqs(n int) map[int64]int64 {
+	freqs := make(map[int64]int64, n)
+	a, b := int64(1), int64(1)
+	for i := 0; i < n; i++ {
+		freqs[int64(i)*1000] = a
+		a, b = b, a+b
+	}
+	return freqs
+}
+
+// zipfFreqs are roughly how amounts (or residuals) are spread: a few common ones and a long tail
+func zipfFreqs(n int) map[int64]int64 {
+	freqs := make(map[int64]int64, n)
+	for i := 0; i < n; i++ {
+		freqs[int64(i)] = int64(1000000 / (i + 1))
+	}
+	return freqs
+}
+
+// randomSymbols picks count symbols at random, as often as their frequencies say
+func randomSymbols(freqs map[int64]int64, count int, rng *rand.Rand) []int64 {
+	var pool []int64
+	for value, freq := range freqs {
+		for i := int64(0); i < min(freq, 1000); i++ {
+			pool = append(pool, value)
+		}
+	}
+	symbols := make([]int64, count)
+	for i := range symbols {
+		symbols[i] = pool[rng.Intn(len(pool))]
+	}
+	return symbols
+}
+
+func encodeSymbols(codes map[int64]BitCode, symbols []int64) ([]byte, int) {
+	w := NewBitWriter()
+	for _, symbol := range symbols {
+		w.Append(codes[symbol])
+	}
+	return w.Bytes(), w.Len()
+}
+
+// bitByBitDecode is the slow, obvious decoder that the Decoder is checked (and benchmarked) against: read a bit
+// at a time until the bits so far are a code
+func bitByBitDecode(byCode map[BitCode]int64, r *BitReader) (int64, error) {
+	code := BitCode{}
+	for {
+		if value, ok := byCode[code]; ok {
+			return value, nil
+		}
+		if code.Length == 64 {
+			return 0, ErrInvalidCode
+		}
+		bit, err := r.ReadBit()
+		if err != nil {
+			return 0, err
+		}
+		code = BitCode{Bits: code.Bits<<1 | bit, Length: code.Length + 1}
+	}
+}
+
+func byCode(codes map[int64]BitCode) map[BitCode]int64 {
+	inverse := make(map[BitCode]int64, len(codes))
+	for value, code := range codes {
+		inverse[code] = value
+	}
+	return inverse
+}
+
+func TestDecoderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		freqs      map[int64]int64
+		maxLength  int
+		longerThan int // The longest code should be longer than this (to exercise the long code path)
+	}{
+		{"single symbol", map[int64]int64{42: 7}, 24, -1},
+		{"two symbols", map[int64]int64{-1: 1, 1: 1000}, 24, 0},
+		{"uniform", map[int64]int64{0: 5, 1: 5, 2: 5, 3: 5, 4: 5, 5: 5, 6: 5, 7: 5}, 24, 2},
+		{"zipf", zipfFreqs(1000), 24, DEFAULT_TABLE_BITS},
+		{"fibonacci, length limited", fibonacciFreqs(40), 24, DEFAULT_TABLE_BITS},
+		{"fibonacci, unlimited", fibonacciFreqs(40), 0, 24},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			codes, err := BuildCodes(test.freqs, test.maxLength)
+			if err != nil {
+				t.Fatal(err)
+			}
+			longest := 0
+			for _, code := range codes {
+				longest = max(longest, code.Length)
+				if test.maxLength > 0 && code.Length > test.maxLength {
+					t.Fatalf("code %s is longer than %d bits", code, test.maxLength)
+				}
+			}
+			if longest <= test.longerThan {
+				t.Fatalf("longest code is %d bits, wanted more than %d", longest, test.longerThan)
+			}
+
+			symbols := randomSymbols(test.freqs, 5000, rand.New(rand.NewSource(1)))
+			// The rarest symbols (with the longest codes) too, which random picks would hardly ever include
+			for value := range test.freqs {
+				symbols = append(symbols, value)
+			}
+			data, bits := encodeSymbols(codes, symbols)
+
+			decoder := NewDecoder(codes, DEFAULT_TABLE_BITS)
+			inverse := byCode(codes)
+			fast := NewBitReader(data, bits)
+			slow := NewBitReader(data, bits)
+			for i, want := range symbols {
+				got, err := decoder.Decode(fast)
+				if err != nil {
+					t.Fatalf("symbol %d: %v", i, err)
+				}
+				if got != want {
+					t.Fatalf("symbol %d: decoded %d, want %d", i, got, want)
+				}
+				got, err = bitByBitDecode(inverse, slow)
+				if err != nil || got != want {
+					t.Fatalf("symbol %d: bit by bit decoded %d (%v), want %d", i, got, err, want)
+				}
+			}
+			if fast.Remaining() != 0 {
+				t.Fatalf("%d bits left over", fast.Remaining())
+			}
+			if longest > 0 {
+				if _, err := decoder.Decode(fast); err != ErrEndOfBits {
+					t.Fatalf("decoding past the end gave %v, want ErrEndOfBits", err)
+				}
+			}
+		})
+	}
+}
+
+// TestDecoderTableBits checks that the size of the lookup table makes no difference to what is decoded
+func TestDecoderTableBits(t *testing.T) {
+	freqs := fibonacciFreqs(30)
+	codes, err := BuildCodes(freqs, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	symbols := randomSymbols(freqs, 2000, rand.New(rand.NewSource(2)))
+	for value := range freqs {
+		symbols = append(symbols, value)
+	}
+	data, bits := encodeSymbols(codes, symbols)
+	for _, tableBits := range []int{1, 4, DEFAULT_TABLE_BITS, 20, 32} {
+		decoder := NewDecoder(codes, tableBits)
+		r := NewBitReader(data, bits)
+		for i, want := range symbols {
+			got, err := decoder.Decode(r)
+			if err != nil || got != want {
+				t.Fatalf("table bits %d, symbol %d: decoded %d (%v), want %d", tableBits, i, got, err, want)
+			}
+		}
+	}
+}
+
+func BenchmarkDecoder(b *testing.B) {
+	freqs := zipfFreqs(100000) // About as many codes as an epoch's celebrities
+	codes, err := BuildCodes(freqs, 24)
+	if err != nil {
+		b.Fatal(err)
+	}
+	symbols := randomSymbols(freqs, 100000, rand.New(rand.NewSource(1)))
+	data, bits := encodeSymbols(codes, symbols)
+
+	b.Run("table", func(b *testing.B) {
+		decoder := NewDecoder(codes, DEFAULT_TABLE_BITS)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			r := NewBitReader(data, bits)
+			for range symbols {
+				if _, err := decoder.Decode(r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(symbols)), "ns/symbol")
+	})
+	b.Run("bit by bit", func(b *testing.B) {
+		inverse := byCode(codes)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			r := NewBitReader(data, bits)
+			for range symbols {
+				if _, err := bitByBitDecode(inverse, r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(symbols)), "ns/symbol")
+	})
+}
@@ -84,6 +84,8 @@ func GenerateBitCodes(node *Node, currentBits uint64, depth int, table map[int64
 
 // --- Bit Manipulation & Concatenation ---
 
+// AppendBitCodes joins two codes into one BitCode. Total length must be <= 64 (it panics otherwise),
+// use JoinBitCodes when that isn't guaranteed.
 func AppendBitCodes(a, b BitCode) BitCode {
 	if a.Length == 0 {
 		return b
@@ -91,17 +93,20 @@ func AppendBitCodes(a, b BitCode) BitCode {
 	if b.Length == 0 {
 		return a
 	}
-	// Note: Total length must be <= 64
+	if a.Length+b.Length > 64 {
+		panic(fmt.Sprintf("AppendBitCodes: %d+%d bits won't fit in a BitCode", a.Length, b.Length))
+	}
 	return BitCode{
 		Bits:   (a.Bits << b.Length) | b.Bits,
 		Length: a.Length + b.Length,
 	}
 }
 
-func JoinBitCodes(codes ...BitCode) BitCode {
-	result := BitCode{}
+// JoinBitCodes concatenates any number of codes, of any total length
+func JoinBitCodes(codes ...BitCode) *BitWriter {
+	result := NewBitWriter()
 	for _, c := range codes {
-		result = AppendBitCodes(result, c)
+		result.Append(c)
 	}
 	return result
 }
@@ -122,10 +127,11 @@ func NewPodium() *Podium {
 	return &Podium{Buckets: make(map[int]map[uint64]*Contender)}
 }
 
-func (p *Podium) Submit(code BitCode, words string) {
-	if code.Length > 16 || code.Length == 0 {
+func (p *Podium) Submit(bits *BitWriter, words string) {
+	if bits.Len() > 16 || bits.Len() == 0 {
 		return // Disqualified from the short-code podium
 	}
+	code, _ := bits.BitCode()
 
 	if p.Buckets[code.Length] == nil {
 		p.Buckets[code.Length] = make(map[uint64]*Contender)
@@ -0,0 +1,114 @@
+package huffman
+
+import (
+	"fmt"
+	"sort"
+)
+
+// --- Length Limited Codes (Package-Merge) ---
+
+// A plain Huffman tree can be very deep for skewed frequencies, and a BitCode only holds 64 bits.
+// Package-merge finds the optimal code lengths subject to a maximum length.
+
+type pmNode struct {
+	weight      int64
+	symbol      int // Index into the sorted leaves, or -1 for a package
+	left, right *pmNode
+}
+
+// LengthLimitedCodeLengths returns the optimal code length for each symbol, with no length over maxLength
+func LengthLimitedCodeLengths(freqs map[int64]int64, maxLength int) (map[int64]int, error) {
+	n := len(freqs)
+	lengths := make(map[int64]int, n)
+	if n == 0 {
+		return lengths, nil
+	}
+	if n == 1 {
+		for value := range freqs {
+			lengths[value] = 0 // Same as GenerateBitCodes for a tree with only one leaf
+		}
+		return lengths, nil
+	}
+	if maxLength < 1 || maxLength > 64 || (maxLength < 63 && int64(n) > int64(1)<<uint(maxLength)) {
+		return nil, fmt.Errorf("can't fit %d symbols into codes of at most %d bits", n, maxLength)
+	}
+
+	// Leaves in increasing order of weight (ties by value, so that the result is deterministic)
+	values := make([]int64, 0, n)
+	for value := range freqs {
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if freqs[values[i]] != freqs[values[j]] {
+			return freqs[values[i]] < freqs[values[j]]
+		}
+		return values[i] < values[j]
+	})
+	leaves := make([]*pmNode, n)
+	for i, value := range values {
+		leaves[i] = &pmNode{weight: freqs[value], symbol: i}
+	}
+
+	list := leaves
+	for level := 1; level < maxLength; level++ {
+		// Package adjacent pairs of the previous list...
+		packages := make([]*pmNode, 0, len(list)/2)
+		for i := 0; i+1 < len(list); i += 2 {
+			packages = append(packages, &pmNode{weight: list[i].weight + list[i+1].weight, symbol: -1, left: list[i], right: list[i+1]})
+		}
+		// ...and merge them with the leaves
+		merged := make([]*pmNode, 0, n+len(packages))
+		l, p := 0, 0
+		for l < n || p < len(packages) {
+			if p >= len(packages) || (l < n && leaves[l].weight <= packages[p].weight) {
+				merged = append(merged, leaves[l])
+				l++
+			} else {
+				merged = append(merged, packages[p])
+				p++
+			}
+		}
+		list = merged
+	}
+
+	// The code length of a symbol is the number of times it appears in the first 2n-2 items
+	counts := make([]int, n)
+	stack := make([]*pmNode, 0, 2*maxLength)
+	for _, item := range list[:2*n-2] {
+		stack = append(stack[:0], item)
+		for len(stack) > 0 {
+			node := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if node.symbol >= 0 {
+				counts[node.symbol]++
+			} else {
+				stack = append(stack, node.left, node.right)
+			}
+		}
+	}
+	for i, value := range values {
+		lengths[value] = counts[i]
+	}
+	return lengths, nil
+}
+
+// BuildCodes builds a code table from frequencies. A maxLength of 0 means no limit (a plain Huffman tree),
+// otherwise package-merge keeps every code within maxLength bits, and the codes are canonical.
+func BuildCodes(freqs map[int64]int64, maxLength int) (map[int64]BitCode, error) {
+	codes := make(map[int64]BitCode)
+	if maxLength <= 0 {
+		GenerateBitCodes(BuildHuffmanTree(freqs), 0, 0, codes)
+		for _, code := range codes {
+			if code.Length > 64 {
+				// The tree is too deep for a BitCode (or a Decoder) to hold, so the codes are garbage
+				return nil, fmt.Errorf("huffman tree for %d symbols is %d deep, give a maxLength", len(freqs), code.Length)
+			}
+		}
+		return codes, nil
+	}
+	lengths, err := LengthLimitedCodeLengths(freqs, maxLength)
+	if err != nil {
+		return nil, err
+	}
+	return CanonicalCodes(lengths), nil
+}
@@ -0,0 +1,141 @@
+package huffman
+
+import (
+	"math/big"
+	"testing"
+)
+
+// kraftSum is the sum of 2^-length over the codes, which is exactly 1 for a complete prefix code
+func kraftSum(lengths map[int64]int) *big.Rat {
+	sum := new(big.Rat)
+	for _, length := range lengths {
+		sum.Add(sum, new(big.Rat).SetFrac(big.NewInt(1), new(big.Int).Lsh(big.NewInt(1), uint(length))))
+	}
+	return sum
+}
+
+// cost is the total number of bits the frequencies take to encode with the given lengths
+func cost(freqs map[int64]int64, lengths map[int64]int) int64 {
+	total := int64(0)
+	for value, freq := range freqs {
+		total += freq * int64(lengths[value])
+	}
+	return total
+}
+
+func huffmanLengths(freqs map[int64]int64) map[int64]int {
+	codes := make(map[int64]BitCode)
+	GenerateBitCodes(BuildHuffmanTree(freqs), 0, 0, codes)
+	return CodeLengths(codes)
+}
+
+func TestLengthLimitedCodeLengths(t *testing.T) {
+	skewed := map[int64]int64{}
+	for i := int64(0); i < 30; i++ {
+		skewed[i] = 1 << uint(i) // Each symbol as common as all the rarer ones together (so a 29 deep tree)
+	}
+	equal := map[int64]int64{}
+	for i := int64(0); i < 64; i++ {
+		equal[i] = 5
+	}
+
+	tests := []struct {
+		name      string
+		freqs     map[int64]int64
+		maxLength int
+		binds     bool // The limit is tighter than the plain Huffman tree's depth
+	}{
+		{"two symbols", map[int64]int64{1: 1, 2: 1000}, 1, false},
+		{"fibonacci 20, no limit in practice", fibonacciFreqs(20), 64, false},
+		{"fibonacci 20, limit 19", fibonacciFreqs(20), 19, false},
+		{"fibonacci 20, limit 10", fibonacciFreqs(20), 10, true},
+		{"fibonacci 20, limit 5", fibonacciFreqs(20), 5, true},
+		{"fibonacci 90, limit 64", fibonacciFreqs(90), 64, true},
+		{"fibonacci 90, limit 24", fibonacciFreqs(90), 24, true},
+		{"powers of two, limit 12", skewed, 12, true},
+		{"zipf 1000, limit 24", zipfFreqs(1000), 24, false},
+		{"zipf 1000, limit 10 (just fits)", zipfFreqs(1000), 10, true},
+		{"64 equal, limit 6 (exactly full)", equal, 6, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lengths, err := LengthLimitedCodeLengths(test.freqs, test.maxLength)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(lengths) != len(test.freqs) {
+				t.Fatalf("%d lengths for %d symbols", len(lengths), len(test.freqs))
+			}
+			for value, length := range lengths {
+				if length < 1 || length > test.maxLength {
+					t.Fatalf("length %d for %d, want 1 to %d", length, value, test.maxLength)
+				}
+			}
+			if sum := kraftSum(lengths); sum.Cmp(big.NewRat(1, 1)) != 0 {
+				t.Fatalf("Kraft sum is %s, want 1", sum.RatString())
+			}
+
+			limitedCost := cost(test.freqs, lengths)
+			huffman := huffmanLengths(test.freqs)
+			huffmanCost := cost(test.freqs, huffman)
+			if !test.binds {
+				if limitedCost != huffmanCost {
+					t.Fatalf("cost %d bits, but plain Huffman is %d", limitedCost, huffmanCost)
+				}
+			} else if limitedCost < huffmanCost {
+				t.Fatalf("cost %d bits, better than optimal Huffman's %d", limitedCost, huffmanCost)
+			}
+
+			codes, err := BuildCodes(test.freqs, test.maxLength)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for value, code := range codes {
+				if code.Length != lengths[value] {
+					t.Fatalf("BuildCodes gave %d a %d bit code, want %d", value, code.Length, lengths[value])
+				}
+			}
+			checkPrefixFree(t, codes)
+			checkCanonical(t, codes)
+		})
+	}
+}
+
+func TestLengthLimitedSmall(t *testing.T) {
+	if lengths, err := LengthLimitedCodeLengths(map[int64]int64{}, 10); err != nil || len(lengths) != 0 {
+		t.Fatalf("no symbols gave %v, %v", lengths, err)
+	}
+	// A single symbol takes no bits at all, the same as a one leaf Huffman tree
+	if lengths, err := LengthLimitedCodeLengths(map[int64]int64{7: 3}, 10); err != nil || lengths[7] != 0 {
+		t.Fatalf("one symbol gave %v, %v", lengths, err)
+	}
+}
+
+func TestLengthLimitedRejects(t *testing.T) {
+	tests := []struct {
+		name      string
+		freqs     map[int64]int64
+		maxLength int
+	}{
+		{"zero length", zipfFreqs(10), 0},
+		{"negative length", zipfFreqs(10), -1},
+		{"longer than a BitCode", zipfFreqs(10), 65},
+		{"too many symbols for the length", zipfFreqs(9), 3},
+		{"too many symbols for 1 bit", zipfFreqs(3), 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if lengths, err := LengthLimitedCodeLengths(test.freqs, test.maxLength); err == nil {
+				t.Fatalf("got lengths %v, want an error", lengths)
+			}
+		})
+	}
+
+	// With no limit, a tree deeper than a BitCode can hold must be refused, not turned into garbage codes
+	if codes, err := BuildCodes(fibonacciFreqs(90), 0); err == nil {
+		t.Fatalf("got %d codes for a tree 89 deep, want an error", len(codes))
+	}
+	if _, err := BuildCodes(fibonacciFreqs(60), 0); err != nil {
+		t.Fatal(err)
+	}
+}
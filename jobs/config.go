@@ -0,0 +1,122 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/KitchenMishap/pudding-huffman/atomicfile"
+	"github.com/KitchenMishap/pudding-huffman/calendar"
+	"github.com/KitchenMishap/pudding-huffman/kmeans"
+	"github.com/KitchenMishap/pudding-huffman/oracle"
+	"io"
+	"os"
+	"runtime"
+)
+
+// Config is everything that a run can be tuned by. It can be read from a JSON file (see LoadConfig), and the
+// config actually used is written alongside the CSVs (EFFECTIVE_CONFIG_FILE).
+type Config struct {
+	Epoch            calendar.Spec // A number of blocks, or a UTC day, week or month
+	MicroEpoch       calendar.Spec
+	CelebCoverage    float64 // Fraction of an epoch's amounts that its celebrities should cover...
+	CelebMaxCodes    int     // ...using at most this many of them
+	ResidualCoverage float64 // Likewise for the residuals at each exp (their max codes come from GetSensibleMaxCodes)
+	CombinedMaxCodes int     // Codes for the combined peak and harmonic selection
+	Passes           int     // Of k-means then compression simulation. Each pass excludes the change outputs found by the last
+	Workers          int     // Per parallel stage (0 for as many as suit the CPUs, see NumWorkers)
+	KMeans           kmeans.Config
+	Oracle           oracle.Config
+	HourOfDay        bool   // Also report the strength of each currency at each UTC hour of the day (HourOfDay.csv)
+	Checkpoints      string // Folder to checkpoint each stage in, and resume from (empty for no checkpoints)
+	Incremental      bool   // Bring the previous run in Checkpoints up to date with the new blocks (see updateOracle)
+	Amounts          string // Folder to extract the txo amounts into once, for the later stages to read (empty to read the chain each time)
+	ProgressJSON     string // File to write each stage's progress to, as JSON lines (empty for none)
+	Metrics          string // Local address (such as localhost:9100) to serve Prometheus-style metrics at, during the run (empty for none)
+}
+
+// EFFECTIVE_CONFIG_FILE is where a run writes the config it used
+const EFFECTIVE_CONFIG_FILE = "EffectiveConfig.json"
+
+func DefaultConfig() Config {
+	return Config{
+		Epoch:            calendar.BlockCount(BLOCKS_PER_EPOCH),
+		MicroEpoch:       calendar.BlockCount(BLOCKS_PER_MICRO_EPOCH),
+		CelebCoverage:    0.7,
+		CelebMaxCodes:    100000,
+		ResidualCoverage: 0.99,
+		CombinedMaxCodes: 124,
+		Passes:           2,
+		Workers:          0,
+		KMeans:           kmeans.DefaultConfig(),
+		Oracle:           oracle.DefaultConfig(),
+	}
+}
+
+// NumWorkers is Workers, or if that's 0, the number of CPUs (less some for the OS if there are plenty)
+func (c Config) NumWorkers() int {
+	if c.Workers > 0 {
+		return c.Workers
+	}
+	workersDivider := 1
+	numWorkers := runtime.NumCPU() / workersDivider
+	if numWorkers > 8 {
+		numWorkers -= 4 // Save some for OS
+	}
+	return numWorkers
+}
+
+// Check catches settings that would make a run fail (or hang) part way through
+func (c Config) Check() error {
+	if c.CelebCoverage <= 0 || c.CelebCoverage > 1 || c.ResidualCoverage <= 0 || c.ResidualCoverage > 1 {
+		return errors.New("coverages must be more than 0 and at most 1")
+	}
+	if c.CelebMaxCodes < 1 || c.CombinedMaxCodes < 1 {
+		return errors.New("max codes must be at least 1")
+	}
+	// Each table also has an escape code, and every code must fit in the table's MAX_CODE_LENGTH_...
+	if c.CelebMaxCodes+1 > 1<<MAX_CODE_LENGTH_CELEB || c.CombinedMaxCodes+1 > 1<<MAX_CODE_LENGTH_COMBINED {
+		return fmt.Errorf("max codes must be less than %d for celebrities, and %d for combined codes",
+			1<<MAX_CODE_LENGTH_CELEB, 1<<MAX_CODE_LENGTH_COMBINED)
+	}
+	if c.Passes < 1 {
+		return errors.New("there must be at least one pass")
+	}
+	if c.Workers < 0 {
+		return errors.New("workers must not be negative")
+	}
+	if c.KMeans.Clusters < 1 || c.KMeans.ThinningRatio < 1 || c.KMeans.ThinningKeepFirst < 0 || c.KMeans.CurrencyTemplates < 0 {
+		return errors.New("k-means needs at least one cluster, a thinning ratio of at least 1, and no negative counts")
+	}
+	if c.Incremental && c.Checkpoints == "" {
+		return errors.New("incremental needs the checkpoints folder of a previous run")
+	}
+	return nil
+}
+
+// LoadConfig reads a JSON config file. Settings that the file leaves out keep their DefaultConfig values.
+func LoadConfig(filename string) (Config, error) {
+	config := DefaultConfig()
+	f, err := os.Open(filename)
+	if err != nil {
+		return Config{}, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields() // A misspelt setting would otherwise be silently ignored
+	if err := dec.Decode(&config); err != nil {
+		return Config{}, fmt.Errorf("%s: %w", filename, err)
+	}
+	return config, nil
+}
+
+// WriteConfig writes a config as JSON, which LoadConfig can read back
+func WriteConfig(filename string, config Config) error {
+	bytes, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(filename, func(f io.Writer) error {
+		_, err := f.Write(append(bytes, '\n'))
+		return err
+	})
+}
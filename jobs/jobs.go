@@ -1,21 +1,35 @@
 package jobs
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/csv"
+	"errors"
 	"fmt"
+	"github.com/KitchenMishap/pudding-huffman/amounts"
+	"github.com/KitchenMishap/pudding-huffman/atomicfile"
 	"github.com/KitchenMishap/pudding-huffman/blockchain"
+	"github.com/KitchenMishap/pudding-huffman/calendar"
+	"github.com/KitchenMishap/pudding-huffman/checkpoint"
 	"github.com/KitchenMishap/pudding-huffman/compress"
 	"github.com/KitchenMishap/pudding-huffman/huffman"
 	"github.com/KitchenMishap/pudding-huffman/kmeans"
+	"github.com/KitchenMishap/pudding-huffman/oracle"
+	"github.com/KitchenMishap/pudding-huffman/progress"
+	"github.com/KitchenMishap/pudding-huffman/scanner"
+	"github.com/KitchenMishap/pudding-shed/chainreadinterface"
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/text/language"
 	"golang.org/x/text/message"
+	"io"
 	"math"
 	"math/rand"
+	"net/http"
 	"os"
-	"runtime"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -84,9 +98,12 @@ func TruncateMapWithEscapeCode(all map[int64]int64, maxCodes int, captureCoverag
 		total += v
 		entries = append(entries, Entry{Value: k, Count: v})
 	}
-	// Sort
+	// Sort (ties by value, so that the same map is always truncated the same way, whatever the map order)
 	sort.Slice(entries, func(i, j int) bool {
-		return entries[i].Count > entries[j].Count
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Value < entries[j].Value
 	})
 	// Truncate
 	some := make(map[int64]int64)
@@ -107,10 +124,6 @@ func TruncateMapWithEscapeCode(all map[int64]int64, maxCodes int, captureCoverag
 	return some, reasonFlag
 }
 
-func bucketCount(beans int64, beansPerBucket int64) int64 {
-	return (beans + beansPerBucket - 1) / beansPerBucket
-}
-
 // Numbers up to 21 million btc (in sats) are unsafe to use as an escape code, because a txo amount could match.
 // So we go to 22 million (times 100,000,000 sats) and make it -ve for good measure
 const ESCAPE_VALUE = -2200000000000000
@@ -118,17 +131,69 @@ const ESCAPE_VALUE = -2200000000000000
 // The maximum number of zeroes at the end of a base 10 number. 15 is about enough for max supply of sats.
 const MAX_BASE_10_EXP = 20
 
-func GatherStatistics(folder string, deterministic *rand.Rand) error {
+// Maximum Huffman code lengths for each table (0 means no limit, a plain Huffman tree).
+// A table limited to n bits can have at most 2^n codes (see Config.Check).
+const MAX_CODE_LENGTH_CELEB = 24
+const MAX_CODE_LENGTH_COMBINED = 16
+const MAX_CODE_LENGTH_EXP = 8
+const MAX_CODE_LENGTH_RESIDUAL = 24
+const MAX_CODE_LENGTH_MAGNITUDE = 8
+
+const BLOCKS_PER_EPOCH = 144 * 28     // Roughly a month
+const BLOCKS_PER_MICRO_EPOCH = 6 * 24 // Roughly a day
+
+// How the celeb/ghost/literal/rest selectors are coded, once the first pass has gathered their frequencies
+const SELECTOR_MODE = compress.SELECTORS_AFTER_PREVIOUS
+
+// The checkpoint that an incremental run starts from: the oracle as it was at the end of the previous run
+const ORACLE_STAGE = "oracle"
+
+func GatherStatistics(ctx context.Context, folder string, deterministic *rand.Rand) error {
 	reader, err := blockchain.NewChainReader(folder)
+	if err != nil {
+		return err
+	}
+	return GatherStatisticsFromChain(ctx, reader, deterministic, DefaultConfig())
+}
+
+// GatherStatisticsFromChain runs all the stages on any chain (a pudding-shed folder, or a synthetic chain).
+// Epochs and micro-epochs are cut according to the config (a number of blocks, or a UTC day, week or month).
+// With HourOfDay, it also reports how strong each currency is at each UTC hour of the day (HourOfDay.csv).
+// Unless Checkpoints is empty, each stage is checkpointed there, and a rerun resumes from the last one.
+// With Incremental, a previous run's checkpoints (made when the chain was shorter) are brought up to date
+// instead (see updateOracle).
+// With Amounts, the txo amounts and the fees are extracted into that folder once (or just the new blocks, see
+// amounts.Extract), and the stages that need nothing else read them from there.
+// If ctx is cancelled (on Ctrl-C, say), the stage in progress stops and ctx's error is returned. The stages
+// already finished are checkpointed, and no output file is left half written.
+// Each stage's progress goes to the terminal, and to ProgressJSON and Metrics if they are set (see newReporter).
+func GatherStatisticsFromChain(ctx context.Context, reader blockchain.AccessChain, deterministic *rand.Rand, config Config) (err error) {
+	if err := config.Check(); err != nil {
+		return err
+	}
+	numWorkers := config.NumWorkers()
+	//numWorkers = 1 // Serial test! I may be some time
+
+	// The config actually used, alongside the CSVs
+	effective := config
+	effective.Workers = numWorkers
+	if err := WriteConfig(EFFECTIVE_CONFIG_FILE, effective); err != nil {
+		return err
+	}
+
+	reporter, closeReporter, err := newReporter(config)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, closeReporter())
+	}()
 
 	var startTime = time.Now()
 	elapsed := time.Since(startTime)
 	fmt.Printf("The time is now: %s\n", startTime.Format(time.TimeOnly))
 	fmt.Printf("[%5.1f min] %s\n", elapsed.Minutes(), "==** Very start Kinda (after user has typed!) **==")
 
-	if err != nil {
-		return err
-	}
 	chain := reader.Blockchain()
 	handles := reader.HandleCreator()
 	latestBlock, err := chain.LatestBlock()
@@ -138,255 +203,315 @@ func GatherStatistics(folder string, deterministic *rand.Rand) error {
 
 	blocks := latestBlock.Height() + 1
 
-	elapsed = time.Since(startTime)
-	sJob := "Creating the celebrity histograms per epoch (PARALLEL by epoch)"
-	tJob := time.Now()
-	fmt.Printf("[%5.1f min] %s\n", elapsed.Minutes(), sJob)
-
-	//const blocksPerEpoch = 144 * 7 // Roughly a week
-	//const blocksPerMicroEpoch = 6  // Roughly an hour
-	const blocksPerEpoch = 144 * 28    // Roughly a month
-	const blocksPerMicroEpoch = 6 * 24 // Roughly a day
-	numEpochs := bucketCount(blocks, blocksPerEpoch)
-
-	workersDivider := 1
-	numWorkers := runtime.NumCPU() / workersDivider
-	if numWorkers > 8 {
-		numWorkers -= 4 // Save some for OS
+	// Epoch boundaries (and the dates in the CSVs) come from the block timestamps
+	blockTimes, err := calendar.BlockTimes(chain, handles, blocks, calendar.TIME_FIELD)
+	if err != nil {
+		return err
 	}
-	//numWorkers = 1 // Serial test! I may be some time
-	fmt.Printf("\tNUMWORKERS:%d\n", numWorkers)
-
-	// Here we use the "worker pool" ("feed the  beast") pattern
-	// 1. Create a channel to hold the epochIDs
-	epochChan := make(chan int) // epochIDs get squirted into here
-
-	// 2. Create a slice to store the results (one map per epoch)
-	epochToCelebsMap := make([]map[int64]int64, numEpochs)
-
-	var wg sync.WaitGroup
+	epochs, err := calendar.NewEpochs(config.Epoch, blockTimes)
+	if err != nil {
+		return err
+	}
+	microEpochs, err := calendar.NewEpochs(config.MicroEpoch, blockTimes)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\t%d epochs (%s), %d micro-epochs (%s)\n", epochs.Count(), config.Epoch, microEpochs.Count(), config.MicroEpoch)
 
-	// Create an errgroup and a context
-	g, ctx := errgroup.WithContext(context.Background())
+	// Each stage's outputs are checkpointed, and loaded instead of worked out again if still valid
+	params := checkpointParams(config)
+	store, err := checkpoint.NewStore(config.Checkpoints, blocks, func(message string) { fmt.Printf("\t%s\n", message) })
+	if err != nil {
+		return err
+	}
 
-	// 3. Start the pool of workers
-	for w := 0; w < numWorkers; w++ {
-		wg.Add(1)
-		g.Go(func() error { // Use the errgroup instead of "go func() {"
-			defer wg.Done()
+	// An incremental run starts from the oracle of the previous run, which saw only previousBlocks blocks
+	var previousPhasePeaks [][]float64
+	var previousAnchors []float64
+	var previousCurrencies [][]kmeans.CurrencyTemplate
+	var previousStrengths [][compress.CSV_COLUMNS]int64
+	var previousExclude *kmeans.ExclusionIndex
+	previousBlocks := int64(0)
+	if config.Incremental {
+		previousBlocks, err = store.LoadLatest(ORACLE_STAGE, params.oracle, &previousPhasePeaks, &previousAnchors, &previousCurrencies, &previousStrengths, &previousExclude)
+		if err != nil {
+			return err
+		}
+		if previousBlocks == blocks {
+			fmt.Printf("\tAlready up to date (%d blocks)\n", blocks)
+			return nil
+		}
+		if previousBlocks == 0 {
+			fmt.Printf("\tNo previous run to bring up to date, so starting from scratch\n")
+		} else {
+			fmt.Printf("\t%d new blocks since the previous run\n", blocks-previousBlocks)
+		}
+	}
+	// Epochs before firstEpoch are unchanged since the previous run (if any)
+	firstEpoch := epochs.FirstChanged(previousBlocks)
+
+	// The stages that only need the txo amounts read them from the scanner's source
+	var source amounts.Source // nil to read them from the chain
+	if config.Amounts != "" {
+		elapsed = time.Since(startTime)
+		fmt.Printf("[%5.1f min] %s\n", elapsed.Minutes(), "==** Amounts extraction **==")
+		file, err := amounts.Extract(ctx, chain, handles, config.Amounts, numWorkers, reporter)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		source = file
+	}
+	scan, err := scanner.NewScanner(reader, source, numWorkers, reporter)
+	if err != nil {
+		return err
+	}
 
-			// Workers pull from the channel until it's closed
-			for eID := range epochChan {
-				// Check if another worker already failed
-				select {
-				case <-ctx.Done():
-					return ctx.Err()
-				default:
-				}
+	elapsed = time.Since(startTime)
+	fmt.Printf("[%5.1f min] %s\n", elapsed.Minutes(), "==** Celebrity histograms **==")
 
-				// --- WORKER LOGIC START ---
-				localMap := make(map[int64]int64)
+	numEpochs := epochs.Count()
 
-				startBlock := int64(eID * blocksPerEpoch)
-				endBlock := startBlock + blocksPerEpoch
-				if endBlock > blocks {
-					endBlock = blocks
-				}
+	fmt.Printf("\tNUMWORKERS:%d\n", numWorkers)
 
-				blockHandle, err := handles.BlockHandleByHeight(startBlock)
-				if err != nil {
-					return err
-				}
-				for b := startBlock; b < endBlock; b++ {
-					block, err := chain.BlockInterface(blockHandle)
-					if err != nil {
-						return err
-					}
-					tCount, err := block.TransactionCount()
-					if err != nil {
-						return err
-					}
-					for t := int64(0); t < tCount; t++ {
-						transHandle, err := block.NthTransaction(t)
-						if err != nil {
-							return err
-						}
-						trans, err := chain.TransInterface(transHandle)
-						if err != nil {
-							return err
-						}
-						txoAmounts, err := trans.AllTxoSatoshis()
-						if err != nil {
-							return err
-						}
-						for _, sats := range txoAmounts {
-							localMap[sats]++
-						}
-					}
-					blockHandle, err = chain.NextBlock(blockHandle)
-					if err != nil {
-						return err
-					}
-				}
+	// Results (one map per epoch)
+	epochToCelebsMap := make([]map[int64]int64, numEpochs)
 
-				// Save result to shared slice (this IS threadsafe because eID is unique)
-				epochToCelebsMap[eID] = localMap
-				// --- WORKER LOGIC END ---
-			}
-			return nil
-		})
+	loaded, err := store.Load("celebs", params.celebs, &epochToCelebsMap)
+	if err != nil {
+		return err
 	}
-	// 4. Feed the Channel (The Producer). This is now errgroup context-aware
-	go func() {
-		defer close(epochChan)
-		for eID := 0; eID < int(numEpochs); eID++ {
-			select { // Note: NOT a switch statement!
-			case epochChan <- eID: // This happens if a worker is free to be fed an epoch ID
-			case <-ctx.Done(): // This happens if a worker returned an err
-				return
+	if !loaded {
+		// The previous run's histograms only need the new blocks adding
+		scannedBlocks := int64(0)
+		if previousBlocks > 0 {
+			var previousCelebsMap []map[int64]int64
+			loadedBlocks, err := store.LoadLatest("celebs", params.celebs, &previousCelebsMap)
+			if err != nil {
+				return err
+			}
+			if loadedBlocks == previousBlocks {
+				scannedBlocks = previousBlocks
+				copy(epochToCelebsMap, previousCelebsMap)
 			}
 		}
-	}()
 
-	// Wait for completion and handle the error
-	if err := g.Wait(); err != nil {
-		return err
+		// Fanned out by epoch, so each epoch's map is only touched by one worker
+		stage := reporter.Start("Creating the celebrity histograms per epoch (PARALLEL by epoch)", blocks-scannedBlocks)
+		err = scanner.ByEpoch(ctx, scan, epochs, scannedBlocks, blocks, nil,
+			func(_ struct{}, trans *scanner.Trans) error {
+				localMap := epochToCelebsMap[trans.Epoch] // The previous run's, if any
+				if localMap == nil {
+					localMap = make(map[int64]int64)
+					epochToCelebsMap[trans.Epoch] = localMap
+				}
+				for _, sats := range trans.Amounts {
+					localMap[sats]++
+				}
+				return nil
+			}, nil, stage.Add)
+		stage.Finish()
+		if err != nil {
+			return err
+		}
+		if err := saveStage(ctx, store, "celebs", params.celebs, epochToCelebsMap); err != nil {
+			return err
+		}
 	}
 
-	jobElapsed := time.Since(tJob)
-	fmt.Printf("\t%s: Job took: [%5.1f min]\n", sJob, jobElapsed.Minutes())
-
 	elapsed = time.Since(startTime)
 	fmt.Printf("[%5.1f min] %s\n", elapsed.Minutes(), "==** Huffman per Epoch (now parallel) **==")
 
-	lock := sync.Mutex{}
-	reasonHist := make(map[int]int64)
-
-	// Build the Forest of Trees
-	// 1. Create the results slice
+	// The results
 	epochToCelebCodes := make([]map[int64]huffman.BitCode, numEpochs)
+	epochToCelebFreqs := make([]map[int64]int64, numEpochs) // Kept for the rANS models
+	epochToReason := make([]int, numEpochs)                 // Why each epoch's map was truncated
+	epochToTableBytes := make([]int64, numEpochs)           // Size of each epoch's serialized code table
 
-	// 2. Setup WaitGroup and Channel
-	//var wg sync.WaitGroup (use the previous one)
-	epochChan2 := make(chan int, numWorkers)
-
-	// 3. Start Workers
-	for w := 0; w < numWorkers; w++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for eID := range epochChan2 {
-				// Check for empty data
-				if len(epochToCelebsMap[eID]) == 0 {
-					continue
-				}
+	loaded, err = store.Load("celebcodes", params.celebCodes, &epochToCelebCodes, &epochToCelebFreqs, &epochToReason, &epochToTableBytes)
+	if err != nil {
+		return err
+	}
+	if !loaded {
+		// Only the epochs that have changed since the previous run need new codes
+		codesFirstEpoch := int64(0)
+		if previousBlocks > 0 {
+			var previousCodes []map[int64]huffman.BitCode
+			var previousFreqs []map[int64]int64
+			var previousReasons []int
+			var previousTableBytes []int64
+			loadedBlocks, err := store.LoadLatest("celebcodes", params.celebCodes, &previousCodes, &previousFreqs, &previousReasons, &previousTableBytes)
+			if err != nil {
+				return err
+			}
+			if loadedBlocks == previousBlocks {
+				codesFirstEpoch = firstEpoch
+				copy(epochToCelebCodes[:firstEpoch], previousCodes)
+				copy(epochToCelebFreqs[:firstEpoch], previousFreqs)
+				copy(epochToReason[:firstEpoch], previousReasons)
+				copy(epochToTableBytes[:firstEpoch], previousTableBytes)
+			}
+		}
 
+		// Build the Forest of Trees, an epoch per goroutine. (Not a scanner.ByEpoch, as no blocks are read: the
+		// histograms are already gathered, and the heavy lifting is building each epoch's codes.)
+		g, forestCtx := errgroup.WithContext(ctx)
+		g.SetLimit(numWorkers)
+		for eID := int(codesFirstEpoch); eID < int(numEpochs) && forestCtx.Err() == nil; eID++ {
+			// Check for empty data
+			if len(epochToCelebsMap[eID]) == 0 {
+				continue
+			}
+			g.Go(func() error {
 				// --- THE ACTUAL LOGIC ---
-				captureCoverage := 0.7
 				epochCelebsTruncated, reason := TruncateMapWithEscapeCode(
-					epochToCelebsMap[eID], 100000, captureCoverage, ESCAPE_VALUE,
+					epochToCelebsMap[eID], config.CelebMaxCodes, config.CelebCoverage, ESCAPE_VALUE,
 				)
-				lock.Lock()
-				reasonHist[reason]++
-				lock.Unlock()
+				epochToReason[eID] = reason
+				epochToCelebFreqs[eID] = epochCelebsTruncated
+				localCodes, err := huffman.BuildCodes(epochCelebsTruncated, MAX_CODE_LENGTH_CELEB)
+				if err != nil {
+					return err
+				}
+				// (BuildCodes gives canonical codes, so the table can be stored, and rebuilt by a decoder, as lengths only)
 
-				huffCelebRoot := huffman.BuildHuffmanTree(epochCelebsTruncated)
-				localCodes := make(map[int64]huffman.BitCode)
-				huffman.GenerateBitCodes(huffCelebRoot, 0, 0, localCodes)
+				tableBytes := bytes.Buffer{}
+				if err := huffman.WriteCodeTable(&tableBytes, localCodes); err != nil {
+					panic(err) // Can't happen writing to a bytes.Buffer
+				}
+				epochToTableBytes[eID] = int64(tableBytes.Len())
 
 				// Thread-safe write to independent slice index
 				epochToCelebCodes[eID] = localCodes
-			}
-		}()
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err // Interrupted before every epoch was fed
+		}
+		if err := saveStage(ctx, store, "celebcodes", params.celebCodes, epochToCelebCodes, epochToCelebFreqs, epochToReason, epochToTableBytes); err != nil {
+			return err
+		}
 	}
 
-	// 4. Feed the Workers
+	reasonHist := make(map[int]int64)
+	celebTablesBytes := int64(0)
 	for eID := 0; eID < int(numEpochs); eID++ {
-		epochChan2 <- eID
+		if len(epochToCelebsMap[eID]) > 0 {
+			reasonHist[epochToReason[eID]]++
+			celebTablesBytes += epochToTableBytes[eID]
+		}
 	}
-	close(epochChan2)
-	wg.Wait()
 
 	fmt.Printf("\tStatistics of why each map was truncated before being sent for Huffman encoding:\n")
 	fmt.Printf("\t%s: %d occurances\n", REASON_STRING_0, reasonHist[0])
 	fmt.Printf("\t%s: %d occurances\n", REASON_STRING_1, reasonHist[1])
 	fmt.Printf("\t%s: %d occurances\n", REASON_STRING_2, reasonHist[2])
+	fmt.Printf("\tCelebrity code tables (all epochs) serialize to %d bytes\n", celebTablesBytes)
+
+	if previousBlocks > 0 {
+		return updateOracle(ctx, chain, scan, epochs, microEpochs, firstEpoch, previousBlocks, epochToCelebCodes, deterministic, store, config,
+			previousPhasePeaks, previousAnchors, previousCurrencies, previousStrengths, previousExclude)
+	}
 
 	elapsed = time.Since(startTime)
 	fmt.Printf("[%5.1f min] %s\n", elapsed.Minutes(), "==** Simulating compression **==")
-	result, magFreqs, expFreqs, err := compress.ParallelAmountStatistics(chain, handles, blocks, blocksPerEpoch, epochToCelebCodes, MAX_BASE_10_EXP)
+	var result compress.CompressionStats
+	var magFreqs, expFreqs []int64
+	loaded, err = store.Load("amountstats", params.amountStats, &result, &magFreqs, &expFreqs)
 	if err != nil {
 		return err
 	}
+	if !loaded {
+		result, magFreqs, expFreqs, err = compress.ParallelAmountStatistics(ctx, scan, epochs, epochToCelebCodes, MAX_BASE_10_EXP)
+		if err != nil {
+			return err
+		}
+		if err := saveStage(ctx, store, "amountstats", params.amountStats, result, magFreqs, expFreqs); err != nil {
+			return err
+		}
+	}
 
-	fmt.Printf("\tCelebrity hits: %d\n", result.CelebrityHits)
-	fmt.Printf("\tLiteral hits: %d\n", result.LiteralHits)
+	_ = result // No statistics in this run!
 
 	elapsed = time.Since(startTime)
 	fmt.Printf("[%5.1f min] %s\n", elapsed.Minutes(), "==** Identifying fiat peaks (parallel) **==")
 
-	microEpochs := bucketCount(blocks, blocksPerMicroEpoch)
+	microEpochCount := microEpochs.Count()
+	microEpochDates := microEpochs.Dates()
 
 	var microEpochToPhasePeaks [][]float64
+	var microEpochToCurrencies [][]kmeans.CurrencyTemplate
 	var microEpochToPeakStrengths [][3]int64
+	microEpochToAnchor := make([]float64, microEpochCount) // The main peak (one unit of fiat), before the peaks are sorted
 
-	var exclude *[2000000000]byte = nil
-	for pass := 0; pass < 2; pass++ {
+	var exclude *kmeans.ExclusionIndex = nil
+	selectorCodes := compress.FixedSelectorCodes(compress.NumChoices()) // Until we've gathered some choice frequencies
+	for pass := 0; pass < config.Passes; pass++ {
 		fmt.Printf("\t==== Pass %d ====\n", pass)
 
-		microEpochToPhasePeaks, err := kmeans.ParallelKMeans(chain, handles, blocks, blocksPerMicroEpoch, epochToCelebCodes, blocksPerEpoch, deterministic, exclude)
+		kmeansStage := fmt.Sprintf("kmeans-pass%d", pass)
+		loaded, err = store.Load(kmeansStage, params.kmeans[pass], &microEpochToPhasePeaks, &microEpochToCurrencies)
 		if err != nil {
 			return err
 		}
-
-		if pass == 1 {
-			f, err := os.Create("FourDigits.csv")
+		if !loaded {
+			microEpochToPhasePeaks, microEpochToCurrencies, err = kmeans.ParallelKMeans(ctx, scan, epochs, microEpochs, epochToCelebCodes, deterministic, exclude, config.KMeans, 0)
 			if err != nil {
-				panic("couldn't open file")
-			}
-
-			//microEpochsPerEpoch := blocksPerEpoch / blocksPerMicroEpoch
-			for meID := 0; meID < int(microEpochs); meID++ {
-				dayCounter := meID
-				//TimeOfDay := meID % 24
-				year := 2009 + math.Round(100.0*(float64(dayCounter)/(52.1775*7.0)))/100.0
-				if len(microEpochToPhasePeaks[meID]) > 0 {
-					//				if TimeOfDay == 0 { // "One" timezone somewhere in the world
-					L := microEpochToPhasePeaks[meID][0]
-					val := math.Pow(10, -L)
-					for val < 1000 {
-						val *= 10
-					}
-					for val >= 10000 {
-						val /= 10
-					}
-					digits := int(val)
-					fmt.Fprintf(f, "%.2f, %d\n", year, digits)
-					//				}
-				}
+				return err
+			}
+			if err := saveStage(ctx, store, kmeansStage, params.kmeans[pass], microEpochToPhasePeaks, microEpochToCurrencies); err != nil {
+				return err
 			}
-			f.Close()
 		}
 
-		for meID := 0; meID < int(microEpochs); meID++ {
+		for meID := 0; meID < int(microEpochCount); meID++ {
+			microEpochToAnchor[meID] = math.NaN()
+			if len(microEpochToPhasePeaks[meID]) > 0 {
+				microEpochToAnchor[meID] = microEpochToPhasePeaks[meID][0]
+			}
 			// Sort the peaks for this epoch so Peak 0 is always the smallest phase
 			sort.Float64s(microEpochToPhasePeaks[meID])
 		}
+		if pass == config.Passes-1 {
+			if err := exportFourDigitsCSV("FourDigits.csv", microEpochToAnchor, microEpochDates); err != nil {
+				return err
+			}
+		}
 
 		if true {
 			elapsed = time.Since(startTime)
 			fmt.Printf("[%5.1f min] %s\n", elapsed.Minutes(), "Build residuals map (PARALLEL per exp) ")
 
-			residualsMapByExp, combinedFreq := compress.ParallelGatherResidualFrequenciesByExp10(chain, handles, blocksPerEpoch, blocksPerMicroEpoch, blocks, epochToCelebCodes, microEpochToPhasePeaks, MAX_BASE_10_EXP)
+			residualsStage := fmt.Sprintf("residuals-pass%d", pass)
+			var residualsMapByExp [20]map[int64]int64
+			var combinedFreq map[int64]int64
+			loaded, err = store.Load(residualsStage, params.residuals[pass], &residualsMapByExp, &combinedFreq)
+			if err != nil {
+				return err
+			}
+			if !loaded {
+				residualsMapByExp, combinedFreq, err = compress.ParallelGatherResidualFrequenciesByExp10(ctx, scan, epochs, microEpochs, epochToCelebCodes, microEpochToPhasePeaks, MAX_BASE_10_EXP)
+				if err != nil {
+					return err
+				}
+				if err := saveStage(ctx, store, residualsStage, params.residuals[pass], residualsMapByExp, combinedFreq); err != nil {
+					return err
+				}
+			}
 
 			elapsed = time.Since(startTime)
 			fmt.Printf("[%5.1f min] %s\n", elapsed.Minutes(), "==** More Huffman stuff **==")
 
 			fmt.Printf("Huffman tree for combined peak and harmonic selection\n")
-			combinedTruncated, reason := TruncateMapWithEscapeCode(combinedFreq, 124, 1.0, ESCAPE_VALUE)
-			huffCombinedRoot := huffman.BuildHuffmanTree(combinedTruncated)
-			combinedCodes := make(map[int64]huffman.BitCode)
-			huffman.GenerateBitCodes(huffCombinedRoot, 0, 0, combinedCodes)
+			combinedTruncated, reason := TruncateMapWithEscapeCode(combinedFreq, config.CombinedMaxCodes, 1.0, ESCAPE_VALUE)
+			combinedCodes, err := huffman.BuildCodes(combinedTruncated, MAX_CODE_LENGTH_COMBINED)
+			if err != nil {
+				return err
+			}
 			fmt.Printf("Reason (if any) why frequencies map was truncated\n")
 			if reason == 0 {
 				println(REASON_STRING_0)
@@ -400,16 +525,19 @@ func GatherStatistics(folder string, deterministic *rand.Rand) error {
 
 			fmt.Printf("Huffman trees for clockPhase residuals AT EACH EXP MAGNITUDE\n")
 			residualCodesByExp := make([]map[int64]huffman.BitCode, MAX_BASE_10_EXP)
+			residualFreqsByExp := make([]map[int64]int64, MAX_BASE_10_EXP)
 			reasonHist = make(map[int]int64)
 			for exp := 0; exp < MAX_BASE_10_EXP; exp++ {
 				// Build a specific tree for this exponent
 				// Lets pick a max number of codes.
 				maxCodes := GetSensibleMaxCodes(exp)
-				residualTruncated, reason := TruncateMapWithEscapeCode(residualsMapByExp[exp], maxCodes, 0.99, ESCAPE_VALUE)
+				residualTruncated, reason := TruncateMapWithEscapeCode(residualsMapByExp[exp], maxCodes, config.ResidualCoverage, ESCAPE_VALUE)
 				reasonHist[reason]++
-				huffResidualRoot := huffman.BuildHuffmanTree(residualTruncated)
-				residualCodesByExp[exp] = make(map[int64]huffman.BitCode)
-				huffman.GenerateBitCodes(huffResidualRoot, 0, 0, residualCodesByExp[exp])
+				residualFreqsByExp[exp] = residualTruncated
+				residualCodesByExp[exp], err = huffman.BuildCodes(residualTruncated, MAX_CODE_LENGTH_RESIDUAL)
+				if err != nil {
+					return err
+				}
 			}
 			fmt.Printf("\tStatistics of why each map was truncated before being sent for Huffman encoding:\n")
 			fmt.Printf("\t%s: %d occurances\n", REASON_STRING_0, reasonHist[0])
@@ -422,9 +550,10 @@ func GatherStatistics(folder string, deterministic *rand.Rand) error {
 				freq := magFreqs[mag]
 				magnitudesMap[mag] = freq
 			}
-			huffMagnitudeRoot := huffman.BuildHuffmanTree(magnitudesMap)
-			magnitudeCodes := make(map[int64]huffman.BitCode)
-			huffman.GenerateBitCodes(huffMagnitudeRoot, 0, 0, magnitudeCodes)
+			magnitudeCodes, err := huffman.BuildCodes(magnitudesMap, MAX_CODE_LENGTH_MAGNITUDE)
+			if err != nil {
+				return err
+			}
 
 			fmt.Printf("Huffman tree for base 10 exps...\n")
 			expsMap := make(map[int64]int64)
@@ -432,49 +561,308 @@ func GatherStatistics(folder string, deterministic *rand.Rand) error {
 				freq := expFreqs[exp]
 				expsMap[exp] = freq
 			}
-			huffExpRoot := huffman.BuildHuffmanTree(expsMap)
-			expCodes := make(map[int64]huffman.BitCode)
-			huffman.GenerateBitCodes(huffExpRoot, 0, 0, expCodes)
+			expCodes, err := huffman.BuildCodes(expsMap, MAX_CODE_LENGTH_EXP)
+			if err != nil {
+				return err
+			}
 
 			elapsed = time.Since(startTime)
 			fmt.Printf("[%5.1f min] %s\n", elapsed.Minutes(), "==** Simulating compression with fiat peaks **==")
 
-			result, microEpochToPeakStrengths, exclude = compress.ParallelSimulateCompressionWithKMeans(chain, handles, blocksPerEpoch, blocksPerMicroEpoch, blocks, epochToCelebCodes, expCodes, residualCodesByExp, magnitudeCodes, combinedCodes, microEpochToPhasePeaks)
+			fmt.Printf("rANS models from the same frequencies...\n")
+			ransModels, err := compress.NewRansModels(epochToCelebFreqs, expsMap, residualFreqsByExp, magnitudesMap, combinedTruncated)
+			if err != nil {
+				return err
+			}
+
+			tables := compress.EncoderTables{
+				EpochToCelebCodes:      epochToCelebCodes,
+				ExpCodes:               expCodes,
+				ResidualCodesByExp:     residualCodesByExp,
+				MagnitudeCodes:         magnitudeCodes,
+				CombinedCodes:          combinedCodes,
+				MicroEpochToPhasePeaks: microEpochToPhasePeaks,
+				RansModels:             ransModels,
+			}
+			simulationStage := fmt.Sprintf("simulation-pass%d", pass)
+			loaded, err = store.Load(simulationStage, params.simulation[pass], &result, &microEpochToPeakStrengths, &exclude)
+			if err != nil {
+				return err
+			}
+			if !loaded {
+				result, microEpochToPeakStrengths, exclude, err = compress.ParallelSimulateCompressionWithKMeans(ctx, scan, epochs, microEpochs, &tables, selectorCodes)
+				if err != nil {
+					return err
+				}
+				if err := saveStage(ctx, store, simulationStage, params.simulation[pass], result, microEpochToPeakStrengths, exclude); err != nil {
+					return err
+				}
+			}
 
 			bitsPerGB := float64(8 * 1024 * 1024 * 1024)
 			p := message.NewPrinter(language.English) // For commas between thousands
 			p.Printf("TotalBits: %d (%f GB)\n", result.TotalBits, float64(result.TotalBits)/bitsPerGB)
+			p.Printf("Encoded and decoded bits: %d (%f GB)\n", result.EncodedBits, float64(result.EncodedBits)/bitsPerGB)
+			p.Printf("Encoded bytes (padded per block): %d (%f GB)\n", result.EncodedBytes, float64(result.EncodedBytes*8)/bitsPerGB)
+			p.Printf("rANS TotalBits: %.0f (%f GB, %.1f%% of Huffman)\n", result.TotalRansBits, result.TotalRansBits/bitsPerGB, 100*result.TotalRansBits/float64(result.TotalBits))
 			p.Printf("-----\n")
-			p.Printf("BTC Celebrity bits: %d (%f GB)\n", result.CelebrityBits, float64(result.CelebrityBits)/bitsPerGB)
-			p.Printf("BTC Celebrity hits: %d\n", result.CelebrityHits)
-			p.Printf("BTC Celebrity average bits: %.1f\n", float64(result.CelebrityBits)/float64(result.CelebrityHits))
-			p.Printf("-----\n")
-			p.Printf("Fiat Ghost bits: %d (%f GB)\n", result.GhostBits, float64(result.GhostBits)/bitsPerGB)
-			p.Printf("Fiat Ghost hits: %d\n", result.GhostHits)
-			p.Printf("Fiat Ghost average bits: %.1f\n", float64(result.GhostBits)/float64(result.GhostHits))
-			p.Printf("-----\n")
-			p.Printf("Literal Satoshis bits: %d (%f GB)\n", result.LiteralBits, float64(result.LiteralBits)/bitsPerGB)
-			p.Printf("Literal Satoshis hits: %d\n", result.LiteralHits)
-			p.Printf("Literal Satoshis average bits: %.1f\n", float64(result.LiteralBits)/float64(result.LiteralHits))
+			for _, enc := range result.Encoders {
+				p.Printf("%s bits: %d (%f GB)\n", enc.Name, enc.Bits, float64(enc.Bits)/bitsPerGB)
+				p.Printf("%s hits: %d\n", enc.Name, enc.Hits)
+				p.Printf("%s average bits: %.1f\n", enc.Name, float64(enc.Bits)/float64(enc.Hits))
+				p.Printf("%s average bits (rANS): %.2f\n", enc.Name, enc.RansBits/float64(enc.Hits))
+				p.Printf("-----\n")
+			}
+			p.Printf("Coinbase bits: %d (%f GB)\n", result.CoinbaseBits, float64(result.CoinbaseBits)/bitsPerGB)
+			p.Printf("Coinbase hits: %d (%d fully claimed)\n", result.CoinbaseHits, result.CoinbaseFullyClaimed)
+			p.Printf("Coinbase average bits: %.1f\n", float64(result.CoinbaseBits)/float64(result.CoinbaseHits))
 			p.Printf("-----\n")
-			p.Printf("The Rest bits: %d (%f GB)\n", result.RestBits, float64(result.RestBits)/bitsPerGB)
-			p.Printf("Literal Satoshis hits: %d\n", result.RestHits)
-			p.Printf("Literal Satoshs average bits: %.1f\n", float64(result.RestBits)/float64(result.RestHits))
+
+			for _, enc := range result.Encoders {
+				p.Printf("%s hits: %d\n", enc.Name, enc.Hits)
+			}
 			p.Printf("-----\n")
+			p.Printf("Selector bits (%s, as used): %d\n", compress.SELECTOR_MODE_NAMES[selectorCodes.Mode], result.SelectorBits)
+			for mode := 0; mode < compress.NUM_SELECTOR_MODES; mode++ {
+				saving := int64(result.SelectorBitsByMode[compress.SELECTORS_FIXED]) - int64(result.SelectorBitsByMode[mode])
+				p.Printf("\tSelector bits if %s: %d (saving %d bits over fixed)\n", compress.SELECTOR_MODE_NAMES[mode], result.SelectorBitsByMode[mode], saving)
+			}
 
-			p.Printf("Fiat Ghost hits: %d\n", result.GhostHits)
-			p.Printf("Literal hits: %d\n", result.LiteralHits)
-			p.Printf("Rest hits: %d\n", result.RestHits)
+			// Next pass, Huffman code the selectors from the choices we just made
+			selectorCodes, err = compress.NewSelectorCodes(&result.Choices, SELECTOR_MODE)
+			if err != nil {
+				return err
+			}
 			elapsed = time.Since(startTime)
 		}
 
 		fmt.Printf("[%5.1f min] %s\n", elapsed.Minutes(), "==** Finished Pass **==")
 	}
-	exportOracleCSV("Oracle.csv", microEpochToPhasePeaks, microEpochToPeakStrengths)
+	err = exportOracleCSV("Oracle.csv", microEpochToPhasePeaks, microEpochDates, microEpochToAnchor, microEpochToPeakStrengths)
+	if err != nil {
+		return err
+	}
+
+	// Several home currencies, labelled so that each keeps its identity over time
+	identities := kmeans.TrackCurrencyIdentities(microEpochToCurrencies)
+	fmt.Printf("\tFound %d currency identities\n", identities)
+	err = exportCurrenciesCSV("Currencies.csv", microEpochToCurrencies, microEpochDates)
+	if err != nil {
+		return err
+	}
+
+	if config.HourOfDay {
+		elapsed = time.Since(startTime)
+		fmt.Printf("[%5.1f min] %s\n", elapsed.Minutes(), "==** Currencies by hour of day **==")
+		// The actual timestamps this time, not the median times that the epochs are cut by
+		hourTimes, err := calendar.BlockTimes(chain, handles, blocks, "time")
+		if err != nil {
+			return err
+		}
+		hours, err := kmeans.ParallelHourOfDay(ctx, scan, epochs, microEpochs, hourTimes, epochToCelebCodes, microEpochToCurrencies, identities, exclude, config.KMeans)
+		if err != nil {
+			return err
+		}
+		printHourOfDay(&hours, config.KMeans.CurrencyTemplates)
+		err = exportHourOfDayCSV("HourOfDay.csv", &hours)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The anchor peaks as absolute prices
+	prices := oracle.Resolve(microEpochToAnchor, config.Oracle)
+	err = atomicfile.Write("Prices.csv", func(f io.Writer) error {
+		return oracle.WriteCSV(f, prices, microEpochDates)
+	})
+	if err != nil {
+		return err
+	}
+
+	// For a later incremental run to start from
+	err = saveStage(ctx, store, ORACLE_STAGE, params.oracle, microEpochToPhasePeaks, microEpochToAnchor, microEpochToCurrencies, microEpochToPeakStrengths, exclude)
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
 
+// updateOracle brings the oracle of a previous run (which saw only previousBlocks blocks) up to date. Only the
+// micro-epochs that have changed are worked out again, in a single k-means pass. The previous run's exclusion
+// map is used, but no outputs of the new transactions are excluded, and their peak strengths (which come from
+// the compression simulation) aren't known (STRENGTH_UNKNOWN, left empty in Oracle.csv). A full run tidies all
+// this up. The rows of Oracle.csv are appended to, and Currencies.csv, FourDigits.csv and Prices.csv are rewritten.
+func updateOracle(ctx context.Context, chain chainreadinterface.IBlockChain, scan *scanner.Scanner, epochs *calendar.Epochs, microEpochs *calendar.Epochs,
+	firstEpoch int64, previousBlocks int64, epochToCelebCodes []map[int64]huffman.BitCode, deterministic *rand.Rand,
+	store *checkpoint.Store, config Config,
+	previousPhasePeaks [][]float64, previousAnchors []float64, previousCurrencies [][]kmeans.CurrencyTemplate,
+	previousStrengths [][compress.CSV_COLUMNS]int64, previousExclude *kmeans.ExclusionIndex) error {
+
+	// The micro-epochs of the changed epochs have new celebrities, and the previous run's last micro-epoch
+	// may have been partial (and might straddle into a changed epoch)
+	firstMicroEpoch := calendar.FirstMicroEpochs(epochs, microEpochs)[firstEpoch]
+	if changed := microEpochs.FirstChanged(previousBlocks); changed < firstMicroEpoch {
+		firstMicroEpoch = changed
+	}
+	fmt.Printf("\tUpdating from epoch %d, micro-epoch %d\n", firstEpoch, firstMicroEpoch)
+
+	microEpochCount := microEpochs.Count()
+	microEpochToPhasePeaks := make([][]float64, microEpochCount)
+	microEpochToAnchor := make([]float64, microEpochCount)
+	microEpochToCurrencies := make([][]kmeans.CurrencyTemplate, microEpochCount)
+	microEpochToPeakStrengths := make([][compress.CSV_COLUMNS]int64, microEpochCount)
+	copy(microEpochToPhasePeaks[:firstMicroEpoch], previousPhasePeaks)
+	copy(microEpochToAnchor[:firstMicroEpoch], previousAnchors)
+	copy(microEpochToCurrencies[:firstMicroEpoch], previousCurrencies)
+	copy(microEpochToPeakStrengths[:firstMicroEpoch], previousStrengths)
+
+	transactions, err := transactionCount(chain)
+	if err != nil {
+		return err
+	}
+	exclude := previousExclude
+	exclude.Grow(transactions) // The new transactions have no outputs excluded
+
+	newPhasePeaks, newCurrencies, err := kmeans.ParallelKMeans(ctx, scan, epochs, microEpochs, epochToCelebCodes, deterministic, exclude, config.KMeans, firstMicroEpoch)
+	if err != nil {
+		return err
+	}
+	for meID := firstMicroEpoch; meID < microEpochCount; meID++ {
+		microEpochToPhasePeaks[meID] = newPhasePeaks[meID]
+		microEpochToCurrencies[meID] = newCurrencies[meID]
+		microEpochToAnchor[meID] = math.NaN()
+		if len(microEpochToPhasePeaks[meID]) > 0 {
+			microEpochToAnchor[meID] = microEpochToPhasePeaks[meID][0]
+		}
+		// Sort the peaks for this epoch so Peak 0 is always the smallest phase
+		sort.Float64s(microEpochToPhasePeaks[meID])
+		for peakIdx := range microEpochToPeakStrengths[meID] {
+			microEpochToPeakStrengths[meID][peakIdx] = STRENGTH_UNKNOWN
+		}
+	}
+
+	microEpochDates := microEpochs.Dates()
+	err = exportFourDigitsCSV("FourDigits.csv", microEpochToAnchor, microEpochDates)
+	if err != nil {
+		return err
+	}
+	err = appendOracleCSV("Oracle.csv", int(firstMicroEpoch), microEpochToPhasePeaks, microEpochDates, microEpochToAnchor, microEpochToPeakStrengths)
+	if err != nil {
+		return err
+	}
+
+	identities := kmeans.TrackCurrencyIdentities(microEpochToCurrencies)
+	fmt.Printf("\tFound %d currency identities\n", identities)
+	err = exportCurrenciesCSV("Currencies.csv", microEpochToCurrencies, microEpochDates)
+	if err != nil {
+		return err
+	}
+
+	prices := oracle.Resolve(microEpochToAnchor, config.Oracle)
+	err = atomicfile.Write("Prices.csv", func(f io.Writer) error {
+		return oracle.WriteCSV(f, prices, microEpochDates)
+	})
+	if err != nil {
+		return err
+	}
+
+	return saveStage(ctx, store, ORACLE_STAGE, checkpointParams(config).oracle, microEpochToPhasePeaks, microEpochToAnchor, microEpochToCurrencies, microEpochToPeakStrengths, exclude)
+}
+
+// saveStage checkpoints a stage, unless ctx has been cancelled (when the stage's results may be partial)
+func saveStage(ctx context.Context, store *checkpoint.Store, stage string, params string, values ...interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return store.Save(stage, params, values...)
+}
+
+// newReporter reports progress to the terminal, and to the JSON lines file and metrics endpoint if the config
+// has them. The returned func closes them, returning any error writing the JSON lines.
+func newReporter(config Config) (*progress.Reporter, func() error, error) {
+	sinks := []progress.Sink{&progress.Terminal{}}
+	var jsonFile *os.File
+	var jsonLines *progress.JSONLines
+	if config.ProgressJSON != "" {
+		var err error
+		jsonFile, err = os.Create(config.ProgressJSON)
+		if err != nil {
+			return nil, nil, err
+		}
+		jsonLines = progress.NewJSONLines(jsonFile)
+		sinks = append(sinks, jsonLines)
+	}
+	reporter := progress.NewReporter(sinks...)
+	var server *http.Server
+	if config.Metrics != "" {
+		var err error
+		server, err = reporter.ServeMetrics(config.Metrics)
+		if err != nil {
+			if jsonFile != nil {
+				jsonFile.Close()
+			}
+			return nil, nil, err
+		}
+	}
+	return reporter, func() error {
+		var err error
+		if jsonFile != nil {
+			err = errors.Join(jsonLines.Err(), jsonFile.Close())
+		}
+		if server != nil {
+			server.Close()
+		}
+		return err
+	}, nil
+}
+
+// stageParams is, for each checkpointed stage, a hash (see checkpoint.ParamsHash) of everything other than the
+// chain that its outputs depend on: the settings it reads, and the hashes of the stages whose outputs it uses.
+// So changing a setting only invalidates the stages that depend on it.
+type stageParams struct {
+	celebs      string
+	celebCodes  string
+	amountStats string
+	kmeans      []string // For each pass
+	residuals   []string
+	simulation  []string
+	oracle      string
+}
+
+func checkpointParams(config Config) stageParams {
+	var p stageParams
+	p.celebs = checkpoint.ParamsHash(config.Epoch)
+	p.celebCodes = checkpoint.ParamsHash(p.celebs, config.CelebCoverage, config.CelebMaxCodes, ESCAPE_VALUE, MAX_CODE_LENGTH_CELEB)
+	p.amountStats = checkpoint.ParamsHash(p.celebCodes, MAX_BASE_10_EXP)
+	previous := "" // The previous pass's simulation (its exclusions and selector choices), if any
+	for pass := 0; pass < config.Passes; pass++ {
+		kmeansParams := checkpoint.ParamsHash(p.celebCodes, previous, config.MicroEpoch, config.KMeans)
+		residualsParams := checkpoint.ParamsHash(kmeansParams, MAX_BASE_10_EXP)
+		simulationParams := checkpoint.ParamsHash(residualsParams, p.amountStats, previous,
+			config.ResidualCoverage, config.CombinedMaxCodes, ESCAPE_VALUE, SELECTOR_MODE, compress.NumChoices(),
+			MAX_CODE_LENGTH_COMBINED, MAX_CODE_LENGTH_EXP, MAX_CODE_LENGTH_RESIDUAL, MAX_CODE_LENGTH_MAGNITUDE)
+		p.kmeans = append(p.kmeans, kmeansParams)
+		p.residuals = append(p.residuals, residualsParams)
+		p.simulation = append(p.simulation, simulationParams)
+		previous = simulationParams
+	}
+	p.oracle = checkpoint.ParamsHash(previous) // The last pass
+	return p
+}
+
+// transactionCount is the number of transactions in the whole chain
+func transactionCount(chain chainreadinterface.IBlockChain) (int64, error) {
+	latestTrans, err := chain.LatestTransaction()
+	if err != nil {
+		return 0, err
+	}
+	if !latestTrans.HeightSpecified() {
+		return 0, errors.New("transaction height not specified")
+	}
+	return latestTrans.Height() + 1, nil
+}
+
 type PeakResult struct {
 	Value    float64
 	Strength int64
@@ -501,22 +889,80 @@ func GetSensibleMaxCodes(exponent int) int {
 	return needed
 }
 
-func exportOracleCSV(filename string, microEpochToPhasePeaks [][]float64, peakStrengths [][compress.CSV_COLUMNS]int64) {
-	f, _ := os.Create(filename)
-	defer f.Close()
-	w := csv.NewWriter(f)
+// STRENGTH_UNKNOWN is the peak strength of a micro-epoch that the compression simulation hasn't seen
+const STRENGTH_UNKNOWN = -1
+
+// exportOracleCSV writes the anchor (main) peak of each micro-epoch, followed by its strongest peaks
+func exportOracleCSV(filename string, microEpochToPhasePeaks [][]float64, microEpochDates []string, microEpochToAnchor []float64, peakStrengths [][compress.CSV_COLUMNS]int64) error {
+	return atomicfile.Write(filename, func(f io.Writer) error {
+		w := csv.NewWriter(f)
+
+		header := []string{"microEpoch", "Date", "Anchor"}
+		for i := 0; i < compress.CSV_COLUMNS; i++ {
+			header = append(header, fmt.Sprintf("P%d_Value", i), fmt.Sprintf("P%d_Strength", i))
+		}
+		w.Write(header)
+
+		writeOracleRows(w, 0, microEpochToPhasePeaks, microEpochDates, microEpochToAnchor, peakStrengths)
+		w.Flush()
+		return w.Error()
+	})
+}
 
-	header := []string{"microEpoch"}
-	for i := 0; i < compress.CSV_COLUMNS; i++ {
-		header = append(header, fmt.Sprintf("P%d_Value", i), fmt.Sprintf("P%d_Strength", i))
+// appendOracleCSV replaces the rows of an earlier Oracle.csv from micro-epoch fromMicroEpoch on (the last of
+// them may have been for a partial micro-epoch) with those of the given micro-epochs. The earlier rows are
+// kept as they are. If there is no earlier Oracle.csv, it writes a whole new one.
+func appendOracleCSV(filename string, fromMicroEpoch int, microEpochToPhasePeaks [][]float64, microEpochDates []string, microEpochToAnchor []float64, peakStrengths [][compress.CSV_COLUMNS]int64) error {
+	earlier, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return exportOracleCSV(filename, microEpochToPhasePeaks, microEpochDates, microEpochToAnchor, peakStrengths)
+	}
+	if err != nil {
+		return err
 	}
-	w.Write(header)
 
-	for microEpochID, peaks := range microEpochToPhasePeaks {
+	// Find where the first row to replace starts (skipping the header)
+	keep := 0
+	lines := bufio.NewReader(bytes.NewReader(earlier))
+	for row := 0; ; row++ {
+		line, err := lines.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if row > 0 {
+			microEpochID, err := strconv.Atoi(strings.SplitN(line, ",", 2)[0])
+			if err != nil {
+				return fmt.Errorf("%s row %d: %w", filename, row, err)
+			}
+			if microEpochID >= fromMicroEpoch {
+				break
+			}
+		}
+		keep += len(line)
+	}
+
+	return atomicfile.Write(filename, func(f io.Writer) error {
+		if _, err := f.Write(earlier[:keep]); err != nil {
+			return err
+		}
+		w := csv.NewWriter(f)
+		writeOracleRows(w, fromMicroEpoch, microEpochToPhasePeaks, microEpochDates, microEpochToAnchor, peakStrengths)
+		w.Flush()
+		return w.Error()
+	})
+}
+
+// writeOracleRows writes the rows of Oracle.csv from micro-epoch fromMicroEpoch on
+func writeOracleRows(w *csv.Writer, fromMicroEpoch int, microEpochToPhasePeaks [][]float64, microEpochDates []string, microEpochToAnchor []float64, peakStrengths [][compress.CSV_COLUMNS]int64) {
+	for microEpochID := fromMicroEpoch; microEpochID < len(microEpochToPhasePeaks); microEpochID++ {
+		peaks := microEpochToPhasePeaks[microEpochID]
 		if peaks == nil {
 			continue
 		}
-		row := []string{fmt.Sprintf("%d", microEpochID)}
+		row := []string{fmt.Sprintf("%d", microEpochID), microEpochDates[microEpochID], fmt.Sprintf("%.4f", microEpochToAnchor[microEpochID])}
 
 		results := make([]PeakResult, compress.CSV_COLUMNS)
 		for peakIdx := 0; peakIdx < compress.CSV_COLUMNS; peakIdx++ {
@@ -530,9 +976,99 @@ func exportOracleCSV(filename string, microEpochToPhasePeaks [][]float64, peakSt
 		})
 
 		for peakPriority := 0; peakPriority < compress.CSV_COLUMNS; peakPriority++ {
-			row = append(row, fmt.Sprintf("%.4f", results[peakPriority].Value), fmt.Sprintf("%d", results[peakPriority].Strength))
+			strength := "" // Not known (see updateOracle)
+			if results[peakPriority].Strength != STRENGTH_UNKNOWN {
+				strength = fmt.Sprintf("%d", results[peakPriority].Strength)
+			}
+			row = append(row, fmt.Sprintf("%.4f", results[peakPriority].Value), strength)
 		}
 		w.Write(row)
 	}
-	w.Flush()
+}
+
+// exportFourDigitsCSV writes the first four significant digits of each micro-epoch's anchor peak
+func exportFourDigitsCSV(filename string, microEpochToAnchor []float64, microEpochDates []string) error {
+	return atomicfile.Write(filename, func(f io.Writer) error {
+		w := bufio.NewWriter(f)
+		for meID, anchor := range microEpochToAnchor {
+			if math.IsNaN(anchor) {
+				continue // No peaks for this micro-epoch
+			}
+			val := math.Pow(10, -anchor)
+			for val < 1000 {
+				val *= 10
+			}
+			for val >= 10000 {
+				val /= 10
+			}
+			digits := int(val)
+			fmt.Fprintf(w, "%s, %d\n", microEpochDates[meID], digits)
+		}
+		return w.Flush()
+	})
+}
+
+// exportCurrenciesCSV writes one row per currency template per micro-epoch
+func exportCurrenciesCSV(filename string, microEpochToCurrencies [][]kmeans.CurrencyTemplate, microEpochDates []string) error {
+	return atomicfile.Write(filename, func(f io.Writer) error {
+		w := csv.NewWriter(f)
+
+		w.Write([]string{"microEpoch", "Date", "Identity", "Anchor", "Share"})
+		for microEpochID, templates := range microEpochToCurrencies {
+			for _, template := range templates {
+				w.Write([]string{
+					fmt.Sprintf("%d", microEpochID),
+					microEpochDates[microEpochID],
+					fmt.Sprintf("%d", template.Identity),
+					fmt.Sprintf("%.4f", template.Anchor),
+					fmt.Sprintf("%.4f", template.Share),
+				})
+			}
+		}
+		w.Flush()
+		return w.Error()
+	})
+}
+
+// printHourOfDay describes the daily rhythm of the strongest few currencies
+func printHourOfDay(hours *kmeans.HourOfDay, strongest int) {
+	identities := make([]int, len(hours.Captured))
+	for id := range identities {
+		identities[id] = id
+	}
+	sort.Slice(identities, func(i, j int) bool { return hours.Total(identities[i]) > hours.Total(identities[j]) })
+	if len(identities) > strongest {
+		identities = identities[:strongest]
+	}
+	for _, id := range identities {
+		fmt.Printf("\tCurrency %d: %d amounts, busiest at %02d:00 UTC, centre of its day %04.1f UTC\n",
+			id, hours.Total(id), hours.BusiestHour(id), hours.CentreHour(id))
+		fmt.Printf("\t\tStrength by UTC hour:")
+		for hour := 0; hour < kmeans.HOURS_PER_DAY; hour++ {
+			fmt.Printf(" %.2f", hours.Strength(id, hour))
+		}
+		fmt.Printf("\n")
+	}
+}
+
+// exportHourOfDayCSV writes one row per currency identity per UTC hour
+func exportHourOfDayCSV(filename string, hours *kmeans.HourOfDay) error {
+	return atomicfile.Write(filename, func(f io.Writer) error {
+		w := csv.NewWriter(f)
+
+		w.Write([]string{"Identity", "Hour", "Captured", "Amounts", "Strength"})
+		for id := range hours.Captured {
+			for hour := 0; hour < kmeans.HOURS_PER_DAY; hour++ {
+				w.Write([]string{
+					fmt.Sprintf("%d", id),
+					fmt.Sprintf("%d", hour),
+					fmt.Sprintf("%d", hours.Captured[id][hour]),
+					fmt.Sprintf("%d", hours.Amounts[hour]),
+					fmt.Sprintf("%.4f", hours.Strength(id, hour)),
+				})
+			}
+		}
+		w.Flush()
+		return w.Error()
+	})
 }
@@ -0,0 +1,24 @@
+package kmeans
+
+// Config is how the fiat peaks are found
+type Config struct {
+	GuffThreshold     float64 // How far (in phase) an amount can be from a spoke of a 1-2-5 template, and still be on it
+	Clusters          int     // k, the number of clusters on the clock face from which the anchor is chosen
+	ThinningRatio     int64   // Only 1 in ThinningRatio amounts of a micro-epoch are used...
+	ThinningKeepFirst int64   // ...after the first ThinningKeepFirst of them
+	CurrencyTemplates int     // How many home currencies (1-2-5 templates) to look for in each micro-epoch (0 for none)
+}
+
+// DEFAULT_GUFF_THRESHOLD should never be more than 0.12. If it gets to 0.15, we lose the ability to
+// recognize the "10" of a "5-10-20" peak pattern and everything falls apart
+const DEFAULT_GUFF_THRESHOLD = 0.05
+
+func DefaultConfig() Config {
+	return Config{
+		GuffThreshold:     DEFAULT_GUFF_THRESHOLD,
+		Clusters:          4,
+		ThinningRatio:     20,
+		ThinningKeepFirst: 1000,
+		CurrencyTemplates: 1,
+	}
+}
@@ -0,0 +1,232 @@
+package kmeans
+
+import (
+	"math"
+	"math/rand"
+	"runtime"
+	"sort"
+)
+
+// A home currency shows up as a 1-2-5 template on the clock face. Where several currencies are in use
+// at once (USD and EUR, say) there are several templates, each with its own anchor.
+
+const CURRENCY_ITERATIONS = 4
+
+// MAX_IDENTITY_JUMP is how far (in phase) a currency's anchor may move between the micro-epochs in which
+// it is seen, and still be recognized as the same currency
+const MAX_IDENTITY_JUMP = 0.05
+
+// NO_IDENTITY is the Identity of a template that TrackCurrencyIdentities hasn't labelled yet
+const NO_IDENTITY = -1
+
+var currencySpokes = []KFloat{0.0, 0.30103, 0.69897} // log10 of 1, 2, 5
+
+// CurrencyTemplate is one 1-2-5 template fitted by FindCurrencyTemplates
+type CurrencyTemplate struct {
+	Anchor   float64 // Phase of the '1' spoke
+	Share    float64 // Fraction of the amounts that this template captured
+	Identity int     // Stable label across micro-epochs (see TrackCurrencyIdentities)
+}
+
+// FindCurrencyTemplates fits up to config.CurrencyTemplates independent 1-2-5 templates to the amounts simultaneously.
+// The templates are seeded greedily (take the anchor already found for the amounts by FindEpochAnchor as the
+// strongest template, take away what it captures, fit the next to what is left), then refined jointly: each amount pulls only on the nearest spoke of any
+// template. Results are in order of decreasing share, and are not yet labelled with an Identity.
+func FindCurrencyTemplates(amounts []int64, anchor KFloat, config Config, deterministic *rand.Rand) []CurrencyTemplate {
+	k := config.CurrencyTemplates
+	guffThreshold := KFloat(config.GuffThreshold)
+	phases := make([]KFloat, 0, len(amounts))
+	positive := make([]int64, 0, len(amounts))
+	for _, v := range amounts {
+		if v <= 0 {
+			continue // No place on the clock
+		}
+		_, ph := math.Modf(math.Log10(float64(v)))
+		phases = append(phases, KFloat(ph))
+		positive = append(positive, v)
+	}
+
+	// 1. Greedy seeding
+	anchors := make([]KFloat, 0, k)
+	remainingAmounts := positive
+	remainingPhases := phases
+	for len(anchors) < k && len(remainingAmounts) >= MIN_AMOUNT_COUNT_FOR_ANALYSIS {
+		if len(anchors) > 0 {
+			var ok bool
+			anchor, ok = findAnchor(remainingAmounts, remainingPhases, config, deterministic)
+			if !ok {
+				break
+			}
+		}
+		anchors = append(anchors, anchor)
+
+		// Take away what this template captures, for the next template to fit to what is left
+		keptAmounts := make([]int64, 0, len(remainingAmounts))
+		keptPhases := make([]KFloat, 0, len(remainingPhases))
+		for i, p := range remainingPhases {
+			if KFloat(math.Abs(float64(spokeError(p, anchor)))) >= guffThreshold {
+				keptAmounts = append(keptAmounts, remainingAmounts[i])
+				keptPhases = append(keptPhases, p)
+			}
+		}
+		remainingAmounts = keptAmounts
+		remainingPhases = keptPhases
+	}
+	if len(anchors) == 0 {
+		return nil
+	}
+
+	// 2. Joint refinement. Like refineAndScore, but the templates compete for the amounts
+	var hits []int
+	for iter := 0; iter <= CURRENCY_ITERATIONS; iter++ {
+		if iter < CURRENCY_ITERATIONS {
+			realignTemplates(phases, anchors, guffThreshold)
+		}
+		var torques []KFloat
+		hits, torques = captureTemplates(phases, anchors, guffThreshold)
+		if iter == CURRENCY_ITERATIONS {
+			break // The final pass is just to count the hits
+		}
+		for t := range anchors {
+			if hits[t] > 0 {
+				// Move the anchor towards the average of the amounts it captured
+				anchors[t] = KFloat(math.Mod(float64(anchors[t]+torques[t]/KFloat(hits[t]))+1.0, 1.0))
+			}
+		}
+	}
+
+	// 3. Shares
+	result := make([]CurrencyTemplate, 0, len(anchors))
+	for t, anchor := range anchors {
+		if hits[t] == 0 {
+			continue // Lost all its amounts to the other templates
+		}
+		duplicate := false
+		for other := range anchors {
+			if hits[other] > hits[t] && cyclicDistance(anchor, anchors[other]) < guffThreshold {
+				duplicate = true // Splitting the spokes of a stronger template, not a currency of its own
+			}
+		}
+		if duplicate {
+			continue
+		}
+		result = append(result, CurrencyTemplate{
+			Anchor:   float64(anchor),
+			Share:    float64(hits[t]) / float64(len(phases)),
+			Identity: NO_IDENTITY,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Share > result[j].Share })
+	return result
+}
+
+// captureTemplates counts the phases that each template captures (those within guffThreshold of its
+// nearest spoke, where no other template has a nearer spoke), and totals their signed errors
+func captureTemplates(phases []KFloat, anchors []KFloat, guffThreshold KFloat) ([]int, []KFloat) {
+	hits := make([]int, len(anchors))
+	torques := make([]KFloat, len(anchors))
+	for i, p := range phases {
+		if i%1000 == 0 {
+			runtime.Gosched()
+		} //...and breathe
+		t, err := nearestTemplate(p, anchors)
+		if KFloat(math.Abs(float64(err))) < guffThreshold {
+			torques[t] += err
+			hits[t]++
+		}
+	}
+	return hits, torques
+}
+
+// realignTemplates fixes templates that have latched onto the wrong spoke. A template whose '1' spoke sits
+// on a currency's '2' or '5' still captures two of that currency's three spokes, so as in FindBestAnchor
+// we try each spoke as the true '1', and keep whichever captures the most (with the other templates fixed).
+func realignTemplates(phases []KFloat, anchors []KFloat, guffThreshold KFloat) {
+	for t, anchor := range anchors {
+		bestHits, _ := captureTemplates(phases, anchors, guffThreshold)
+		bestAnchor := anchor
+		for _, shift := range currencySpokes[1:] {
+			anchors[t] = KFloat(math.Mod(float64(anchor-shift)+1.0, 1.0))
+			hits, _ := captureTemplates(phases, anchors, guffThreshold)
+			if hits[t] > bestHits[t] {
+				bestHits = hits
+				bestAnchor = anchors[t]
+			}
+		}
+		anchors[t] = bestAnchor
+	}
+}
+
+// spokeError is the SIGNED distance (-0.5 to 0.5) from the nearest spoke of the template to the phase
+func spokeError(p KFloat, anchor KFloat) KFloat {
+	bestError := KFloat(1.0) // Initialize with max possible
+	for _, spokeOffset := range currencySpokes {
+		targetPos := KFloat(math.Mod(float64(anchor+spokeOffset), 1.0))
+		diff := p - targetPos
+		if diff > 0.5 {
+			diff -= 1.0
+		}
+		if diff < -0.5 {
+			diff += 1.0
+		}
+		if math.Abs(float64(diff)) < math.Abs(float64(bestError)) {
+			bestError = diff
+		}
+	}
+	return bestError
+}
+
+// nearestTemplate is the template with a spoke nearest to the phase, and the signed distance to that spoke
+func nearestTemplate(p KFloat, anchors []KFloat) (int, KFloat) {
+	best := 0
+	bestError := KFloat(1.0)
+	for t, anchor := range anchors {
+		err := spokeError(p, anchor)
+		if math.Abs(float64(err)) < math.Abs(float64(bestError)) {
+			best = t
+			bestError = err
+		}
+	}
+	return best, bestError
+}
+
+// TrackCurrencyIdentities labels the templates of each micro-epoch (in place) so that the same currency
+// keeps the same Identity from one micro-epoch to the next. In order of decreasing share (so a weak template
+// can't steal the identity of a strong one) each template takes a free identity whose most recently seen
+// anchor is within MAX_IDENTITY_JUMP; the most recently seen such identity, then the nearest. A template
+// with no free identity within MAX_IDENTITY_JUMP gets a new one.
+// Micro-epochs without templates (nil) don't break the tracking. It returns the number of identities handed out.
+func TrackCurrencyIdentities(microEpochToCurrencies [][]CurrencyTemplate) int {
+	lastAnchors := []float64{} // By identity
+	lastSeen := []int{}        // By identity, the micro-epoch
+
+	for microEpochID, templates := range microEpochToCurrencies {
+		identityTaken := make([]bool, len(lastAnchors))
+		for t := range templates { // Already in order of decreasing share (see FindCurrencyTemplates)
+			bestIdentity := NO_IDENTITY
+			bestDistance := MAX_IDENTITY_JUMP
+			for id, anchor := range lastAnchors {
+				distance := PhaseDistance(templates[t].Anchor, anchor)
+				if identityTaken[id] || distance >= MAX_IDENTITY_JUMP {
+					continue
+				}
+				if bestIdentity == NO_IDENTITY || lastSeen[id] > lastSeen[bestIdentity] ||
+					(lastSeen[id] == lastSeen[bestIdentity] && distance < bestDistance) {
+					bestIdentity = id
+					bestDistance = distance
+				}
+			}
+			if bestIdentity == NO_IDENTITY {
+				bestIdentity = len(lastAnchors)
+				lastAnchors = append(lastAnchors, templates[t].Anchor)
+				lastSeen = append(lastSeen, microEpochID)
+				identityTaken = append(identityTaken, true)
+			}
+			templates[t].Identity = bestIdentity
+			identityTaken[bestIdentity] = true
+			lastAnchors[bestIdentity] = templates[t].Anchor
+			lastSeen[bestIdentity] = microEpochID
+		}
+	}
+	return len(lastAnchors)
+}
@@ -0,0 +1,122 @@
+package kmeans
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// NO_EXCLUSION is the output excluded from a transaction that has none excluded
+const NO_EXCLUSION = -1
+
+// Codes stored (one byte per transaction) by ExclusionIndex. Other codes are output index + 1.
+const exclusionNone = 0
+const exclusionOverflow = 255 // The output index is too big for a byte, and is in the overflow map
+
+// ExclusionIndex notes, for each transaction (by height), which one of its outputs (if any) the compression
+// simulation coded as "the rest" (probably change), to be left out of the next k-means pass. It takes one byte
+// per transaction; the few outputs with an index too big for a byte are kept in a map.
+// Set is threadsafe, as long as no two goroutines set the same transaction.
+type ExclusionIndex struct {
+	codes    []byte
+	overflow map[int64]int32 // Output index, by transaction
+	mutex    sync.Mutex      // Protects overflow
+}
+
+// NewExclusionIndex is an index of transactions transactions, none of which have an output excluded
+func NewExclusionIndex(transactions int64) *ExclusionIndex {
+	return &ExclusionIndex{
+		codes:    make([]byte, transactions),
+		overflow: make(map[int64]int32),
+	}
+}
+
+// Len is the number of transactions in the index
+func (x *ExclusionIndex) Len() int64 {
+	return int64(len(x.codes))
+}
+
+// Grow makes room for the transactions of a longer chain, with no outputs excluded
+func (x *ExclusionIndex) Grow(transactions int64) {
+	if transactions > x.Len() {
+		x.codes = append(x.codes, make([]byte, transactions-x.Len())...)
+	}
+}
+
+// Set notes the output to exclude from a transaction (NO_EXCLUSION for none)
+func (x *ExclusionIndex) Set(transaction int64, output int) {
+	previous := x.codes[transaction]
+	if output+1 >= exclusionOverflow {
+		x.codes[transaction] = exclusionOverflow
+		x.mutex.Lock()
+		x.overflow[transaction] = int32(output)
+		x.mutex.Unlock()
+		return
+	}
+	x.codes[transaction] = byte(output + 1) // NO_EXCLUSION gives exclusionNone
+	if previous == exclusionOverflow {
+		x.mutex.Lock()
+		delete(x.overflow, transaction)
+		x.mutex.Unlock()
+	}
+}
+
+// Excluded is the output to exclude from a transaction, or NO_EXCLUSION
+func (x *ExclusionIndex) Excluded(transaction int64) int {
+	code := x.codes[transaction]
+	switch code {
+	case exclusionNone:
+		return NO_EXCLUSION
+	case exclusionOverflow:
+		x.mutex.Lock()
+		defer x.mutex.Unlock()
+		return int(x.overflow[transaction])
+	}
+	return int(code) - 1
+}
+
+// exclusionIndexData is what an ExclusionIndex gob encodes (see GobEncode). The codes themselves (a byte for
+// every transaction in the chain, a gigabyte or so) are too big to copy into memory to encode, so a checkpoint
+// keeps them in a raw file of their own (see WriteRaw).
+type exclusionIndexData struct {
+	Transactions int64
+	Overflow     map[int64]int32
+}
+
+// GobEncode lets an ExclusionIndex be saved with a checkpoint, for the next pass or run. It encodes everything
+// but the codes, which the checkpoint.Store streams to a file of their own with WriteRaw.
+func (x *ExclusionIndex) GobEncode() ([]byte, error) {
+	buf := bytes.Buffer{}
+	err := gob.NewEncoder(&buf).Encode(exclusionIndexData{Transactions: x.Len(), Overflow: x.overflow})
+	return buf.Bytes(), err
+}
+
+func (x *ExclusionIndex) GobDecode(data []byte) error {
+	var d exclusionIndexData
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&d); err != nil {
+		return err
+	}
+	if d.Transactions < 0 {
+		return fmt.Errorf("exclusion index of %d transactions", d.Transactions)
+	}
+	x.codes = make([]byte, d.Transactions) // Filled in by ReadRaw
+	x.overflow = d.Overflow
+	if x.overflow == nil {
+		x.overflow = make(map[int64]int32)
+	}
+	return nil
+}
+
+// WriteRaw writes the codes (see checkpoint.Raw)
+func (x *ExclusionIndex) WriteRaw(w io.Writer) error {
+	_, err := w.Write(x.codes)
+	return err
+}
+
+// ReadRaw reads back the codes written by WriteRaw, into an ExclusionIndex just decoded by GobDecode
+func (x *ExclusionIndex) ReadRaw(r io.Reader) error {
+	_, err := io.ReadFull(r, x.codes)
+	return err
+}
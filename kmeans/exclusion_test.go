@@ -0,0 +1,41 @@
+package kmeans
+
+import (
+	"github.com/KitchenMishap/pudding-huffman/checkpoint"
+	"testing"
+)
+
+func TestExclusionIndexCheckpoint(t *testing.T) {
+	x := NewExclusionIndex(100000)
+	for tx := int64(0); tx < x.Len(); tx += 7 {
+		x.Set(tx, int(tx%300)) // Some outputs too big for a byte, and so in the overflow map
+	}
+	x.Set(14, NO_EXCLUSION)
+
+	store, err := checkpoint.NewStore(t.TempDir(), 10, func(message string) { t.Log(message) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save("stage", "params", x); err != nil {
+		t.Fatal(err)
+	}
+	var loaded *ExclusionIndex
+	if ok, err := store.Load("stage", "params", &loaded); err != nil || !ok {
+		t.Fatalf("Load gave %v, %v", ok, err)
+	}
+	if loaded.Len() != x.Len() {
+		t.Fatalf("loaded %d transactions, want %d", loaded.Len(), x.Len())
+	}
+	for tx := int64(0); tx < x.Len(); tx++ {
+		if loaded.Excluded(tx) != x.Excluded(tx) {
+			t.Fatalf("transaction %d excludes output %d, want %d", tx, loaded.Excluded(tx), x.Excluded(tx))
+		}
+	}
+
+	// And it can still grow, for an incremental run
+	loaded.Grow(x.Len() + 10)
+	loaded.Set(x.Len()+5, 299)
+	if loaded.Excluded(x.Len()+5) != 299 || loaded.Excluded(x.Len()+6) != NO_EXCLUSION {
+		t.Fatal("grown index doesn't work")
+	}
+}
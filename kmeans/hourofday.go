@@ -0,0 +1,143 @@
+package kmeans
+
+import (
+	"context"
+	"github.com/KitchenMishap/pudding-huffman/amounts"
+	"github.com/KitchenMishap/pudding-huffman/calendar"
+	"github.com/KitchenMishap/pudding-huffman/huffman"
+	"github.com/KitchenMishap/pudding-huffman/scanner"
+	"math"
+)
+
+const HOURS_PER_DAY = 24
+const SECONDS_PER_HOUR = 60 * 60
+
+// HourOfDay is how strong each currency's peaks are at each UTC hour of the day. A currency used mostly in
+// one region is busiest in that region's daytime, which hints at the timezone of its users.
+type HourOfDay struct {
+	Captured [][HOURS_PER_DAY]int64 // By currency identity, amounts captured by its template
+	Amounts  [HOURS_PER_DAY]int64   // All the amounts considered
+}
+
+// Strength is the fraction of an hour's amounts that a currency's template captured
+func (h *HourOfDay) Strength(identity int, hour int) float64 {
+	if h.Amounts[hour] == 0 {
+		return 0
+	}
+	return float64(h.Captured[identity][hour]) / float64(h.Amounts[hour])
+}
+
+// Total is the number of amounts a currency's template captured, over all the hours
+func (h *HourOfDay) Total(identity int) int64 {
+	total := int64(0)
+	for _, count := range h.Captured[identity] {
+		total += count
+	}
+	return total
+}
+
+// BusiestHour is the UTC hour in which a currency's template is strongest
+func (h *HourOfDay) BusiestHour(identity int) int {
+	busiest := 0
+	for hour := 1; hour < HOURS_PER_DAY; hour++ {
+		if h.Strength(identity, hour) > h.Strength(identity, busiest) {
+			busiest = hour
+		}
+	}
+	return busiest
+}
+
+// CentreHour is the middle of a currency's day: the circular mean of the hours, weighted by strength
+func (h *HourOfDay) CentreHour(identity int) float64 {
+	var sumSin, sumCos float64
+	for hour := 0; hour < HOURS_PER_DAY; hour++ {
+		angle := 2 * math.Pi * (float64(hour) + 0.5) / HOURS_PER_DAY // Middle of the hour
+		sumSin += h.Strength(identity, hour) * math.Sin(angle)
+		sumCos += h.Strength(identity, hour) * math.Cos(angle)
+	}
+	centre := math.Atan2(sumSin, sumCos) * HOURS_PER_DAY / (2 * math.Pi)
+	if centre < 0 {
+		centre += HOURS_PER_DAY
+	}
+	return centre
+}
+
+// ParallelHourOfDay buckets the amounts by the UTC hour of their block's timestamp ("time", see
+// calendar.BlockTimes), and counts those captured by each of the micro-epoch's currency templates
+// (see FindCurrencyTemplates and TrackCurrencyIdentities). Like the second pass of ParallelKMeans,
+// it leaves out celebrities and the excluded (change) outputs, but it does no thinning.
+func ParallelHourOfDay(ctx context.Context, scan *scanner.Scanner, epochs *calendar.Epochs, microEpochs *calendar.Epochs,
+	blockTimes []int64, celebCodesPerEpoch []map[int64]huffman.BitCode,
+	microEpochToCurrencies [][]CurrencyTemplate, identities int,
+	transToExcludedOutput *ExclusionIndex, config Config) (HourOfDay, error) {
+
+	stage := scan.Reporter().Start("Hour of day: PARALLEL by epoch", epochs.BlockCount())
+	defer stage.Finish()
+
+	result := HourOfDay{Captured: make([][HOURS_PER_DAY]int64, identities)}
+
+	type workerResult struct {
+		hours HourOfDay
+		// The block being visited, and its hour and templates
+		block     *amounts.Block
+		hour      int64
+		templates []CurrencyTemplate
+		anchors   []KFloat
+	}
+	err := scanner.ByEpoch(ctx, scan, epochs, 0, epochs.BlockCount(),
+		func() *workerResult {
+			return &workerResult{hours: HourOfDay{Captured: make([][HOURS_PER_DAY]int64, identities)}}
+		},
+		func(local *workerResult, trans *scanner.Trans) error {
+			blockIdx := trans.Block.Height
+			if trans.Block != local.block {
+				local.block = trans.Block
+				local.templates = microEpochToCurrencies[microEpochs.Of(blockIdx)]
+				local.anchors = make([]KFloat, len(local.templates))
+				for t, template := range local.templates {
+					local.anchors[t] = KFloat(template.Anchor)
+				}
+				local.hour = (blockTimes[blockIdx] % (HOURS_PER_DAY * SECONDS_PER_HOUR)) / SECONDS_PER_HOUR
+			}
+			hour := local.hour
+
+			excluded := NO_EXCLUSION
+			if transToExcludedOutput != nil {
+				excluded = transToExcludedOutput.Excluded(trans.Height())
+			}
+			for txo, amount := range trans.Amounts {
+				if _, ok := celebCodesPerEpoch[trans.Epoch][amount]; ok {
+					continue
+				}
+				if txo == excluded {
+					continue
+				}
+				if amount <= 0 {
+					continue // No place on the clock
+				}
+				local.hours.Amounts[hour]++
+				if len(local.anchors) == 0 {
+					continue
+				}
+				_, ph := math.Modf(math.Log10(float64(amount)))
+				nearest, phaseErr := nearestTemplate(KFloat(ph), local.anchors)
+				if math.Abs(float64(phaseErr)) < config.GuffThreshold {
+					local.hours.Captured[local.templates[nearest].Identity][hour]++
+				}
+			}
+			return nil
+		},
+		func(local *workerResult) {
+			for hour := 0; hour < HOURS_PER_DAY; hour++ {
+				result.Amounts[hour] += local.hours.Amounts[hour]
+				for id := range result.Captured {
+					result.Captured[id][hour] += local.hours.Captured[id][hour]
+				}
+			}
+		},
+		stage.Add)
+	if err != nil {
+		return HourOfDay{}, err
+	}
+	return result, nil
+}
@@ -2,22 +2,31 @@ package kmeans
 
 import (
 	"context"
-	"errors"
 	"fmt"
+	"github.com/KitchenMishap/pudding-huffman/calendar"
 	"github.com/KitchenMishap/pudding-huffman/huffman"
-	"github.com/KitchenMishap/pudding-shed/chainreadinterface"
+	"github.com/KitchenMishap/pudding-huffman/scanner"
 	"golang.org/x/sync/errgroup"
 	"math"
 	"math/rand"
 	"runtime"
 	"sync/atomic"
-	"time"
 )
 
 // Switch between float32 and float64 here
 type KFloat = float32
 
-func FindEpochPeaksMain(amounts []int64, deterministic *rand.Rand) []float64 {
+func FindEpochPeaksMain(amounts []int64, config Config, deterministic *rand.Rand) []float64 {
+	bestPeak, ok := FindEpochAnchor(amounts, config, deterministic)
+	if !ok {
+		return nil
+	}
+	return PeaksOfAnchor(bestPeak)
+}
+
+// FindEpochAnchor finds the anchor (the '1' spoke) of the 1-2-5 template that best fits the amounts of a
+// micro-epoch. Not ok if the amounts have no anchor to find.
+func FindEpochAnchor(amounts []int64, config Config, deterministic *rand.Rand) (KFloat, bool) {
 	// 1. Map all mantissas to the 0.0 to 1.0 "Clock face"
 	phases := make([]KFloat, len(amounts))
 	for i, v := range amounts {
@@ -29,21 +38,11 @@ func FindEpochPeaksMain(amounts []int64, deterministic *rand.Rand) []float64 {
 		}
 	}
 
-	n := 4
-	nPeaks := findEpochPeaks(amounts, n, deterministic)
-	if len(nPeaks) < n {
-		return nil
-	}
-	bestPeak := nPeaks[0]
-	_, bestBadness := FindBestAnchor(phases, bestPeak)
-	for _, peak := range nPeaks {
-		peak, badness := FindBestAnchor(phases, peak)
-		if badness < bestBadness {
-			bestBadness = badness
-			bestPeak = peak
-		}
-	}
+	return findAnchor(amounts, phases, config, deterministic)
+}
 
+// PeaksOfAnchor are the phase peaks of an anchor: the phases of 1.0, 1.1, 1.2, ..., 9.9 times its '1' spoke
+func PeaksOfAnchor(bestPeak KFloat) []float64 {
 	result := []float64{}
 	// fundamental times logs representing 1.0, 1.1, 1.2, ..., 9.9
 	for i := float64(1.00); i < 10.00; i += 0.1 {
@@ -57,7 +56,25 @@ func FindEpochPeaksMain(amounts []int64, deterministic *rand.Rand) []float64 {
 	return result
 }
 
-func FindBestAnchor(phases []KFloat, initialPeak KFloat) (bestAnchor KFloat, score KFloat) {
+// findAnchor finds the anchor (the '1' spoke) of the 1-2-5 template that best fits the amounts
+func findAnchor(amounts []int64, phases []KFloat, config Config, deterministic *rand.Rand) (KFloat, bool) {
+	n := config.Clusters
+	nPeaks := findEpochPeaks(amounts, n, deterministic)
+	if len(nPeaks) < n {
+		return 0, false
+	}
+	bestPeak, bestBadness := FindBestAnchor(phases, nPeaks[0], config.GuffThreshold)
+	for _, peak := range nPeaks[1:] {
+		peak, badness := FindBestAnchor(phases, peak, config.GuffThreshold)
+		if badness < bestBadness {
+			bestBadness = badness
+			bestPeak = peak
+		}
+	}
+	return bestPeak, true
+}
+
+func FindBestAnchor(phases []KFloat, initialPeak KFloat, guffThreshold float64) (bestAnchor KFloat, score KFloat) {
 	spokes := []KFloat{0.0, 0.30103, 0.69897} // log10 of 1, 2, 5
 
 	bestScore := KFloat(math.MaxFloat32)
@@ -68,7 +85,7 @@ func FindBestAnchor(phases []KFloat, initialPeak KFloat) (bestAnchor KFloat, sco
 		// We shift the anchor so the template aligns the initial peak with that spoke.
 		testAnchor := KFloat(math.Mod(float64(initialPeak)-float64(shift)+1.0, 1.0))
 
-		refined, currentBadness := refineAndScore(phases, testAnchor, spokes)
+		refined, currentBadness := refineAndScore(phases, testAnchor, spokes, guffThreshold)
 
 		if currentBadness < bestScore {
 			bestScore = currentBadness
@@ -78,9 +95,8 @@ func FindBestAnchor(phases []KFloat, initialPeak KFloat) (bestAnchor KFloat, sco
 	return absoluteBest, bestScore
 }
 
-func refineAndScore(phases []KFloat, startAnchor KFloat, spokes []KFloat) (KFloat, KFloat) {
-	const guffThreshold = 0.05 // Should never be more than 0.12. If it gets to 0.15, we lose the ability to
-	// recognize the "10" of a "5-10-20" peak pattern and everything falls apart
+// guffThreshold should never be more than 0.12 (see DEFAULT_GUFF_THRESHOLD)
+func refineAndScore(phases []KFloat, startAnchor KFloat, spokes []KFloat, guffThreshold float64) (KFloat, KFloat) {
 	const iterations = 4
 	currentAnchor := startAnchor
 
@@ -123,8 +139,7 @@ func refineAndScore(phases []KFloat, startAnchor KFloat, spokes []KFloat) (KFloa
 
 		if validHits > 0 {
 			// Adjust the anchor by the average torque (the M-step)
-			//currentAnchor = math.Mod(currentAnchor+(totalTorque/validHits)+1.0, 1.0)
-			currentAnchor = KFloat(math.Mod(float64(currentAnchor-(totalTorque/validHits)+1.0), 1.0)) // Gemini test, reverse the torque
+			currentAnchor = KFloat(math.Mod(float64(currentAnchor+(totalTorque/validHits)+1.0), 1.0))
 			if math.IsNaN(float64(currentAnchor)) {
 				return startAnchor, math.MaxFloat32
 			}
@@ -159,7 +174,7 @@ func refineAndScore(phases []KFloat, startAnchor KFloat, spokes []KFloat) (KFloa
 		}
 		err := bestError
 
-		if err < guffThreshold {
+		if err < KFloat(guffThreshold) {
 			//totalSqError += (err * err)
 			totalAbsError += KFloat(math.Abs(float64(err * err)))
 			hits++
@@ -233,7 +248,11 @@ func guessEpochPeaksClock(amounts []int64, k int, deterministic *rand.Rand) (log
 				if len(clusters[j]) > 2 {
 					logCentroids[j] = circularMean(clusters[j])
 				} else {
-					logCentroids[j] = KFloat(rand.Float32()) // Give it a kick
+					if deterministic != nil {
+						logCentroids[j] = KFloat(deterministic.Float32()) // Give it a kick
+					} else {
+						logCentroids[j] = KFloat(rand.Float32()) // Give it a kick
+					}
 				}
 			}
 		}
@@ -336,42 +355,41 @@ func ExpPeakResidual(amount int64, logCentroids []float64) (exp int, peak int, h
 const MIN_AMOUNT_COUNT_FOR_ANALYSIS = 100
 
 // "beans/beansperbucket+1" usually works, but you get black swans when the division is exact
-func bucketCount(beans int64, beansPerBucket int64) int64 {
-	return (beans + beansPerBucket - 1) / beansPerBucket
-}
-
-func ParallelKMeans(chain chainreadinterface.IBlockChain, handles chainreadinterface.IHandleCreator, blocks int64, blocksPerMicroEpoch int64,
-	celebCodesPerEpoch []map[int64]huffman.BitCode, blocksPerEpoch int64, deterministic *rand.Rand,
-	transToExcludedOutput *[2000000000]byte) ([][]float64, error) {
-
-	sJob := "Peak detection: PARALLEL by micro-epoch"
-	fmt.Printf("%s\n", sJob)
-	tJob := time.Now()
-
-	epochs := bucketCount(blocks, blocksPerEpoch)
-	microEpochs := bucketCount(blocks, blocksPerMicroEpoch)
-	microEpochToPhasePeaks := make([][]float64, microEpochs)
-	microEpochsPerEpoch := blocksPerEpoch / blocksPerMicroEpoch
+// Micro-epochs before firstMicroEpoch (for an incremental run, those that haven't changed) are left nil.
+func ParallelKMeans(ctx context.Context, scan *scanner.Scanner, epochs *calendar.Epochs, microEpochs *calendar.Epochs,
+	celebCodesPerEpoch []map[int64]huffman.BitCode, deterministic *rand.Rand,
+	transToExcludedOutput *ExclusionIndex, config Config, firstMicroEpoch int64) ([][]float64, [][]CurrencyTemplate, error) {
+
+	epochCount := epochs.Count()
+	microEpochCount := microEpochs.Count()
+	blocksToDo := int64(0) // Those of the micro-epochs from firstMicroEpoch on
+	if firstMicroEpoch < microEpochCount {
+		firstBlock, _ := microEpochs.Blocks(firstMicroEpoch)
+		blocksToDo = microEpochs.BlockCount() - firstBlock
+	}
+	stage := scan.Reporter().Start("Peak detection: PARALLEL by micro-epoch", blocksToDo)
+	defer stage.Finish()
+	microEpochToPhasePeaks := make([][]float64, microEpochCount)
+	microEpochToCurrencies := make([][]CurrencyTemplate, microEpochCount) // Only if config.CurrencyTemplates > 0
+	firstMicroEpochs := calendar.FirstMicroEpochs(epochs, microEpochs)
+	firstEpoch := int64(0) // The first epoch with a micro-epoch to work out
+	for firstEpoch < epochCount && firstMicroEpochs[firstEpoch+1] <= firstMicroEpoch {
+		firstEpoch++
+	}
 
-	microEpochsToTxos := make([]int64, microEpochs)
+	microEpochsToTxos := make([]int64, microEpochCount)
 	transactionsInChain := int64(0)
 	blocksInChain := int64(0)
 
-	var completed int64 // atomic counter
-
-	// Use a semaphore to limit concurrency to CPU count
-
-	workersDivider := 1
-	numWorkers := runtime.NumCPU() / workersDivider
-	if numWorkers > 8 {
-		numWorkers -= 4 // Save some for OS
-	}
+	// Use a semaphore to limit concurrency to numWorkers
+	// (Not a scanner.ByEpoch, as the heavy lifting is per micro-epoch, once all its amounts are gathered)
+	numWorkers := scan.Workers()
 	//numWorkers = 1 // Serial test! I may be some time
 
-	g, ctx := errgroup.WithContext(context.Background())
+	g, ctx := errgroup.WithContext(ctx)
 	sem := make(chan struct{}, numWorkers)
 
-	for i := int64(0); i < epochs; i++ {
+	for i := firstEpoch; i < epochCount; i++ {
 		epochID := i // Capture for closure
 		g.Go(func() error {
 			sem <- struct{}{}
@@ -395,93 +413,40 @@ func ParallelKMeans(chain chainreadinterface.IBlockChain, handles chainreadinter
 			localRand := rand.New(src)
 
 			// Go through the microEpochs in this epoch
-			firstMe := epochID * microEpochsPerEpoch
-			lastMe := (epochID + 1) * microEpochsPerEpoch // Usually
-			if lastMe > microEpochs {
-				lastMe = microEpochs // Finally (last, possibly partial, epoch)
+			firstMe := firstMicroEpochs[epochID]
+			if firstMe < firstMicroEpoch {
+				firstMe = firstMicroEpoch
 			}
+			lastMe := firstMicroEpochs[epochID+1]
 			for me := firstMe; me < lastMe; me++ {
+				// An epoch can take a while, so check between its micro-epochs too
+				if err := ctx.Err(); err != nil {
+					return err
+				}
 				txoCount := 0
 				buffer = buffer[:0] // Reset buffer but keep allocated memory
-				firstBlock := epochID*blocksPerEpoch + (me-firstMe)*blocksPerMicroEpoch
-				if firstBlock >= blocks {
-					break
-				}
-				lastBlock := firstBlock + blocksPerMicroEpoch
-				if lastBlock > blocks {
-					lastBlock = blocks
-				}
+				firstBlock, lastBlock := microEpochs.Blocks(me)
 
 				// To emulate the old code, we need to know the txoIndex of the first txo of the first trans
 				// in the first block of this microepoch
-				blockHandle, err := handles.BlockHandleByHeight(firstBlock)
-				if err != nil {
-					return err
-				}
-				block, err := chain.BlockInterface(blockHandle)
-				if err != nil {
-					return err
-				}
-				transHandle, err := block.NthTransaction(0)
-				if err != nil {
-					return err
-				}
-				trans, err := chain.TransInterface(transHandle)
-				if err != nil {
-					return err
-				}
-				txoHandle, err := trans.NthTxo(0)
-				if err != nil {
-					return err
-				}
-				if !txoHandle.TxoHeightSpecified() {
-					return errors.New("txo height not specified")
-				}
-				firstTxoOfMe := txoHandle.TxoHeight()
+				firstTxoOfMe := int64(0)
 
 				// Go through the blocks in the microEpoch
 				for blockIdx := firstBlock; blockIdx < lastBlock; blockIdx++ {
 					atomic.AddInt64(&blocksInChain, 1)
-					blockHandle, err := handles.BlockHandleByHeight(int64(blockIdx))
-					if err != nil {
-						return err
-					}
-					block, err := chain.BlockInterface(blockHandle)
+					block, err := scan.Source().Block(blockIdx)
 					if err != nil {
 						return err
 					}
-					tCount, err := block.TransactionCount()
-					if err != nil {
-						return err
+					if blockIdx == firstBlock {
+						firstTxoOfMe = block.FirstTxo()
 					}
-					for t := int64(0); t < tCount; t++ {
+					for t, txoAmounts := range block.Trans {
 						atomic.AddInt64(&transactionsInChain, 1)
-						transHandle, err := block.NthTransaction(t)
-						if !transHandle.HeightSpecified() {
-							return errors.New("transaction height not specified")
-						}
-						transIndex := transHandle.Height()
-						if err != nil {
-							return err
-						}
-						trans, err := chain.TransInterface(transHandle)
-						if err != nil {
-							return err
-						}
-						txoAmounts, err := trans.AllTxoSatoshis()
-						if err != nil {
-							return err
-						}
+						transIndex := block.TransHeight(t)
 						// For the thinning below to match the "old" code, in which txo indexed all the txo's
 						// in the entire chain, we'll need to know the firstTxo of the transaction
-						txoHandle, err := trans.NthTxo(0)
-						if err != nil {
-							return err
-						}
-						if !txoHandle.TxoHeightSpecified() {
-							return errors.New("txo height not specified")
-						}
-						firstTxoOfTrans := txoHandle.TxoHeight()
+						firstTxoOfTrans := block.FirstTxos[t]
 
 						for txo, sats := range txoAmounts {
 							txoCount++
@@ -491,19 +456,16 @@ func ParallelKMeans(chain chainreadinterface.IBlockChain, handles chainreadinter
 								// Only if NOT a celeb
 								if transToExcludedOutput == nil {
 									// First pass, thin it down
-									if oldCodeTxoIndex-firstTxoOfMe < 1000 || oldCodeTxoIndex%20 == 0 {
+									if oldCodeTxoIndex-firstTxoOfMe < config.ThinningKeepFirst || oldCodeTxoIndex%config.ThinningRatio == 0 {
 										buffer = append(buffer, amount)
 									}
 								} else {
 									// Second pass
 									// Is it excluded? (recognized as high entropy change?)
-									excludeCode := transToExcludedOutput[transIndex]
-									// 255 is a special code meaning "do not exclude any of the outputs"
-									// 0 to 254 are codes meaning "exclude this output, one of output index 0 to 254"
-									if excludeCode == 255 || int64(excludeCode) != int64(txo) {
+									if transToExcludedOutput.Excluded(transIndex) != txo {
 										// Do not exclude txo. So use it.
 										// But maybe do some thinning
-										if oldCodeTxoIndex-firstTxoOfMe < 1000 || oldCodeTxoIndex%20 == 0 {
+										if oldCodeTxoIndex-firstTxoOfMe < config.ThinningKeepFirst || oldCodeTxoIndex%config.ThinningRatio == 0 {
 											buffer = append(buffer, amount)
 										}
 									}
@@ -517,31 +479,33 @@ func ParallelKMeans(chain chainreadinterface.IBlockChain, handles chainreadinter
 					microEpochToPhasePeaks[me] = nil
 				} else {
 					// This is the heavy lifting
-					microEpochToPhasePeaks[me] = FindEpochPeaksMain(buffer, localRand)
+					anchor, ok := FindEpochAnchor(buffer, config, localRand)
+					if ok {
+						microEpochToPhasePeaks[me] = PeaksOfAnchor(anchor)
+						if config.CurrencyTemplates > 0 {
+							// The anchor just found seeds the first (strongest) currency, rather than finding it again
+							microEpochToCurrencies[me] = FindCurrencyTemplates(buffer, anchor, config, localRand)
+						}
+					}
 				}
+				// Report progress on completion of micro epoch
+				stage.Add(lastBlock - firstBlock)
 			} // for micro epochs
 
-			// Report progress on completion of epoch
-			done := atomic.AddInt64(&completed, 1)
-			fmt.Printf("\r\tProgress %.1f%%    ", float64(100*done)/float64(epochs))
-
 			return nil
 		})
 	}
 	if err := g.Wait(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-
-	fmt.Printf("\n")
-	jobElapsed := time.Since(tJob)
-	fmt.Printf("\t%s: Job took: [%5.1f min]\n", sJob, jobElapsed.Minutes())
+	stage.Finish()
 
 	txosInChain := int64(0)
-	for i := int64(0); i < microEpochs; i++ {
+	for i := int64(0); i < microEpochCount; i++ {
 		txosInChain += microEpochsToTxos[i]
 	}
 	fmt.Printf("\tConsidered %d blocks (should be 888,888\n", blocksInChain)
 	fmt.Printf("\tTODO! Considered %d transactions (should be 1169006472)\n", transactionsInChain)
 	fmt.Printf("\tTODO! Considered %d txos (should be 3,244,970,783)\n", txosInChain)
-	return microEpochToPhasePeaks, nil
+	return microEpochToPhasePeaks, microEpochToCurrencies, nil
 }
@@ -0,0 +1,65 @@
+package kmeans
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// fiatAmounts are round fiat payments (1, 2, 5, 10, 20 ... 1000) at a price (fiat per BTC), each at a slightly
+// jittered exchange rate, mixed with a share of amounts spread evenly over the clock face (change, say)
+func fiatAmounts(price float64, count int, noiseShare float64, rng *rand.Rand) []int64 {
+	round := []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000}
+	amounts := make([]int64, count)
+	for i := range amounts {
+		if rng.Float64() < noiseShare {
+			amounts[i] = int64(math.Pow(10, 3+4*rng.Float64()))
+			continue
+		}
+		rate := price * math.Pow(10, rng.NormFloat64()*0.001)
+		amounts[i] = int64(math.Round(round[rng.Intn(len(round))] / rate * 100000000))
+	}
+	return amounts
+}
+
+func phasesOf(amounts []int64) []KFloat {
+	phases := make([]KFloat, len(amounts))
+	for i, amount := range amounts {
+		_, phase := math.Modf(math.Log10(float64(amount)))
+		phases[i] = KFloat(phase)
+	}
+	return phases
+}
+
+// TestFindBestAnchor checks that refining an anchor that starts on (or near) the truth stays there
+func TestFindBestAnchor(t *testing.T) {
+	for _, price := range []float64{27000, 900, 5000, 64000} {
+		truth := PhaseOfPrice(price)
+		phases := phasesOf(fiatAmounts(price, 10000, 0.4, rand.New(rand.NewSource(1))))
+		for _, offset := range []float64{0, 0.01, -0.01} {
+			start := KFloat(math.Mod(truth+offset+1, 1))
+			anchor, _ := FindBestAnchor(phases, start, DEFAULT_GUFF_THRESHOLD)
+			if PhaseDistance(float64(anchor), truth) > 0.005 {
+				t.Errorf("price %.0f, starting at %.4f: anchor %.4f, want %.4f", price, start, anchor, truth)
+			}
+		}
+	}
+}
+
+// TestFindEpochPeaksMain checks that the main peak is at the phase of the price, whichever k-means clusters
+// it starts from
+func TestFindEpochPeaksMain(t *testing.T) {
+	for _, price := range []float64{27000, 900, 5000, 64000} {
+		truth := PhaseOfPrice(price)
+		for seed := int64(1); seed <= 4; seed++ {
+			amounts := fiatAmounts(price, 10000, 0.4, rand.New(rand.NewSource(seed)))
+			peaks := FindEpochPeaksMain(amounts, DefaultConfig(), rand.New(rand.NewSource(seed)))
+			if len(peaks) == 0 {
+				t.Fatalf("price %.0f, seed %d: no peaks", price, seed)
+			}
+			if PhaseDistance(peaks[0], truth) > 0.01 {
+				t.Errorf("price %.0f, seed %d: main peak %.4f, want %.4f", price, seed, peaks[0], truth)
+			}
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package kmeans
+
+import (
+	"math"
+)
+
+// PhaseOfPrice is where the amount for one unit of fiat sits on the log10 "clock face", given the fiat
+// price of one BTC. It is the phase that FindEpochPeaksMain should find as its main peak (result[0]).
+func PhaseOfPrice(fiatPerBTC float64) float64 {
+	_, phase := math.Modf(math.Log10(100000000 / fiatPerBTC))
+	if phase < 0 {
+		phase += 1
+	}
+	return phase
+}
+
+// PhaseDistance is how far apart two phases are, the short way round the clock face (0 to 0.5)
+func PhaseDistance(a float64, b float64) float64 {
+	// As cyclicDistance, but in full precision
+	diff := math.Abs(a - b)
+	diff -= math.Floor(diff)
+	if diff > 0.5 {
+		return 1.0 - diff
+	}
+	return diff
+}
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/KitchenMishap/pudding-huffman/blockchain"
+	"github.com/KitchenMishap/pudding-huffman/calendar"
+	"github.com/KitchenMishap/pudding-huffman/evaluate"
 	"github.com/KitchenMishap/pudding-huffman/jobs"
+	"github.com/KitchenMishap/pudding-huffman/synthetic"
 	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
@@ -17,12 +26,166 @@ func main() {
 	//deterministic := nil
 
 	var sDirFlag = flag.String("Dir", "", "Directory to serve data from")
+	var syntheticBlocksFlag = flag.Int64("Synthetic", 0, "Number of blocks of a synthetic chain to use instead of Dir")
+	var currencyFlag = flag.String("Currency", "", "Home currency (USD, EUR or JPY) of mostly round fiat payments in the synthetic chain")
+	var evaluateFlag = flag.String("Evaluate", "", "Reference price CSV (date, price) to evaluate an earlier run's Oracle.csv against, instead of running")
+	var oracleFlag = flag.String("Oracle", "Oracle.csv", "Oracle CSV to evaluate")
+	var toleranceFlag = flag.Float64("Tolerance", evaluate.DEFAULT_TOLERANCE, "Phase error that still counts as a hit, when evaluating")
+	var configFlag = flag.String("Config", "", "JSON config file (see jobs.Config). The flags below override it")
+	// Flags override the config file only if they are given. Their defaults here are just for -help
+	defaults := jobs.DefaultConfig()
+	var epochFlag = flag.String("Epoch", defaults.Epoch.String(), "Epoch length: day, week, month (UTC, from block timestamps) or a number of blocks")
+	var microEpochFlag = flag.String("MicroEpoch", defaults.MicroEpoch.String(), "Micro-epoch length: day, week, month (UTC, from block timestamps) or a number of blocks")
+	var celebCoverageFlag = flag.Float64("CelebCoverage", defaults.CelebCoverage, "Fraction of an epoch's amounts that its celebrities should cover")
+	var celebMaxCodesFlag = flag.Int("CelebMaxCodes", defaults.CelebMaxCodes, "Most celebrities per epoch")
+	var residualCoverageFlag = flag.Float64("ResidualCoverage", defaults.ResidualCoverage, "Fraction of the residuals at each exp that their table should cover")
+	var combinedMaxCodesFlag = flag.Int("CombinedMaxCodes", defaults.CombinedMaxCodes, "Most codes for the combined peak and harmonic selection")
+	var passesFlag = flag.Int("Passes", defaults.Passes, "Passes of k-means then compression simulation")
+	var workersFlag = flag.Int("Workers", defaults.Workers, "Workers per parallel stage (0 for as many as suit the CPUs)")
+	var guffThresholdFlag = flag.Float64("GuffThreshold", defaults.KMeans.GuffThreshold, "How far (in phase) an amount can be from a spoke of a 1-2-5 template, and still be on it")
+	var clustersFlag = flag.Int("Clusters", defaults.KMeans.Clusters, "k, the number of k-means clusters from which the anchor is chosen")
+	var thinningFlag = flag.Int64("Thinning", defaults.KMeans.ThinningRatio, "Use only 1 in this many amounts of a micro-epoch for k-means (after the first ThinningKeepFirst)")
+	var thinningKeepFirstFlag = flag.Int64("ThinningKeepFirst", defaults.KMeans.ThinningKeepFirst, "Use every one of the first this many amounts of a micro-epoch for k-means, before thinning the rest")
+	var currencyTemplatesFlag = flag.Int("CurrencyTemplates", defaults.KMeans.CurrencyTemplates, "How many home currencies to look for in each micro-epoch")
+	var anchorPriceFlag = flag.Float64("AnchorPrice", defaults.Oracle.AnchorPrice, "Rough fiat price of a BTC at AnchorMicroEpoch, to resolve the decade of the detected prices")
+	var anchorMicroEpochFlag = flag.Int("AnchorMicroEpoch", defaults.Oracle.AnchorMicroEpoch, "Micro-epoch of AnchorPrice (-1 means the last)")
+	var hourOfDayFlag = flag.Bool("HourOfDay", defaults.HourOfDay, "Also report the strength of each currency at each UTC hour of the day")
+	var busiestHourFlag = flag.Float64("FiatBusiestHour", -1, "UTC hour when the synthetic chain's fiat payments are busiest (-1 for no daily cycle)")
+	var checkpointsFlag = flag.String("Checkpoints", defaults.Checkpoints, "Folder to checkpoint each stage in, and resume from (empty for no checkpoints)")
+	var incrementalFlag = flag.Bool("Incremental", defaults.Incremental, "Bring the previous run in the Checkpoints folder up to date with the new blocks, instead of a full run (the peak strengths of the new rows of Oracle.csv are left empty, as they come from the compression simulation)")
+	var amountsFlag = flag.String("Amounts", defaults.Amounts, "Folder to extract the txo amounts and fees into once, for the later stages to read (empty to read the chain each time)")
+	var progressJSONFlag = flag.String("ProgressJSON", defaults.ProgressJSON, "File to write each stage's progress to, as JSON lines (empty for none)")
+	var metricsFlag = flag.String("Metrics", defaults.Metrics, "Local address (such as localhost:9100) to serve Prometheus-style metrics at, during the run (empty for none)")
 	flag.Parse()
 
+	config := defaults
 	var err error
-	err = jobs.GatherStatistics(*sDirFlag, deterministic)
-
+	if *configFlag != "" {
+		config, err = jobs.LoadConfig(*configFlag)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "Epoch":
+			var specErr error
+			config.Epoch, specErr = calendar.ParseSpec(*epochFlag)
+			err = errors.Join(err, specErr)
+		case "MicroEpoch":
+			var specErr error
+			config.MicroEpoch, specErr = calendar.ParseSpec(*microEpochFlag)
+			err = errors.Join(err, specErr)
+		case "CelebCoverage":
+			config.CelebCoverage = *celebCoverageFlag
+		case "CelebMaxCodes":
+			config.CelebMaxCodes = *celebMaxCodesFlag
+		case "ResidualCoverage":
+			config.ResidualCoverage = *residualCoverageFlag
+		case "CombinedMaxCodes":
+			config.CombinedMaxCodes = *combinedMaxCodesFlag
+		case "Passes":
+			config.Passes = *passesFlag
+		case "Workers":
+			config.Workers = *workersFlag
+		case "GuffThreshold":
+			config.KMeans.GuffThreshold = *guffThresholdFlag
+		case "Clusters":
+			config.KMeans.Clusters = *clustersFlag
+		case "Thinning":
+			config.KMeans.ThinningRatio = *thinningFlag
+		case "ThinningKeepFirst":
+			config.KMeans.ThinningKeepFirst = *thinningKeepFirstFlag
+		case "CurrencyTemplates":
+			config.KMeans.CurrencyTemplates = *currencyTemplatesFlag
+		case "AnchorPrice":
+			config.Oracle.AnchorPrice = *anchorPriceFlag
+		case "AnchorMicroEpoch":
+			config.Oracle.AnchorMicroEpoch = *anchorMicroEpochFlag
+		case "HourOfDay":
+			config.HourOfDay = *hourOfDayFlag
+		case "Checkpoints":
+			config.Checkpoints = *checkpointsFlag
+		case "Incremental":
+			config.Incremental = *incrementalFlag
+		case "Amounts":
+			config.Amounts = *amountsFlag
+		case "ProgressJSON":
+			config.ProgressJSON = *progressJSONFlag
+		case "Metrics":
+			config.Metrics = *metricsFlag
+		}
+	})
+	if err == nil {
+		err = config.Check()
+	}
 	if err != nil {
-		fmt.Printf(err.Error())
+		fmt.Println(err.Error())
+		return
+	}
+
+	var reader blockchain.AccessChain
+	if *syntheticBlocksFlag > 0 {
+		blocks := *syntheticBlocksFlag
+		generatorConfig := synthetic.DefaultGeneratorConfig(blocks)
+		if *currencyFlag != "" {
+			currency, ok := synthetic.Currencies[*currencyFlag]
+			if !ok {
+				fmt.Println("Unknown currency " + *currencyFlag)
+				return
+			}
+			generatorConfig = synthetic.FiatPaymentConfig(blocks, currency, synthetic.DefaultFiatPrice(blocks, currency))
+		}
+		if *busiestHourFlag >= 0 {
+			generatorConfig.FiatBusiestHour = *busiestHourFlag
+			generatorConfig.FiatDailySwing = synthetic.DEFAULT_FIAT_DAILY_SWING
+		}
+		var chain *synthetic.Chain
+		chain, err = synthetic.Generate(generatorConfig, rand.New(rand.NewSource(1)))
+		reader = chain
+		// The true peak phases and prices, to compare with Oracle.csv
+		var microEpochs *calendar.Epochs
+		if err == nil {
+			var blockTimes []int64
+			blockTimes, err = calendar.ChainTimes(chain, chain)
+			if err == nil {
+				microEpochs, err = calendar.NewEpochs(config.MicroEpoch, blockTimes)
+			}
+		}
+		if err == nil {
+			err = generatorConfig.WriteGroundTruthCSV("GroundTruth.csv", microEpochs)
+		}
+		if err == nil {
+			err = generatorConfig.WriteReferencePriceCSV("ReferencePrices.csv")
+		}
+	} else {
+		reader, err = blockchain.NewChainReader(*sDirFlag)
+	}
+
+	// Ctrl-C (or a SIGTERM) stops the run cleanly, keeping the checkpoints of the stages already done.
+	// A second one quits at once.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop() // Restore the default, so the next one kills the process
+	}()
+
+	if err == nil {
+		if *evaluateFlag != "" {
+			err = evaluate.Run(reader, *evaluateFlag, *oracleFlag, config.MicroEpoch, *toleranceFlag)
+		} else {
+			err = jobs.GatherStatisticsFromChain(ctx, reader, deterministic, config)
+		}
+	}
+
+	if errors.Is(err, context.Canceled) {
+		fmt.Println("\nInterrupted, so stopped before the end")
+		if config.Checkpoints != "" {
+			fmt.Println("Run again with the same Checkpoints folder to carry on")
+		}
+	} else if err != nil {
+		fmt.Println(err.Error())
 	}
 }
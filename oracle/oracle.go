@@ -0,0 +1,141 @@
+package oracle
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+)
+
+// The anchor peak of a micro-epoch (from kmeans.ParallelKMeans, microEpochToPhasePeaks[me][0]) is the phase L
+// of the amount paid for one unit of fiat: L = frac(log10(sats per unit)). Any price 10^(8-L-k) fits it, for
+// every whole number k. That's the decade ambiguity. We resolve it by starting from an anchor price (roughly
+// right at one micro-epoch) and then assuming the price moves as little as possible from one micro-epoch to
+// the next.
+
+// Config says how the decade is resolved
+type Config struct {
+	AnchorPrice      float64 // Fiat per BTC, roughly (within a factor of 3 is fine), at AnchorMicroEpoch
+	AnchorMicroEpoch int     // -1 means the last micro-epoch with peaks
+	ConsiderSpokes   bool    // Allow for kmeans having locked onto the 2 or 5 spoke instead of the 1
+	SpokePenalty     float64 // In log10 price, the extra jump a spoke has to explain before it's chosen
+}
+
+const DEFAULT_ANCHOR_PRICE = 100000 // USD, recently
+
+func DefaultConfig() Config {
+	return Config{
+		AnchorPrice:      DEFAULT_ANCHOR_PRICE,
+		AnchorMicroEpoch: -1,
+		ConsiderSpokes:   true,
+		SpokePenalty:     0.1,
+	}
+}
+
+// Price is the resolved price of one micro-epoch
+type Price struct {
+	MicroEpoch int
+	Phase      float64 // The anchor phase it came from (NaN if there were no peaks)
+	Price      float64 // Fiat per BTC (NaN if there were no peaks)
+	Confidence float64 // 0 to 1
+}
+
+// spokes are the 1, 2 and 5 spokes. If kmeans locked onto the 2 spoke, the phase is log10(2) too big,
+// and the price from it is half the true price.
+var spokes = []float64{1, 2, 5}
+
+// nearest finds the price that fits the phase and is nearest (in log10) to the target.
+// It returns the price and the distance in log10 (penalty included).
+func nearest(phase float64, targetLog float64, config Config) (float64, float64) {
+	best := math.NaN()
+	bestDist := math.Inf(1)
+	for s, spoke := range spokes {
+		if s > 0 && !config.ConsiderSpokes {
+			break
+		}
+		penalty := 0.0
+		if s > 0 {
+			penalty = config.SpokePenalty
+		}
+		// The decade that puts this price closest to the target
+		spokeLog := math.Log10(spoke)
+		k := int(math.Round(8 - phase + spokeLog - targetLog))
+		for _, kk := range []int{k - 1, k, k + 1} {
+			logPrice := 8 - phase + spokeLog - float64(kk)
+			dist := math.Abs(logPrice-targetLog) + penalty
+			if dist < bestDist {
+				bestDist = dist
+				best = math.Pow(10, logPrice)
+			}
+		}
+	}
+	return best, bestDist
+}
+
+// Resolve turns the anchor phase of each micro-epoch (NaN for none) into an absolute price.
+// The anchor micro-epoch gets the decade nearest the anchor price; from there we walk forwards and backwards
+// choosing the decade nearest the previous price. Confidence falls as the jump approaches half a decade
+// (where either choice is as good as the other), and after gaps.
+func Resolve(anchors []float64, config Config) []Price {
+	prices := make([]Price, len(anchors))
+	for me := range prices {
+		prices[me] = Price{MicroEpoch: me, Phase: anchors[me], Price: math.NaN()}
+	}
+	start := config.AnchorMicroEpoch
+	if start < 0 || start >= len(anchors) {
+		start = -1
+		for me := len(anchors) - 1; me >= 0; me-- {
+			if !math.IsNaN(anchors[me]) {
+				start = me
+				break
+			}
+		}
+	}
+	if start < 0 || math.IsNaN(anchors[start]) {
+		return prices
+	}
+
+	price, dist := nearest(anchors[start], math.Log10(config.AnchorPrice), config)
+	prices[start].Price = price
+	prices[start].Confidence = jumpConfidence(dist)
+
+	for _, step := range []int{1, -1} {
+		previous := prices[start]
+		gap := 0
+		for me := start + step; me >= 0 && me < len(anchors); me += step {
+			if math.IsNaN(anchors[me]) {
+				gap++
+				continue
+			}
+			price, dist := nearest(anchors[me], math.Log10(previous.Price), config)
+			prices[me].Price = price
+			// Confidence fades across gaps
+			prices[me].Confidence = jumpConfidence(dist) / (1 + GAP_FADE*float64(gap))
+			previous = prices[me]
+			gap = 0
+		}
+	}
+	return prices
+}
+
+// GAP_FADE is how much confidence drops for each missing micro-epoch in a row
+const GAP_FADE = 0.1
+
+// jumpConfidence is 1 for no jump, falling to 0 at half a decade
+func jumpConfidence(logJump float64) float64 {
+	return math.Max(0, 1-2*logJump)
+}
+
+// WriteCSV writes the resolved price of every micro-epoch. dates has the (ISO 8601) date of each micro-epoch.
+func WriteCSV(f io.Writer, prices []Price, dates []string) error {
+	w := csv.NewWriter(f)
+	w.Write([]string{"microEpoch", "Date", "Phase", "Price", "Confidence"})
+	for _, p := range prices {
+		if math.IsNaN(p.Price) {
+			continue
+		}
+		w.Write([]string{fmt.Sprintf("%d", p.MicroEpoch), dates[p.MicroEpoch], fmt.Sprintf("%.4f", p.Phase), fmt.Sprintf("%.2f", p.Price), fmt.Sprintf("%.3f", p.Confidence)})
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,75 @@
+package progress
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// metric is one of the gauges served for each stage
+type metric struct {
+	name  string
+	help  string
+	value func(s Snapshot) float64
+}
+
+var metrics = []metric{
+	{"pudding_stage_done_blocks", "Blocks done by the stage", func(s Snapshot) float64 { return float64(s.Done) }},
+	{"pudding_stage_total_blocks", "Blocks the stage has to do", func(s Snapshot) float64 { return float64(s.Total) }},
+	{"pudding_stage_blocks_per_second", "Blocks done per second", func(s Snapshot) float64 { return s.Rate }},
+	{"pudding_stage_eta_seconds", "Time left until the stage is done (-1 if not known yet)", func(s Snapshot) float64 {
+		if s.ETA < 0 {
+			return -1
+		}
+		return s.ETA.Seconds()
+	}},
+	{"pudding_stage_elapsed_seconds", "Time the stage has taken so far (or in all, once finished)", func(s Snapshot) float64 { return s.Elapsed.Seconds() }},
+	{"pudding_stage_finished", "1 once the stage has finished", func(s Snapshot) float64 {
+		if s.Finished {
+			return 1
+		}
+		return 0
+	}},
+}
+
+// WriteMetrics writes every stage's gauges in the Prometheus text format. The same stage name can come up more
+// than once (a stage of each pass, say), so each series is labelled with the stage's index too (its place in
+// the order the stages started).
+func (r *Reporter) WriteMetrics(w io.Writer) error {
+	snapshots := r.Snapshots()
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name); err != nil {
+			return err
+		}
+		for i, s := range snapshots {
+			if _, err := fmt.Fprintf(w, "%s{index=\"%d\",stage=\"%s\"} %g\n", m.name, i, escapeLabel(s.Stage), m.value(s)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// ServeMetrics serves the reporter's metrics at /metrics on a local address (such as localhost:9100), until the
+// returned server is closed
+func (r *Reporter) ServeMetrics(addr string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WriteMetrics(w)
+	})
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	fmt.Printf("\tServing metrics at http://%s/metrics\n", listener.Addr())
+	return server, nil
+}
@@ -0,0 +1,139 @@
+package progress
+
+// Each long job (a "stage") reports its progress, in blocks, to a Reporter. The Reporter works out the rate and
+// ETA, and passes them on to its sinks: the terminal, a file of JSON lines, and/or a metrics endpoint.
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// REPORT_INTERVAL is the least time between progress reports of a stage (its start and finish are always reported)
+const REPORT_INTERVAL = 250 * time.Millisecond
+
+// Snapshot is how a stage is getting on
+type Snapshot struct {
+	Stage    string
+	Done     int64 // Blocks
+	Total    int64
+	Elapsed  time.Duration
+	Rate     float64       // Blocks per second
+	ETA      time.Duration // Negative if not known yet
+	Finished bool
+}
+
+// Sink is told about each stage as it starts, makes progress and finishes. Calls are never concurrent.
+type Sink interface {
+	Started(s Snapshot)
+	Progressed(s Snapshot)
+	Finished(s Snapshot)
+}
+
+// Reporter hands out Stages, and passes on their progress to its sinks
+type Reporter struct {
+	sinks  []Sink
+	mutex  sync.Mutex // Serializes the sinks, and protects stages
+	stages []*Stage   // All stages so far, in the order they started
+}
+
+func NewReporter(sinks ...Sink) *Reporter {
+	return &Reporter{sinks: sinks}
+}
+
+// Stage is a named job of so many blocks. Add is threadsafe.
+type Stage struct {
+	reporter   *Reporter
+	name       string
+	total      int64
+	started    time.Time
+	done       int64 // atomic
+	lastReport int64 // atomic, nanoseconds since started
+	finished   time.Duration
+	isFinished bool // Protected by the reporter's mutex
+}
+
+// Start starts a stage of total blocks
+func (r *Reporter) Start(name string, total int64) *Stage {
+	s := &Stage{reporter: r, name: name, total: total, started: time.Now()}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.stages = append(r.stages, s)
+	snapshot := s.snapshot()
+	for _, sink := range r.sinks {
+		sink.Started(snapshot)
+	}
+	return s
+}
+
+// Add notes that so many more blocks are done
+func (s *Stage) Add(blocks int64) {
+	done := atomic.AddInt64(&s.done, blocks)
+	now := int64(time.Since(s.started))
+	last := atomic.LoadInt64(&s.lastReport)
+	if done < s.total && now-last < int64(REPORT_INTERVAL) {
+		return
+	}
+	if !atomic.CompareAndSwapInt64(&s.lastReport, last, now) {
+		return // Another worker is reporting
+	}
+	s.reporter.mutex.Lock()
+	defer s.reporter.mutex.Unlock()
+	if s.isFinished {
+		return
+	}
+	snapshot := s.snapshot()
+	for _, sink := range s.reporter.sinks {
+		sink.Progressed(snapshot)
+	}
+}
+
+// Finish notes that the stage is over (whether or not all its blocks got done)
+func (s *Stage) Finish() {
+	s.reporter.mutex.Lock()
+	defer s.reporter.mutex.Unlock()
+	if s.isFinished {
+		return
+	}
+	s.finished = time.Since(s.started)
+	s.isFinished = true
+	snapshot := s.snapshot()
+	for _, sink := range s.reporter.sinks {
+		sink.Finished(snapshot)
+	}
+}
+
+// snapshot is called with the reporter's mutex held
+func (s *Stage) snapshot() Snapshot {
+	snapshot := Snapshot{
+		Stage:    s.name,
+		Done:     atomic.LoadInt64(&s.done),
+		Total:    s.total,
+		Elapsed:  time.Since(s.started),
+		ETA:      -1,
+		Finished: s.isFinished,
+	}
+	if s.isFinished {
+		snapshot.Elapsed = s.finished
+		snapshot.ETA = 0
+	}
+	if seconds := snapshot.Elapsed.Seconds(); seconds > 0 {
+		snapshot.Rate = float64(snapshot.Done) / seconds
+	}
+	if !s.isFinished && snapshot.Rate > 0 {
+		remaining := float64(snapshot.Total - snapshot.Done)
+		snapshot.ETA = time.Duration(remaining / snapshot.Rate * float64(time.Second))
+	}
+	return snapshot
+}
+
+// Snapshots is how every stage so far is getting on, in the order they started
+func (r *Reporter) Snapshots() []Snapshot {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	snapshots := make([]Snapshot, len(r.stages))
+	for i, s := range r.stages {
+		snapshots[i] = s.snapshot()
+	}
+	return snapshots
+}
@@ -0,0 +1,94 @@
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// Terminal prints each stage's name, a progress line (overwritten as it goes) and how long the stage took
+type Terminal struct {
+	midLine bool // A progress line has been printed, with no newline yet
+}
+
+func (t *Terminal) Started(s Snapshot) {
+	fmt.Printf("%s\n", s.Stage)
+}
+
+func (t *Terminal) Progressed(s Snapshot) {
+	t.midLine = true
+	eta := "?"
+	if s.ETA >= 0 {
+		eta = s.ETA.Round(time.Second).String()
+	}
+	fmt.Printf("\r\tProgress %5.1f%%  %8.0f blocks/s  ETA %s    ", percent(s), s.Rate, eta)
+}
+
+func (t *Terminal) Finished(s Snapshot) {
+	if t.midLine {
+		fmt.Printf("\n")
+		t.midLine = false
+	}
+	fmt.Printf("\t%s: Job took: [%5.1f min] (%d blocks, %.0f blocks/s)\n", s.Stage, s.Elapsed.Minutes(), s.Done, s.Rate)
+}
+
+func percent(s Snapshot) float64 {
+	if s.Total <= 0 {
+		return 100
+	}
+	return float64(100*s.Done) / float64(s.Total)
+}
+
+// JSONLines writes each start, progress report and finish as a line of JSON, for another program to follow.
+// After an error, it writes no more lines (see Err).
+type JSONLines struct {
+	enc *json.Encoder
+	err error
+}
+
+func NewJSONLines(w io.Writer) *JSONLines {
+	return &JSONLines{enc: json.NewEncoder(w)}
+}
+
+// jsonLine is one line written by JSONLines
+type jsonLine struct {
+	Time           string  `json:"time"`
+	Event          string  `json:"event"` // "start", "progress" or "finish"
+	Stage          string  `json:"stage"`
+	Done           int64   `json:"done"`
+	Total          int64   `json:"total"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	BlocksPerSec   float64 `json:"blocks_per_second"`
+	EtaSeconds     float64 `json:"eta_seconds"` // -1 if not known yet
+}
+
+// Err is the first error writing a line, if any
+func (j *JSONLines) Err() error {
+	return j.err
+}
+
+func (j *JSONLines) write(event string, s Snapshot) {
+	if j.err != nil {
+		return
+	}
+	eta := -1.0
+	if s.ETA >= 0 {
+		eta = math.Round(s.ETA.Seconds()*10) / 10
+	}
+	j.err = j.enc.Encode(jsonLine{
+		Time:           time.Now().UTC().Format(time.RFC3339Nano),
+		Event:          event,
+		Stage:          s.Stage,
+		Done:           s.Done,
+		Total:          s.Total,
+		ElapsedSeconds: s.Elapsed.Seconds(),
+		BlocksPerSec:   s.Rate,
+		EtaSeconds:     eta,
+	})
+}
+
+func (j *JSONLines) Started(s Snapshot)    { j.write("start", s) }
+func (j *JSONLines) Progressed(s Snapshot) { j.write("progress", s) }
+func (j *JSONLines) Finished(s Snapshot)   { j.write("finish", s) }
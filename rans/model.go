@@ -0,0 +1,119 @@
+package rans
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// DEFAULT_SCALE_BITS is the precision of the quantized frequencies. It has to be big enough for a residual
+// table of a million symbols, and no more than MAX_SCALE_BITS.
+const DEFAULT_SCALE_BITS = 24
+const MAX_SCALE_BITS = 31
+
+// Model is a frequency table quantized so that the frequencies add up to exactly 1<<scaleBits.
+// Every symbol in the original map (even one with a frequency of zero) gets at least 1, so it can be coded.
+type Model struct {
+	scaleBits uint
+	starts    map[int64]uint32
+	freqs     map[int64]uint32
+
+	// For the decoder: symbols in order of their starts
+	symbols    []int64
+	symbolEnds []uint32 // Exclusive end of each symbol's slot range
+}
+
+// NewModel accepts the same frequency maps as are fed to huffman.BuildHuffmanTree
+// (for example from TruncateMapWithEscapeCode)
+func NewModel(freqs map[int64]int64, scaleBits int) (*Model, error) {
+	if scaleBits < 1 || scaleBits > MAX_SCALE_BITS {
+		return nil, fmt.Errorf("scale bits %d out of range", scaleBits)
+	}
+	total := uint64(1) << uint(scaleBits)
+	if uint64(len(freqs)) > total {
+		return nil, fmt.Errorf("can't fit %d symbols into %d scale bits", len(freqs), scaleBits)
+	}
+	if len(freqs) == 0 {
+		return nil, fmt.Errorf("empty frequency map")
+	}
+
+	// Biggest first (ties by value, so the model is deterministic)
+	symbols := make([]int64, 0, len(freqs))
+	sum := float64(0)
+	for value, freq := range freqs {
+		symbols = append(symbols, value)
+		sum += float64(freq)
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		if freqs[symbols[i]] != freqs[symbols[j]] {
+			return freqs[symbols[i]] > freqs[symbols[j]]
+		}
+		return symbols[i] < symbols[j]
+	})
+
+	// Quantize
+	quantized := make([]uint64, len(symbols))
+	quantizedSum := uint64(0)
+	for i, value := range symbols {
+		q := uint64(1)
+		if sum > 0 {
+			q = uint64(float64(freqs[value]) / sum * float64(total))
+		}
+		if q < 1 {
+			q = 1
+		}
+		quantized[i] = q
+		quantizedSum += q
+	}
+	// Fix up the total, taking from (or giving to) the biggest symbols where it matters least
+	for quantizedSum < total {
+		quantized[0] += total - quantizedSum
+		quantizedSum = total
+	}
+	for i := 0; quantizedSum > total; i = (i + 1) % len(quantized) {
+		if quantized[i] > 1 {
+			take := quantizedSum - total
+			if take > quantized[i]-1 {
+				take = quantized[i] - 1
+			}
+			// Don't take more than about half of a symbol in one go
+			if half := quantized[i] / 2; take > half && half > 0 {
+				take = half
+			}
+			quantized[i] -= take
+			quantizedSum -= take
+		}
+	}
+
+	m := Model{
+		scaleBits:  uint(scaleBits),
+		starts:     make(map[int64]uint32, len(symbols)),
+		freqs:      make(map[int64]uint32, len(symbols)),
+		symbols:    symbols,
+		symbolEnds: make([]uint32, len(symbols)),
+	}
+	start := uint64(0)
+	for i, value := range symbols {
+		m.starts[value] = uint32(start)
+		m.freqs[value] = uint32(quantized[i])
+		start += quantized[i]
+		m.symbolEnds[i] = uint32(start)
+	}
+	return &m, nil
+}
+
+// CostBits is the number of bits that coding the symbol will (very nearly) cost
+func (m *Model) CostBits(symbol int64) (float64, bool) {
+	freq, ok := m.freqs[symbol]
+	if !ok {
+		return math.Inf(1), false
+	}
+	return float64(m.scaleBits) - math.Log2(float64(freq)), true
+}
+
+// lookup finds the symbol whose slot range contains slot
+func (m *Model) lookup(slot uint32) (int64, uint32, uint32) {
+	i := sort.Search(len(m.symbolEnds), func(i int) bool { return m.symbolEnds[i] > slot })
+	value := m.symbols[i]
+	return value, m.starts[value], m.freqs[value]
+}
@@ -0,0 +1,130 @@
+package rans
+
+// A 64 bit range Asymmetric Numeral Systems coder, emitting 32 bit words (after Fabian Giesen's rans64).
+// rANS is last-in-first-out, so the Encoder buffers what it is given and codes it backwards when finished.
+// The Decoder then gets everything back in the original order.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const ransL = uint64(1) << 31 // Lower bound of the normalized state
+
+// Raw bits are coded as uniform symbols of up to this many bits
+const rawChunkBits = 16
+
+type pending struct {
+	start, freq uint32
+	scaleBits   uint
+}
+
+type Encoder struct {
+	pending []pending
+}
+
+func NewEncoder() *Encoder {
+	return &Encoder{}
+}
+
+// Put queues a symbol to be coded with a model
+func (e *Encoder) Put(m *Model, symbol int64) error {
+	freq, ok := m.freqs[symbol]
+	if !ok {
+		return fmt.Errorf("symbol %d not in model", symbol)
+	}
+	e.pending = append(e.pending, pending{start: m.starts[symbol], freq: freq, scaleBits: m.scaleBits})
+	return nil
+}
+
+// PutBits queues the lowest n bits of bits, as uniformly distributed (incompressible) data
+func (e *Encoder) PutBits(bits uint64, n int) {
+	for n > 0 {
+		take := rawChunkBits
+		if take > n {
+			take = n
+		}
+		chunk := (bits >> uint(n-take)) & (1<<uint(take) - 1)
+		e.pending = append(e.pending, pending{start: uint32(chunk), freq: 1, scaleBits: uint(take)})
+		n -= take
+	}
+}
+
+// Bytes codes everything queued so far and returns the result
+func (e *Encoder) Bytes() []byte {
+	x := ransL
+	words := make([]uint32, 0, len(e.pending)/2+2)
+	for i := len(e.pending) - 1; i >= 0; i-- {
+		p := e.pending[i]
+		xMax := ((ransL >> p.scaleBits) << 32) * uint64(p.freq)
+		if x >= xMax {
+			words = append(words, uint32(x))
+			x >>= 32
+		}
+		x = ((x / uint64(p.freq)) << p.scaleBits) + (x % uint64(p.freq)) + uint64(p.start)
+	}
+	words = append(words, uint32(x), uint32(x>>32))
+
+	// The decoder reads the words in the reverse order to which they were written
+	result := make([]byte, 4*len(words))
+	for i := range words {
+		binary.LittleEndian.PutUint32(result[4*i:], words[len(words)-1-i])
+	}
+	return result
+}
+
+var ErrEndOfData = errors.New("ran out of rANS data")
+
+type Decoder struct {
+	x    uint64
+	data []byte
+	pos  int
+}
+
+func NewDecoder(data []byte) (*Decoder, error) {
+	if len(data) < 8 || len(data)%4 != 0 {
+		return nil, errors.New("rANS data is the wrong length")
+	}
+	hi := binary.LittleEndian.Uint32(data[0:])
+	lo := binary.LittleEndian.Uint32(data[4:])
+	return &Decoder{x: uint64(hi)<<32 | uint64(lo), data: data, pos: 8}, nil
+}
+
+func (d *Decoder) advance(start, freq uint32, scaleBits uint) error {
+	mask := uint64(1)<<scaleBits - 1
+	d.x = uint64(freq)*(d.x>>scaleBits) + (d.x & mask) - uint64(start)
+	if d.x < ransL {
+		if d.pos+4 > len(d.data) {
+			return ErrEndOfData
+		}
+		d.x = d.x<<32 | uint64(binary.LittleEndian.Uint32(d.data[d.pos:]))
+		d.pos += 4
+	}
+	return nil
+}
+
+// Get decodes a symbol that was coded with model m
+func (d *Decoder) Get(m *Model) (int64, error) {
+	slot := uint32(d.x & (uint64(1)<<m.scaleBits - 1))
+	value, start, freq := m.lookup(slot)
+	return value, d.advance(start, freq, m.scaleBits)
+}
+
+// GetBits decodes n raw bits that were coded with PutBits
+func (d *Decoder) GetBits(n int) (uint64, error) {
+	result := uint64(0)
+	for n > 0 {
+		take := rawChunkBits
+		if take > n {
+			take = n
+		}
+		chunk := uint32(d.x & (uint64(1)<<uint(take) - 1))
+		if err := d.advance(chunk, 1, uint(take)); err != nil {
+			return 0, err
+		}
+		result = result<<uint(take) | uint64(chunk)
+		n -= take
+	}
+	return result, nil
+}
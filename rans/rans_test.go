@@ -0,0 +1,181 @@
+package rans
+
+import (
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// item is a symbol (coded with a model) or some raw bits (if model is nil)
+type item struct {
+	model  *Model
+	symbol int64
+	bits   uint64
+	n      int
+}
+
+func mustModel(t *testing.T, freqs map[int64]int64, scaleBits int) *Model {
+	t.Helper()
+	m, err := NewModel(freqs, scaleBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func repeat(it item, count int) []item {
+	items := make([]item, count)
+	for i := range items {
+		items[i] = it
+	}
+	return items
+}
+
+func TestRoundTrip(t *testing.T) {
+	skewed := mustModel(t, map[int64]int64{0: 1 << 40, 1: 1, -7: 0}, 16) // 1 and -7 get a frequency of 1
+	if skewed.freqs[1] != 1 || skewed.freqs[-7] != 1 {
+		t.Fatalf("rare symbols have frequencies %d and %d, want 1", skewed.freqs[1], skewed.freqs[-7])
+	}
+	single := mustModel(t, map[int64]int64{5: 100}, 12)
+	fine := mustModel(t, map[int64]int64{0: 1000000, 1: 300000, 2: 10, 3: 0}, MAX_SCALE_BITS)
+
+	rng := rand.New(rand.NewSource(1))
+	var mixed []item
+	for i := 0; i < 50000; i++ {
+		switch rng.Intn(4) {
+		case 0:
+			mixed = append(mixed, item{model: skewed, symbol: []int64{0, 0, 0, 1, -7}[rng.Intn(5)]})
+		case 1:
+			mixed = append(mixed, item{model: fine, symbol: int64(rng.Intn(4))})
+		case 2:
+			mixed = append(mixed, item{model: single, symbol: 5})
+		default:
+			n := rng.Intn(65)
+			mixed = append(mixed, item{bits: rng.Uint64() & (1<<uint(n) - 1), n: n})
+		}
+	}
+
+	tests := []struct {
+		name  string
+		items []item
+	}{
+		{"empty", nil},
+		{"frequency 1 symbol", repeat(item{model: skewed, symbol: 1}, 1000)},
+		{"only the likeliest symbol", repeat(item{model: skewed, symbol: 0}, 100000)},
+		{"single symbol model", repeat(item{model: single, symbol: 5}, 1000)},
+		// Coding goes backwards from a state of ransL, which a zero chunk of rawChunkBits takes to exactly the
+		// renormalisation bound, so the chunk before it is coded right on the boundary
+		{"renormalisation boundary", []item{{bits: 1<<rawChunkBits - 1, n: rawChunkBits}, {bits: 0, n: rawChunkBits}}},
+		{"all ones", repeat(item{bits: 1<<64 - 1, n: 64}, 100)},
+		{"mixed", mixed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			enc := NewEncoder()
+			for _, it := range test.items {
+				if it.model == nil {
+					enc.PutBits(it.bits, it.n)
+				} else if err := enc.Put(it.model, it.symbol); err != nil {
+					t.Fatal(err)
+				}
+			}
+			data := enc.Bytes()
+
+			dec, err := NewDecoder(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, it := range test.items {
+				if it.model == nil {
+					bits, err := dec.GetBits(it.n)
+					if err != nil || bits != it.bits {
+						t.Fatalf("item %d: decoded bits %x (%v), want %x", i, bits, err, it.bits)
+					}
+				} else {
+					symbol, err := dec.Get(it.model)
+					if err != nil || symbol != it.symbol {
+						t.Fatalf("item %d: decoded %d (%v), want %d", i, symbol, err, it.symbol)
+					}
+				}
+			}
+			// Everything read, and the state back where the encoder started
+			if dec.pos != len(data) {
+				t.Fatalf("%d of %d bytes read", dec.pos, len(data))
+			}
+			if dec.x != ransL {
+				t.Fatalf("final state %x, want %x", dec.x, ransL)
+			}
+		})
+	}
+}
+
+func TestPutUnknownSymbol(t *testing.T) {
+	m := mustModel(t, map[int64]int64{1: 1, 2: 2}, 8)
+	if err := NewEncoder().Put(m, 3); err == nil {
+		t.Fatal("a symbol that isn't in the model was accepted")
+	}
+}
+
+func TestDecoderRunsOut(t *testing.T) {
+	enc := NewEncoder()
+	enc.PutBits(0x1234, 16)
+	data := enc.Bytes()
+	if _, err := NewDecoder(data[:len(data)-1]); err == nil {
+		t.Fatal("data of the wrong length was accepted")
+	}
+	dec, err := NewDecoder(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dec.GetBits(16); err != nil {
+		t.Fatal(err)
+	}
+	// Decoding on past the end soon needs more words than there are
+	for i := 0; i < 10; i++ {
+		if _, err = dec.GetBits(rawChunkBits); err != nil {
+			break
+		}
+	}
+	if err != ErrEndOfData {
+		t.Fatalf("decoding past the end gave %v, want ErrEndOfData", err)
+	}
+}
+
+// TestCostBits checks that the cost model (which the compression simulation uses) matches what is really coded
+func TestCostBits(t *testing.T) {
+	freqs := map[int64]int64{0: 1000000, 1: 300000, 2: 10, 3: 0, -5: 7}
+	for i := int64(10); i < 2000; i++ {
+		freqs[i] = i % 13
+	}
+	m := mustModel(t, freqs, DEFAULT_SCALE_BITS)
+	keys := make([]int64, 0, len(freqs))
+	for k := range freqs {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys) // So that the same symbols are picked every time
+
+	rng := rand.New(rand.NewSource(2))
+	enc := NewEncoder()
+	cost := 0.0
+	for i := 0; i < 100000; i++ {
+		symbol := keys[rng.Intn(len(keys))]
+		if rng.Intn(10) < 7 {
+			symbol = int64(rng.Intn(2))
+		}
+		if err := enc.Put(m, symbol); err != nil {
+			t.Fatal(err)
+		}
+		bits, ok := m.CostBits(symbol)
+		if !ok {
+			t.Fatalf("no cost for symbol %d", symbol)
+		}
+		cost += bits
+	}
+	actual := float64(8 * len(enc.Bytes()))
+	if actual < cost || actual > cost*1.001+64 {
+		t.Fatalf("coded in %.0f bits, but costed at %.0f", actual, cost)
+	}
+	if _, ok := m.CostBits(4); ok {
+		t.Fatal("a symbol that isn't in the model was costed")
+	}
+}
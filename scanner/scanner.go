@@ -0,0 +1,220 @@
+package scanner
+
+// Most stages go through a range of blocks in parallel, visiting each transaction's amounts with a worker-local
+// result, then merge the workers' results. This is that "feed the beast" worker pool, written once.
+
+import (
+	"context"
+	"github.com/KitchenMishap/pudding-huffman/amounts"
+	"github.com/KitchenMishap/pudding-huffman/blockchain"
+	"github.com/KitchenMishap/pudding-huffman/calendar"
+	"github.com/KitchenMishap/pudding-huffman/progress"
+	"github.com/KitchenMishap/pudding-shed/chainreadinterface"
+	"golang.org/x/sync/errgroup"
+)
+
+// Scanner is what every scan needs: a chain, where to read its amounts from, how many workers to use, and
+// where to report progress
+type Scanner struct {
+	chain    blockchain.AccessChain
+	source   amounts.Source
+	workers  int
+	reporter *progress.Reporter
+}
+
+// NewScanner scans a chain, reading the amounts from source (see amounts.Extract), or from the chain itself if
+// source is nil
+func NewScanner(chain blockchain.AccessChain, source amounts.Source, workers int, reporter *progress.Reporter) (*Scanner, error) {
+	if source == nil {
+		chainSource, err := amounts.NewChainSource(chain.Blockchain(), chain.HandleCreator())
+		if err != nil {
+			return nil, err
+		}
+		source = chainSource
+	}
+	return &Scanner{chain: chain, source: source, workers: workers, reporter: reporter}, nil
+}
+
+func (s *Scanner) Chain() blockchain.AccessChain {
+	return s.chain
+}
+
+func (s *Scanner) Source() amounts.Source {
+	return s.source
+}
+
+func (s *Scanner) Workers() int {
+	return s.workers
+}
+
+func (s *Scanner) Reporter() *progress.Reporter {
+	return s.reporter
+}
+
+// Trans is what a Visitor sees of each transaction
+type Trans struct {
+	Block   *amounts.Block
+	Epoch   int64   // When scanning by epoch (otherwise -1)
+	Index   int     // In the block
+	Amounts []int64 // The sats of each of its outputs
+	scanner *Scanner
+}
+
+// Height is the height (in the whole chain) of the transaction
+func (t *Trans) Height() int64 {
+	return t.Block.TransHeight(t.Index)
+}
+
+// FirstTxo is the height (in the whole chain) of the transaction's first txo
+func (t *Trans) FirstTxo() int64 {
+	return t.Block.FirstTxos[t.Index]
+}
+
+// Handle is the transaction's handle, for visitors that need more than its amounts. (It's looked up in the
+// chain, so costs a read or two.)
+func (t *Trans) Handle() (chainreadinterface.ITransHandle, error) {
+	blockHandle, err := t.scanner.chain.HandleCreator().BlockHandleByHeight(t.Block.Height)
+	if err != nil {
+		return nil, err
+	}
+	block, err := t.scanner.chain.Blockchain().BlockInterface(blockHandle)
+	if err != nil {
+		return nil, err
+	}
+	return block.NthTransaction(int64(t.Index))
+}
+
+// Visitor is called for each transaction, with the result local to the worker visiting it
+type Visitor[L any] func(local L, trans *Trans) error
+
+// Reducer merges one worker's local result (into the caller's). Reducers are called one at a time, once all
+// the workers are done.
+type Reducer[L any] func(local L)
+
+// Progress is told, as each block (or epoch) is finished, how many more blocks are done (see progress.Stage.Add).
+// It may be called from any worker.
+type Progress func(blocks int64)
+
+// ByBlock visits the transactions of blocks first to end-1, handing out a block at a time to the workers
+func ByBlock[L any](ctx context.Context, s *Scanner, first int64, end int64,
+	newLocal func() L, visit Visitor[L], reduce Reducer[L], progress Progress) error {
+
+	blockRanges := func(feed func(epoch int64, first int64, end int64) bool) {
+		for b := first; b < end; b++ {
+			if !feed(-1, b, b+1) {
+				return
+			}
+		}
+	}
+	return scan(ctx, s, blockRanges, newLocal, visit, reduce, progress)
+}
+
+// ByEpoch visits the transactions of blocks first to end-1, handing out an epoch at a time to the workers (so
+// that a visitor can keep per-epoch results without locking)
+func ByEpoch[L any](ctx context.Context, s *Scanner, epochs *calendar.Epochs, first int64, end int64,
+	newLocal func() L, visit Visitor[L], reduce Reducer[L], progress Progress) error {
+
+	if first >= end {
+		return nil
+	}
+	firstEpoch := epochs.Of(first)
+	endEpoch := epochs.Of(end-1) + 1
+	blockRanges := func(feed func(epoch int64, first int64, end int64) bool) {
+		for e := firstEpoch; e < endEpoch; e++ {
+			epochFirst, epochEnd := epochs.Blocks(e)
+			if !feed(e, max(epochFirst, first), min(epochEnd, end)) {
+				return
+			}
+		}
+	}
+	return scan(ctx, s, blockRanges, newLocal, visit, reduce, progress)
+}
+
+// scan is the worker pool behind ByBlock and ByEpoch. blockRanges feeds the jobs (each a range of blocks, and
+// its epoch), stopping if feed returns false.
+func scan[L any](ctx context.Context, s *Scanner,
+	blockRanges func(feed func(epoch int64, first int64, end int64) bool),
+	newLocal func() L, visit Visitor[L], reduce Reducer[L], progress Progress) error {
+
+	type job struct {
+		epoch int64
+		first int64
+		end   int64
+	}
+	jobsChan := make(chan job, 100) // Ranges of blocks get squirted into here
+	locals := make([]L, s.workers)  // Each worker's result, reduced at the end
+
+	// Create an errgroup and a context. (The caller's is kept, as cancelling it only stops the feeding, and the
+	// workers then finish normally.)
+	parentCtx := ctx
+	g, ctx := errgroup.WithContext(ctx)
+
+	for w := 0; w < s.workers; w++ {
+		g.Go(func() error {
+			var local L // A visitor that keeps no local result can have no newLocal (or reduce)
+			if newLocal != nil {
+				local = newLocal()
+			}
+			locals[w] = local
+			trans := Trans{scanner: s}
+
+			for j := range jobsChan {
+				// Check if another worker already failed
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				default:
+				}
+
+				trans.Epoch = j.epoch
+				for b := j.first; b < j.end; b++ {
+					block, err := s.source.Block(b)
+					if err != nil {
+						return err
+					}
+					trans.Block = block
+					for t, txoAmounts := range block.Trans {
+						trans.Index = t
+						trans.Amounts = txoAmounts
+						if err := visit(local, &trans); err != nil {
+							return err
+						}
+					}
+				}
+				if progress != nil {
+					progress(j.end - j.first)
+				}
+			}
+			return nil
+		})
+	}
+
+	// Feed the workers. This is errgroup context-aware
+	go func() {
+		defer close(jobsChan)
+		blockRanges(func(epoch int64, first int64, end int64) bool {
+			select { // Note: NOT a switch statement!
+			case jobsChan <- job{epoch: epoch, first: first, end: end}: // This happens if a worker is free
+				return true
+			case <-ctx.Done(): // This happens if a worker returned an err
+				return false
+			}
+		})
+	}()
+
+	// Wait for completion and handle the error
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if err := parentCtx.Err(); err != nil {
+		return err // Cancelled, so the locals are partial. Don't reduce them.
+	}
+
+	// --- REDUCE PHASE ---
+	if reduce != nil {
+		for _, local := range locals {
+			reduce(local)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/KitchenMishap/pudding-huffman/amounts"
+	"github.com/KitchenMishap/pudding-huffman/calendar"
+	"github.com/KitchenMishap/pudding-huffman/progress"
+)
+
+// fakeSource has blocks of three transactions, each with one output of the block's height
+type fakeSource struct {
+	blocks int64
+}
+
+func (fs fakeSource) Blocks() int64 {
+	return fs.blocks
+}
+
+func (fs fakeSource) Block(height int64) (*amounts.Block, error) {
+	block := amounts.Block{Height: height, FirstTrans: 3 * height, FirstTxos: make([]int64, 3), Trans: make([][]int64, 3)}
+	for t := range block.Trans {
+		block.FirstTxos[t] = 3*height + int64(t)
+		block.Trans[t] = []int64{height}
+	}
+	return &block, nil
+}
+
+func (fs fakeSource) BlockFees(height int64) ([]int64, error) {
+	return make([]int64, 3), nil
+}
+
+func newTestScanner(t *testing.T, blocks int64, workers int) *Scanner {
+	t.Helper()
+	s, err := NewScanner(nil, fakeSource{blocks: blocks}, workers, progress.NewReporter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestByBlock(t *testing.T) {
+	const blocks = 1000
+	s := newTestScanner(t, blocks, 4)
+	total := int64(0)
+	err := ByBlock(context.Background(), s, 0, blocks,
+		func() *int64 { return new(int64) },
+		func(local *int64, trans *Trans) error {
+			*local += trans.Amounts[0]
+			return nil
+		},
+		func(local *int64) { total += *local },
+		nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(3 * blocks * (blocks - 1) / 2); total != want {
+		t.Fatalf("total %d, want %d", total, want)
+	}
+}
+
+func TestByEpoch(t *testing.T) {
+	const blocks = 1000
+	s := newTestScanner(t, blocks, 4)
+	epochs, err := calendar.NewEpochs(calendar.BlockCount(144), make([]int64, blocks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ByEpoch(context.Background(), s, epochs, 0, blocks, nil,
+		func(_ struct{}, trans *Trans) error {
+			if trans.Epoch != epochs.Of(trans.Block.Height) {
+				t.Errorf("block %d visited in epoch %d", trans.Block.Height, trans.Epoch)
+			}
+			return nil
+		}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCancel checks that a scan cancelled by the caller returns the context's error, and reduces nothing (the
+// locals are partial), however far it had got
+func TestCancel(t *testing.T) {
+	const blocks = 1000
+	for _, cancelAt := range []int64{0, 10, blocks / 2, blocks - 1} {
+		for _, workers := range []int{1, 4, 16} {
+			s := newTestScanner(t, blocks, workers)
+			ctx, cancel := context.WithCancel(context.Background())
+			reduced := false
+			err := ByBlock(ctx, s, 0, blocks,
+				func() *int64 { return new(int64) },
+				func(local *int64, trans *Trans) error {
+					if trans.Block.Height == cancelAt {
+						cancel()
+					}
+					*local++
+					return nil
+				},
+				func(local *int64) { reduced = true },
+				nil)
+			cancel()
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("cancelled at block %d with %d workers: got %v, want context.Canceled", cancelAt, workers, err)
+			}
+			if reduced {
+				t.Fatalf("cancelled at block %d with %d workers: partial results were reduced", cancelAt, workers)
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package synthetic
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Builder puts a Chain together one block, and one transaction, at a time
+type Builder struct {
+	chain Chain
+	spent map[int64]bool // Txo heights already spent
+}
+
+func NewBuilder() *Builder {
+	return &Builder{spent: make(map[int64]bool)}
+}
+
+// MEDIAN_TIME_BLOCKS is the number of blocks whose median is "mediantime", as for bitcoin
+const MEDIAN_TIME_BLOCKS = 11
+
+// AddBlock starts a new block. Transactions added after this go in it.
+func (b *Builder) AddBlock(time int64) int64 {
+	height := int64(len(b.chain.blocks))
+	first := int64(len(b.chain.transactions))
+	b.chain.blocks = append(b.chain.blocks, blockData{firstTrans: first, time: time})
+
+	// Median of the times of this and the previous (up to) ten blocks
+	recent := make([]int64, 0, MEDIAN_TIME_BLOCKS)
+	for h := height; h >= 0 && h > height-MEDIAN_TIME_BLOCKS; h-- {
+		recent = append(recent, b.chain.blocks[h].time)
+	}
+	sort.Slice(recent, func(i, j int) bool { return recent[i] < recent[j] })
+	b.chain.blocks[height].medianTime = recent[len(recent)/2]
+	return height
+}
+
+// AddTransaction adds a transaction to the latest block. spends are the heights of the txos it spends (none for
+// a coinbase, which must come first in its block). It returns the height of the transaction's first txo.
+func (b *Builder) AddTransaction(spends []int64, outputs []int64) (int64, error) {
+	if len(b.chain.blocks) == 0 {
+		return -1, errors.New("add a block before adding transactions")
+	}
+	blockHeight := int64(len(b.chain.blocks)) - 1
+	block := &b.chain.blocks[blockHeight]
+	if len(spends) == 0 && block.transCount > 0 {
+		return -1, fmt.Errorf("block %d: only the first transaction can be a coinbase", blockHeight)
+	}
+	inputTotal := int64(0)
+	for _, txoHeight := range spends {
+		if txoHeight < 0 || txoHeight >= int64(len(b.chain.txos)) {
+			return -1, fmt.Errorf("txo %d doesn't exist yet", txoHeight)
+		}
+		if b.spent[txoHeight] {
+			return -1, fmt.Errorf("txo %d is already spent", txoHeight)
+		}
+		inputTotal += b.chain.txos[txoHeight].sats
+	}
+	outputTotal := int64(0)
+	for _, sats := range outputs {
+		if sats < 0 {
+			return -1, fmt.Errorf("negative output of %d sats", sats)
+		}
+		outputTotal += sats
+	}
+	if len(spends) > 0 && outputTotal > inputTotal {
+		return -1, fmt.Errorf("outputs of %d sats exceed inputs of %d sats", outputTotal, inputTotal)
+	}
+
+	handle := TransHandle{height: int64(len(b.chain.transactions)), block: blockHeight, nth: block.transCount}
+	trans := transData{
+		handle:   handle,
+		firstTxi: int64(len(b.chain.txis)),
+		txiCount: int64(len(spends)),
+		firstTxo: int64(len(b.chain.txos)),
+		txoCount: int64(len(outputs)),
+		// Roughly the size of a P2PKH transaction
+		sizeBytes: 10 + 148*int64(len(spends)) + 34*int64(len(outputs)),
+	}
+	for n, txoHeight := range spends {
+		b.spent[txoHeight] = true
+		txiHandle := TxiHandle{height: int64(len(b.chain.txis)), parent: handle, nth: int64(n)}
+		b.chain.txis = append(b.chain.txis, txiData{handle: txiHandle, sourceTxo: txoHeight})
+	}
+	for n, sats := range outputs {
+		txoHandle := TxoHandle{height: int64(len(b.chain.txos)), parent: handle, nth: int64(n)}
+		b.chain.txos = append(b.chain.txos, txoData{handle: txoHandle, sats: sats})
+	}
+	b.chain.transactions = append(b.chain.transactions, trans)
+	block.transCount++
+	return trans.firstTxo, nil
+}
+
+// Sats is the amount of a txo already added
+func (b *Builder) Sats(txoHeight int64) int64 {
+	return b.chain.txos[txoHeight].sats
+}
+
+// Chain returns the chain built so far
+func (b *Builder) Chain() *Chain {
+	return &b.chain
+}
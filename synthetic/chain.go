@@ -0,0 +1,232 @@
+package synthetic
+
+import (
+	"errors"
+	"fmt"
+	"github.com/KitchenMishap/pudding-shed/chainreadinterface"
+	"github.com/KitchenMishap/pudding-shed/chainstorage"
+	"github.com/KitchenMishap/pudding-shed/indexedhashes"
+)
+
+// Chain is a blockchain held entirely in memory, built from Go structs (see Builder and Generate).
+// It implements everything the stages read from a real pudding-shed folder, so that they can be run
+// (and checked) without one. Chain also satisfies blockchain.AccessChain.
+type Chain struct {
+	blocks       []blockData
+	transactions []transData
+	txis         []txiData
+	txos         []txoData
+}
+
+type blockData struct {
+	firstTrans int64
+	transCount int64
+	time       int64 // Unix seconds
+	medianTime int64
+}
+
+type transData struct {
+	handle    TransHandle
+	firstTxi  int64
+	txiCount  int64
+	firstTxo  int64
+	txoCount  int64
+	sizeBytes int64
+}
+
+type txiData struct {
+	handle    TxiHandle
+	sourceTxo int64 // Height of the txo that is spent
+}
+
+type txoData struct {
+	handle TxoHandle
+	sats   int64
+}
+
+// Compiler checks that implements
+var _ chainreadinterface.IBlockChain = (*Chain)(nil)
+var _ chainreadinterface.IHandleCreator = (*Chain)(nil)
+var _ chainstorage.IParents = (*Chain)(nil)
+
+// The same three things a ChainReader gives access to (blockchain.AccessChain)
+
+func (c *Chain) Blockchain() chainreadinterface.IBlockChain       { return c }
+func (c *Chain) HandleCreator() chainreadinterface.IHandleCreator { return c }
+func (c *Chain) Parents() chainstorage.IParents                   { return c }
+
+// Functions to implement IBlockTree as part of IBlockChain
+
+func (c *Chain) InvalidBlock() chainreadinterface.IBlockHandle {
+	return &BlockHandle{height: -1}
+}
+
+func (c *Chain) InvalidTrans() chainreadinterface.ITransHandle {
+	return &TransHandle{height: -1, block: -1, nth: -1}
+}
+
+func (c *Chain) GenesisBlock() chainreadinterface.IBlockHandle {
+	return &BlockHandle{height: 0}
+}
+
+func (c *Chain) ParentBlock(block chainreadinterface.IBlockHandle) chainreadinterface.IBlockHandle {
+	if block.Height() <= 0 {
+		return c.InvalidBlock()
+	}
+	return &BlockHandle{height: block.Height() - 1}
+}
+
+func (c *Chain) GenesisTransaction() (chainreadinterface.ITransHandle, error) {
+	return c.TransactionHandleByHeight(0)
+}
+
+func (c *Chain) PreviousTransaction(trans chainreadinterface.ITransHandle) chainreadinterface.ITransHandle {
+	handle, err := c.TransactionHandleByHeight(trans.Height() - 1)
+	if err != nil {
+		return c.InvalidTrans()
+	}
+	return handle
+}
+
+func (c *Chain) IsBlockTree() bool {
+	return false
+}
+
+func (c *Chain) BlockInterface(handle chainreadinterface.IBlockHandle) (chainreadinterface.IBlock, error) {
+	height := handle.Height()
+	if height < 0 || height >= int64(len(c.blocks)) {
+		return nil, fmt.Errorf("block %d not in the synthetic chain", height)
+	}
+	return &Block{BlockHandle: BlockHandle{height: height}, chain: c}, nil
+}
+
+func (c *Chain) TransInterface(handle chainreadinterface.ITransHandle) (chainreadinterface.ITransaction, error) {
+	height := handle.Height()
+	if height < 0 || height >= int64(len(c.transactions)) {
+		return nil, fmt.Errorf("transaction %d not in the synthetic chain", height)
+	}
+	return &Transaction{TransHandle: c.transactions[height].handle, chain: c}, nil
+}
+
+func (c *Chain) TxiInterface(handle chainreadinterface.ITxiHandle) (chainreadinterface.ITxi, error) {
+	height := handle.TxiHeight()
+	if height < 0 || height >= int64(len(c.txis)) {
+		return nil, fmt.Errorf("txi %d not in the synthetic chain", height)
+	}
+	return &Txi{TxiHandle: c.txis[height].handle, chain: c}, nil
+}
+
+func (c *Chain) TxoInterface(handle chainreadinterface.ITxoHandle) (chainreadinterface.ITxo, error) {
+	height := handle.TxoHeight()
+	if height < 0 || height >= int64(len(c.txos)) {
+		return nil, fmt.Errorf("txo %d not in the synthetic chain", height)
+	}
+	return &Txo{TxoHandle: c.txos[height].handle, sats: c.txos[height].sats}, nil
+}
+
+func (c *Chain) AddressInterface(handle chainreadinterface.IAddressHandle) (chainreadinterface.IAddress, error) {
+	return nil, ErrNoAddresses
+}
+
+// Functions to implement IBlockChain
+
+func (c *Chain) LatestBlock() (chainreadinterface.IBlockHandle, error) {
+	if len(c.blocks) == 0 {
+		return nil, errors.New("the synthetic chain has no blocks")
+	}
+	return &BlockHandle{height: int64(len(c.blocks)) - 1}, nil
+}
+
+func (c *Chain) NextBlock(block chainreadinterface.IBlockHandle) (chainreadinterface.IBlockHandle, error) {
+	if block.Height()+1 >= int64(len(c.blocks)) {
+		return c.InvalidBlock(), nil
+	}
+	return &BlockHandle{height: block.Height() + 1}, nil
+}
+
+func (c *Chain) LatestTransaction() (chainreadinterface.ITransHandle, error) {
+	return c.TransactionHandleByHeight(int64(len(c.transactions)) - 1)
+}
+
+func (c *Chain) NextTransaction(trans chainreadinterface.ITransHandle) (chainreadinterface.ITransHandle, error) {
+	if trans.Height()+1 >= int64(len(c.transactions)) {
+		return c.InvalidTrans(), nil
+	}
+	return c.TransactionHandleByHeight(trans.Height() + 1)
+}
+
+// Functions to implement IHandleCreator
+
+func (c *Chain) BlockHandleByHeight(blockHeight int64) (chainreadinterface.IBlockHandle, error) {
+	if blockHeight < 0 || blockHeight >= int64(len(c.blocks)) {
+		return nil, fmt.Errorf("block %d not in the synthetic chain", blockHeight)
+	}
+	return &BlockHandle{height: blockHeight}, nil
+}
+
+func (c *Chain) TransactionHandleByHeight(transactionHeight int64) (chainreadinterface.ITransHandle, error) {
+	if transactionHeight < 0 || transactionHeight >= int64(len(c.transactions)) {
+		return nil, fmt.Errorf("transaction %d not in the synthetic chain", transactionHeight)
+	}
+	handle := c.transactions[transactionHeight].handle
+	return &handle, nil
+}
+
+func (c *Chain) TxiHandleByHeight(txiHeight int64) (chainreadinterface.ITxiHandle, error) {
+	if txiHeight < 0 || txiHeight >= int64(len(c.txis)) {
+		return nil, fmt.Errorf("txi %d not in the synthetic chain", txiHeight)
+	}
+	handle := c.txis[txiHeight].handle
+	return &handle, nil
+}
+
+func (c *Chain) TxoHandleByHeight(txoHeight int64) (chainreadinterface.ITxoHandle, error) {
+	if txoHeight < 0 || txoHeight >= int64(len(c.txos)) {
+		return nil, fmt.Errorf("txo %d not in the synthetic chain", txoHeight)
+	}
+	handle := c.txos[txoHeight].handle
+	return &handle, nil
+}
+
+func (c *Chain) AddressHandleByHeight(addressHeight int64) (chainreadinterface.IAddressHandle, error) {
+	return nil, ErrNoAddresses
+}
+
+func (c *Chain) AddressHandleByHash(hash indexedhashes.Sha256) (chainreadinterface.IAddressHandle, error) {
+	return nil, ErrNoAddresses
+}
+
+func (c *Chain) AddressHandleByString(address string) (chainreadinterface.IAddressHandle, error) {
+	return nil, ErrNoAddresses
+}
+
+func (c *Chain) TransactionHandleByHash(hash indexedhashes.Sha256) (chainreadinterface.ITransHandle, error) {
+	return nil, ErrNoHashes
+}
+
+func (c *Chain) BlockHandleByHash(hash indexedhashes.Sha256) (chainreadinterface.IBlockHandle, error) {
+	return nil, ErrNoHashes
+}
+
+// Functions to implement IParents
+
+func (c *Chain) ParentBlockOfTrans(transactionHeight int64) (int64, error) {
+	if transactionHeight < 0 || transactionHeight >= int64(len(c.transactions)) {
+		return -1, fmt.Errorf("transaction %d not in the synthetic chain", transactionHeight)
+	}
+	return c.transactions[transactionHeight].handle.block, nil
+}
+
+func (c *Chain) ParentTransOfTxi(txiHeight int64) (int64, error) {
+	if txiHeight < 0 || txiHeight >= int64(len(c.txis)) {
+		return -1, fmt.Errorf("txi %d not in the synthetic chain", txiHeight)
+	}
+	return c.txis[txiHeight].handle.parent.height, nil
+}
+
+func (c *Chain) ParentTransOfTxo(txoHeight int64) (int64, error) {
+	if txoHeight < 0 || txoHeight >= int64(len(c.txos)) {
+		return -1, fmt.Errorf("txo %d not in the synthetic chain", txoHeight)
+	}
+	return c.txos[txoHeight].handle.parent.height, nil
+}
@@ -0,0 +1,94 @@
+package synthetic
+
+import (
+	"github.com/KitchenMishap/pudding-shed/chainreadinterface"
+)
+
+type Block struct {
+	BlockHandle
+	chain *Chain
+}
+
+func (b *Block) TransactionCount() (int64, error) {
+	return b.chain.blocks[b.height].transCount, nil
+}
+
+func (b *Block) NthTransaction(n int64) (chainreadinterface.ITransHandle, error) {
+	return b.chain.TransactionHandleByHeight(b.chain.blocks[b.height].firstTrans + n)
+}
+
+func (b *Block) NonEssentialInts() (*map[string]int64, error) {
+	data := b.chain.blocks[b.height]
+	nonEssentialInts := make(map[string]int64)
+	nonEssentialInts["time"] = data.time
+	nonEssentialInts["mediantime"] = data.medianTime
+	return &nonEssentialInts, nil
+}
+
+type Transaction struct {
+	TransHandle
+	chain *Chain
+}
+
+func (t *Transaction) data() *transData {
+	return &t.chain.transactions[t.height]
+}
+
+func (t *Transaction) TxiCount() (int64, error) {
+	return t.data().txiCount, nil
+}
+
+func (t *Transaction) NthTxi(n int64) (chainreadinterface.ITxiHandle, error) {
+	return t.chain.TxiHandleByHeight(t.data().firstTxi + n)
+}
+
+func (t *Transaction) TxoCount() (int64, error) {
+	return t.data().txoCount, nil
+}
+
+func (t *Transaction) NthTxo(n int64) (chainreadinterface.ITxoHandle, error) {
+	return t.chain.TxoHandleByHeight(t.data().firstTxo + n)
+}
+
+func (t *Transaction) AllTxoSatoshis() ([]int64, error) {
+	data := t.data()
+	result := make([]int64, data.txoCount)
+	for i := range result {
+		result[i] = t.chain.txos[data.firstTxo+int64(i)].sats
+	}
+	return result, nil
+}
+
+func (t *Transaction) NonEssentialInts() (*map[string]int64, error) {
+	nonEssentialInts := make(map[string]int64)
+	nonEssentialInts["size"] = t.data().sizeBytes
+	return &nonEssentialInts, nil
+}
+
+type Txi struct {
+	TxiHandle
+	chain *Chain
+}
+
+func (t *Txi) SourceTxo() (chainreadinterface.ITxoHandle, error) {
+	return t.chain.TxoHandleByHeight(t.chain.txis[t.height].sourceTxo)
+}
+
+type Txo struct {
+	TxoHandle
+	sats int64
+}
+
+func (t *Txo) Satoshis() (int64, error) {
+	return t.sats, nil
+}
+
+func (t *Txo) Address() (chainreadinterface.IAddressHandle, error) {
+	return nil, ErrNoAddresses
+}
+
+// Compiler checks that implements
+var _ chainreadinterface.IBlock = (*Block)(nil)
+var _ chainreadinterface.ITransaction = (*Transaction)(nil)
+var _ chainreadinterface.ITxi = (*Txi)(nil)
+var _ chainreadinterface.ITxo = (*Txo)(nil)
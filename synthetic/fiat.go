@@ -0,0 +1,125 @@
+package synthetic
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/KitchenMishap/pudding-huffman/atomicfile"
+	"github.com/KitchenMishap/pudding-huffman/calendar"
+	"github.com/KitchenMishap/pudding-huffman/kmeans"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// --- Round Fiat Payments With A Known Exchange Rate ---
+
+// Currency is a home currency, with the round amounts people pay in it
+type Currency struct {
+	Code         string
+	RoundAmounts []float64
+	PerUSD       float64 // Roughly, so that a price path in USD can be scaled
+}
+
+var USD = Currency{Code: "USD", RoundAmounts: []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000}, PerUSD: 1}
+var EUR = Currency{Code: "EUR", RoundAmounts: []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000}, PerUSD: 0.9}
+var JPY = Currency{Code: "JPY", RoundAmounts: []float64{100, 500, 1000, 2000, 5000, 10000, 20000, 50000, 100000}, PerUSD: 140}
+
+var Currencies = map[string]Currency{"USD": USD, "EUR": EUR, "JPY": JPY}
+
+// PricePoint is the fiat price of one BTC at a time
+type PricePoint struct {
+	Time  int64 // Unix seconds
+	Price float64
+}
+
+// SeriesPrice follows a price time series, using the time of each block (genesisTime + height*blockInterval).
+// Between points the log of the price is interpolated. Before the first point and after the last, it's flat.
+func SeriesPrice(points []PricePoint, genesisTime int64, blockInterval int64) PricePath {
+	sorted := append([]PricePoint(nil), points...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Time < sorted[j].Time })
+	return func(height int64) float64 {
+		t := genesisTime + height*blockInterval
+		i := sort.Search(len(sorted), func(i int) bool { return sorted[i].Time >= t })
+		if i == 0 {
+			return sorted[0].Price
+		}
+		if i == len(sorted) {
+			return sorted[len(sorted)-1].Price
+		}
+		before, after := sorted[i-1], sorted[i]
+		fraction := float64(t-before.Time) / float64(after.Time-before.Time)
+		return math.Exp(math.Log(before.Price) + fraction*(math.Log(after.Price)-math.Log(before.Price)))
+	}
+}
+
+// FiatPaymentConfig generates mostly round fiat payments in the currency, at the given price (fiat per BTC).
+// Each payment's exchange rate is jittered a little (wallets and exchanges don't all agree), and the change
+// outputs are whatever is left.
+func FiatPaymentConfig(blocks int64, currency Currency, price PricePath) GeneratorConfig {
+	config := DefaultGeneratorConfig(blocks)
+	config.Price = price
+	config.FiatAmounts = currency.RoundAmounts
+	config.FiatShare = 0.7
+	config.CelebrityShare = 0.05
+	config.PriceJitter = 0.001
+	return config
+}
+
+// DefaultFiatPrice is the default price path (see DefaultGeneratorConfig) in another currency
+func DefaultFiatPrice(blocks int64, currency Currency) PricePath {
+	return ExponentialPrice(100*currency.PerUSD, 100000*currency.PerUSD, blocks)
+}
+
+// GroundTruthPhases is the true peak phase for each micro-epoch, from the geometric mean price of its blocks.
+// It is the phase the kmeans stage should find as the main peak (see kmeans.PhaseOfPrice).
+func (config GeneratorConfig) GroundTruthPhases(microEpochs *calendar.Epochs) []float64 {
+	phases := make([]float64, microEpochs.Count())
+	for me := range phases {
+		sumLog := 0.0
+		count := 0
+		first, end := microEpochs.Blocks(int64(me))
+		for h := first; h < end; h++ {
+			sumLog += math.Log(config.Price(h))
+			count++
+		}
+		phases[me] = kmeans.PhaseOfPrice(math.Exp(sumLog / float64(count)))
+	}
+	return phases
+}
+
+// WriteGroundTruthCSV writes the true phase and price of every micro-epoch, to compare against Oracle.csv
+func (config GeneratorConfig) WriteGroundTruthCSV(filename string, microEpochs *calendar.Epochs) error {
+	return atomicfile.Write(filename, func(f io.Writer) error {
+		w := csv.NewWriter(f)
+		w.Write([]string{"microEpoch", "Date", "TruePhase", "TruePrice"})
+		for me, phase := range config.GroundTruthPhases(microEpochs) {
+			first, end := microEpochs.Blocks(int64(me))
+			price := config.Price((first + end) / 2)
+			w.Write([]string{fmt.Sprintf("%d", me), microEpochs.Date(int64(me)), fmt.Sprintf("%.4f", phase), fmt.Sprintf("%.2f", price)})
+		}
+		w.Flush()
+		return w.Error()
+	})
+}
+
+// WriteReferencePriceCSV writes the price at midday of every UTC day (date, price), in the same form as a
+// reference price CSV for the evaluate package
+func (config GeneratorConfig) WriteReferencePriceCSV(filename string) error {
+	return atomicfile.Write(filename, func(f io.Writer) error {
+		w := csv.NewWriter(f)
+		w.Write([]string{"date", "price"})
+		const day = 24 * 60 * 60
+		end := config.GenesisTime + config.Blocks*config.BlockInterval
+		for t := config.GenesisTime - config.GenesisTime%day; t < end; t += day {
+			height := (t + day/2 - config.GenesisTime) / config.BlockInterval
+			if height < 0 {
+				height = 0
+			}
+			date := time.Unix(t, 0).UTC().Format(time.DateOnly)
+			w.Write([]string{date, fmt.Sprintf("%.2f", config.Price(height))})
+		}
+		w.Flush()
+		return w.Error()
+	})
+}
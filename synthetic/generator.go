@@ -0,0 +1,198 @@
+package synthetic
+
+import (
+	"errors"
+	"github.com/KitchenMishap/pudding-huffman/amounts"
+	"math"
+	"math/rand"
+)
+
+// PricePath is the fiat price of one BTC at each block height
+type PricePath func(height int64) float64
+
+func ConstantPrice(fiatPerBTC float64) PricePath {
+	return func(height int64) float64 { return fiatPerBTC }
+}
+
+// ExponentialPrice goes smoothly from startFiat to endFiat over the given number of blocks
+func ExponentialPrice(startFiat float64, endFiat float64, blocks int64) PricePath {
+	growth := math.Log(endFiat/startFiat) / float64(blocks)
+	return func(height int64) float64 { return startFiat * math.Exp(growth*float64(height)) }
+}
+
+// RandomWalkPrice is a geometric random walk from startFiat. volatility is the standard deviation
+// of the log price change per block.
+func RandomWalkPrice(startFiat float64, volatility float64, blocks int64, rng *rand.Rand) PricePath {
+	prices := make([]float64, blocks)
+	logPrice := math.Log(startFiat)
+	for h := range prices {
+		prices[h] = math.Exp(logPrice)
+		logPrice += rng.NormFloat64() * volatility
+	}
+	return func(height int64) float64 {
+		if height < 0 {
+			return prices[0]
+		}
+		if height >= blocks {
+			return prices[blocks-1]
+		}
+		return prices[height]
+	}
+}
+
+// GeneratorConfig describes the payments in a synthetic chain. Every payment is either a round fiat amount
+// converted at the price of the block, a round BTC "celebrity" amount, or a random amount. Whatever is
+// left of the inputs (after payments and fees) goes to a change output.
+type GeneratorConfig struct {
+	Blocks               int64
+	TransactionsPerBlock int
+	GenesisTime          int64 // Unix seconds
+	BlockInterval        int64 // Seconds
+	Price                PricePath
+	FiatAmounts          []float64 // Round fiat amounts, such as 20.00
+	FiatShare            float64   // Fraction of payments that are round fiat amounts
+	FiatBusiestHour      float64   // UTC hour of the day when round fiat payments are most common
+	FiatDailySwing       float64   // 0 for no daily cycle, up to 1 for no fiat payments 12 hours from FiatBusiestHour
+	PriceJitter          float64   // Standard deviation of the log10 exchange rate used for each fiat payment
+	CelebrityAmounts     []int64   // Round BTC amounts in sats
+	CelebrityShare       float64   // Fraction of payments that are celebrities
+	MaxPayments          int       // Payments per transaction, 1 to MaxPayments
+	MinFee               int64
+	MaxFee               int64
+}
+
+const GENESIS_TIME = 1231006505 // The real genesis block
+
+// DEFAULT_FIAT_DAILY_SWING gives a strong daily cycle of fiat payments (see FiatDailySwing)
+const DEFAULT_FIAT_DAILY_SWING = 0.8
+const SATS_PER_BTC = amounts.SATS_PER_BTC
+
+func DefaultGeneratorConfig(blocks int64) GeneratorConfig {
+	return GeneratorConfig{
+		Blocks:               blocks,
+		TransactionsPerBlock: 20,
+		GenesisTime:          GENESIS_TIME,
+		BlockInterval:        600,
+		Price:                ExponentialPrice(100, 100000, blocks),
+		FiatAmounts:          []float64{1, 2, 5, 10, 20, 25, 50, 100, 200, 250, 500, 1000},
+		FiatShare:            0.4,
+		CelebrityAmounts:     []int64{1000000, 10000000, 50000000, 100000000, 500000000, 1000000000},
+		CelebrityShare:       0.1,
+		MaxPayments:          3,
+		MinFee:               1000,
+		MaxFee:               20000,
+	}
+}
+
+// Generate builds a synthetic chain. Each block's coinbase claims the subsidy plus the block's fees.
+// Transactions only spend txos from earlier blocks.
+func Generate(config GeneratorConfig, rng *rand.Rand) (*Chain, error) {
+	if config.Blocks <= 0 {
+		return nil, errors.New("a synthetic chain needs at least one block")
+	}
+	if config.MaxPayments < 1 {
+		config.MaxPayments = 1
+	}
+	builder := NewBuilder()
+	unspent := make([]int64, 0, 1000) // Txo heights that can be spent
+
+	type pendingTrans struct {
+		spends  []int64
+		outputs []int64
+	}
+	for height := int64(0); height < config.Blocks; height++ {
+		blockTime := config.GenesisTime + height*config.BlockInterval
+		builder.AddBlock(blockTime)
+		price := config.Price(height)
+		fiatShare := config.FiatShareAt(blockTime)
+
+		// Work out the block's transactions first, as the coinbase needs their fees
+		pending := make([]pendingTrans, 0, config.TransactionsPerBlock)
+		fees := int64(0)
+		for t := 0; t < config.TransactionsPerBlock && len(unspent) > 0; t++ {
+			payments := make([]int64, 1+rng.Intn(config.MaxPayments))
+			needed := config.MinFee
+			if config.MaxFee > config.MinFee {
+				needed += rng.Int63n(config.MaxFee - config.MinFee + 1)
+			}
+			fee := needed
+			for p := range payments {
+				payments[p] = randomPayment(config, price, fiatShare, rng)
+				needed += payments[p]
+			}
+
+			// Spend random unspent txos until there's enough
+			spends := make([]int64, 0, 4)
+			inputTotal := int64(0)
+			for inputTotal < needed && len(unspent) > 0 {
+				i := rng.Intn(len(unspent))
+				spends = append(spends, unspent[i])
+				inputTotal += builder.Sats(unspent[i])
+				unspent[i] = unspent[len(unspent)-1]
+				unspent = unspent[:len(unspent)-1]
+			}
+			if inputTotal < needed {
+				// Can't afford it. Pay whatever we gathered back to ourselves, less the fee.
+				if inputTotal <= fee {
+					fee = inputTotal
+					payments = nil
+				} else {
+					payments = []int64{inputTotal - fee}
+				}
+			} else if change := inputTotal - needed; change > 0 {
+				// The change goes in a random position among the payments
+				c := rng.Intn(len(payments) + 1)
+				payments = append(payments, 0)
+				copy(payments[c+1:], payments[c:])
+				payments[c] = change
+			}
+			if len(payments) == 0 {
+				payments = []int64{0} // Every transaction has at least one output
+			}
+			pending = append(pending, pendingTrans{spends: spends, outputs: payments})
+			fees += fee
+		}
+
+		firstTxo, err := builder.AddTransaction(nil, []int64{amounts.BlockSubsidy(height) + fees})
+		if err != nil {
+			return nil, err
+		}
+		newTxos := []int64{firstTxo}
+		for _, trans := range pending {
+			firstTxo, err = builder.AddTransaction(trans.spends, trans.outputs)
+			if err != nil {
+				return nil, err
+			}
+			for o, sats := range trans.outputs {
+				if sats > 0 {
+					newTxos = append(newTxos, firstTxo+int64(o))
+				}
+			}
+		}
+		unspent = append(unspent, newTxos...)
+	}
+	return builder.Chain(), nil
+}
+
+// FiatShareAt is the fraction of payments that are round fiat amounts at a given time (Unix seconds),
+// following the daily cycle (see FiatBusiestHour and FiatDailySwing)
+func (config GeneratorConfig) FiatShareAt(unixTime int64) float64 {
+	const day = 24 * 60 * 60
+	hour := float64(unixTime%day) / (60 * 60)
+	cycle := math.Cos(2 * math.Pi * (hour - config.FiatBusiestHour) / 24) // 1 at the busiest hour
+	return config.FiatShare * (1 + config.FiatDailySwing*(cycle-1)/2)
+}
+
+func randomPayment(config GeneratorConfig, price float64, fiatShare float64, rng *rand.Rand) int64 {
+	r := rng.Float64()
+	if r < fiatShare && len(config.FiatAmounts) > 0 {
+		fiat := config.FiatAmounts[rng.Intn(len(config.FiatAmounts))]
+		rate := price * math.Pow(10, rng.NormFloat64()*config.PriceJitter)
+		return int64(math.Round(fiat / rate * SATS_PER_BTC))
+	}
+	if r < fiatShare+config.CelebrityShare && len(config.CelebrityAmounts) > 0 {
+		return config.CelebrityAmounts[rng.Intn(len(config.CelebrityAmounts))]
+	}
+	// Random, evenly spread in log space from 1000 sats to 10 BTC
+	return int64(math.Pow(10, 3+6*rng.Float64()))
+}
@@ -0,0 +1,76 @@
+package synthetic
+
+import (
+	"errors"
+	"github.com/KitchenMishap/pudding-shed/chainreadinterface"
+	"github.com/KitchenMishap/pudding-shed/indexedhashes"
+)
+
+// Everything in a synthetic chain is identified by height. There are no hashes, and no addresses.
+
+var ErrNoHashes = errors.New("a synthetic chain has no hashes")
+var ErrNoAddresses = errors.New("a synthetic chain has no addresses")
+
+type BlockHandle struct {
+	height int64
+}
+
+func (h *BlockHandle) Height() int64 { return h.height }
+func (h *BlockHandle) Hash() (indexedhashes.Sha256, error) {
+	return indexedhashes.Sha256{}, ErrNoHashes
+}
+func (h *BlockHandle) HeightSpecified() bool { return true }
+func (h *BlockHandle) HashSpecified() bool   { return false }
+func (h *BlockHandle) IsBlockHandle()        {}
+func (h *BlockHandle) IsInvalid() bool       { return h.height < 0 }
+
+type TransHandle struct {
+	height int64
+	block  int64 // Height of the parent block
+	nth    int64 // Index within the parent block
+}
+
+func (h *TransHandle) Height() int64 { return h.height }
+func (h *TransHandle) Hash() (indexedhashes.Sha256, error) {
+	return indexedhashes.Sha256{}, ErrNoHashes
+}
+func (h *TransHandle) IndicesPath() (int64, int64) { return h.block, h.nth }
+func (h *TransHandle) HeightSpecified() bool       { return true }
+func (h *TransHandle) HashSpecified() bool         { return false }
+func (h *TransHandle) IndicesPathSpecified() bool  { return h.height >= 0 }
+func (h *TransHandle) IsTransHandle()              {}
+func (h *TransHandle) IsInvalid() bool             { return h.height < 0 }
+
+type TxiHandle struct {
+	height int64
+	parent TransHandle
+	nth    int64 // Index within the parent transaction
+}
+
+func (h *TxiHandle) ParentTrans() chainreadinterface.ITransHandle { return &h.parent }
+func (h *TxiHandle) ParentIndex() int64                           { return h.nth }
+func (h *TxiHandle) TxiHeight() int64                             { return h.height }
+func (h *TxiHandle) IndicesPath() (int64, int64, int64)           { return h.parent.block, h.parent.nth, h.nth }
+func (h *TxiHandle) ParentSpecified() bool                        { return true }
+func (h *TxiHandle) TxiHeightSpecified() bool                     { return true }
+func (h *TxiHandle) IndicesPathSpecified() bool                   { return true }
+
+type TxoHandle struct {
+	height int64
+	parent TransHandle
+	nth    int64 // Index within the parent transaction
+}
+
+func (h *TxoHandle) ParentTrans() chainreadinterface.ITransHandle { return &h.parent }
+func (h *TxoHandle) ParentIndex() int64                           { return h.nth }
+func (h *TxoHandle) TxoHeight() int64                             { return h.height }
+func (h *TxoHandle) IndicesPath() (int64, int64, int64)           { return h.parent.block, h.parent.nth, h.nth }
+func (h *TxoHandle) ParentSpecified() bool                        { return true }
+func (h *TxoHandle) TxoHeightSpecified() bool                     { return true }
+func (h *TxoHandle) IndicesPathSpecified() bool                   { return true }
+
+// Compiler checks that implements
+var _ chainreadinterface.IBlockHandle = (*BlockHandle)(nil)
+var _ chainreadinterface.ITransHandle = (*TransHandle)(nil)
+var _ chainreadinterface.ITxiHandle = (*TxiHandle)(nil)
+var _ chainreadinterface.ITxoHandle = (*TxoHandle)(nil)
@@ -0,0 +1,393 @@
+package synthetic_test
+
+// The synthetic chain is generated from a known price, so the stages run on it can be checked against the
+// truth: the phase of the price, and the very amounts that were generated.
+
+import (
+	"context"
+	"encoding/csv"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/KitchenMishap/pudding-huffman/amounts"
+	"github.com/KitchenMishap/pudding-huffman/calendar"
+	"github.com/KitchenMishap/pudding-huffman/compress"
+	"github.com/KitchenMishap/pudding-huffman/huffman"
+	"github.com/KitchenMishap/pudding-huffman/jobs"
+	"github.com/KitchenMishap/pudding-huffman/kmeans"
+	"github.com/KitchenMishap/pudding-huffman/progress"
+	"github.com/KitchenMishap/pudding-huffman/scanner"
+	"github.com/KitchenMishap/pudding-huffman/synthetic"
+)
+
+const TEST_BLOCKS = 1500
+
+// PHASE_TOLERANCE is how far a detected phase can be from the truth, and still count as right
+const PHASE_TOLERANCE = 0.01
+
+// pricePaths are the price paths (in EUR) that the tests generate chains from
+func pricePaths(blocks int64) []struct {
+	name  string
+	price synthetic.PricePath
+} {
+	start := int64(synthetic.GENESIS_TIME)
+	week := int64(7 * 24 * 60 * 60)
+	return []struct {
+		name  string
+		price synthetic.PricePath
+	}{
+		{"constant", synthetic.ConstantPrice(27000)},
+		{"exponential", synthetic.ExponentialPrice(20000, 25000, blocks)},
+		{"series", synthetic.SeriesPrice([]synthetic.PricePoint{
+			{Time: start, Price: 900},
+			{Time: start + week, Price: 1100},
+			{Time: start + 2*week, Price: 1000},
+		}, synthetic.GENESIS_TIME, 600)},
+		{"random walk", synthetic.RandomWalkPrice(5000, 0.002, blocks, rand.New(rand.NewSource(3)))},
+	}
+}
+
+func generate(t *testing.T, blocks int64, price synthetic.PricePath) (*synthetic.Chain, synthetic.GeneratorConfig) {
+	t.Helper()
+	config := synthetic.FiatPaymentConfig(blocks, synthetic.EUR, price)
+	chain, err := synthetic.Generate(config, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chain, config
+}
+
+func blockTimes(t *testing.T, chain *synthetic.Chain, blocks int64) []int64 {
+	t.Helper()
+	times, err := calendar.BlockTimes(chain, chain, blocks, calendar.TIME_FIELD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return times
+}
+
+func newScanner(t *testing.T, chain *synthetic.Chain) *scanner.Scanner {
+	t.Helper()
+	scan, err := scanner.NewScanner(chain, nil, 2, progress.NewReporter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return scan
+}
+
+// celebCodes gives every epoch a code for each of the chain's celebrity amounts (the codes themselves don't matter)
+func celebCodes(config synthetic.GeneratorConfig, epochs *calendar.Epochs) []map[int64]huffman.BitCode {
+	codes := make([]map[int64]huffman.BitCode, epochs.Count())
+	for e := range codes {
+		codes[e] = make(map[int64]huffman.BitCode)
+		for i, amount := range config.CelebrityAmounts {
+			codes[e][amount] = huffman.BitCode{Bits: uint64(i), Length: 3}
+		}
+	}
+	return codes
+}
+
+func TestNewEpochs(t *testing.T) {
+	chain, _ := generate(t, TEST_BLOCKS, synthetic.ConstantPrice(27000))
+	times := blockTimes(t, chain, TEST_BLOCKS)
+
+	// The truth: the UTC day, week or month of each block's time
+	periodOf := map[string]func(t time.Time) string{
+		"day":  func(t time.Time) string { return t.Format(time.DateOnly) },
+		"week": func(t time.Time) string { y, w := t.ISOWeek(); return strconv.Itoa(y*100 + w) },
+		"month": func(t time.Time) string {
+			return t.Format("2006-01")
+		},
+		"144": func(t time.Time) string { return "" }, // Not by time
+	}
+	tests := []struct {
+		spec  string
+		count int64
+	}{
+		{"144", (TEST_BLOCKS + 143) / 144},
+		{"1000", 2},
+		{"day", -1}, // Counted from the block times
+		{"week", -1},
+		{"month", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			spec, err := calendar.ParseSpec(test.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			epochs, err := calendar.NewEpochs(spec, times)
+			if err != nil {
+				t.Fatal(err)
+			}
+			count := test.count
+			if count < 0 {
+				periods := make(map[string]bool)
+				for _, secs := range times {
+					periods[periodOf[test.spec](time.Unix(secs, 0).UTC())] = true
+				}
+				count = int64(len(periods))
+			}
+			if epochs.Count() != count {
+				t.Fatalf("%d epochs, want %d", epochs.Count(), count)
+			}
+			if epochs.BlockCount() != TEST_BLOCKS {
+				t.Fatalf("%d blocks, want %d", epochs.BlockCount(), TEST_BLOCKS)
+			}
+
+			// The epochs follow on from each other, and each is a single period
+			next := int64(0)
+			for e := int64(0); e < epochs.Count(); e++ {
+				first, end := epochs.Blocks(e)
+				if first != next || end <= first {
+					t.Fatalf("epoch %d is blocks %d to %d, following on from %d", e, first, end-1, next)
+				}
+				for h := first; h < end; h++ {
+					if epochs.Of(h) != e {
+						t.Fatalf("block %d is in epoch %d, want %d", h, epochs.Of(h), e)
+					}
+					if spec.Period != calendar.BLOCKS {
+						period := periodOf[test.spec](time.Unix(times[h], 0).UTC())
+						if period != periodOf[test.spec](time.Unix(times[first], 0).UTC()) {
+							t.Fatalf("block %d of epoch %d is in another period (%s)", h, e, period)
+						}
+					}
+				}
+				next = end
+			}
+		})
+	}
+}
+
+func TestParallelAmountStatistics(t *testing.T) {
+	chain, config := generate(t, TEST_BLOCKS, synthetic.ConstantPrice(27000))
+	epochs, err := calendar.NewEpochs(calendar.BlockCount(500), blockTimes(t, chain, TEST_BLOCKS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	celebrities := make(map[int64]bool)
+	for _, amount := range config.CelebrityAmounts {
+		celebrities[amount] = true
+	}
+
+	tests := []struct {
+		name   string
+		celebs []map[int64]huffman.BitCode
+	}{
+		{"no celebrities", make([]map[int64]huffman.BitCode, epochs.Count())},
+		{"celebrities", celebCodes(config, epochs)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The truth, read straight from the chain
+			wantMags := make([]int64, 65)
+			wantExps := make([]int64, jobs.MAX_BASE_10_EXP)
+			for h := int64(0); h < TEST_BLOCKS; h++ {
+				block, err := chain.BlockInterface(mustBlockHandle(t, chain, h))
+				if err != nil {
+					t.Fatal(err)
+				}
+				count, _ := block.TransactionCount()
+				for n := int64(0); n < count; n++ {
+					handle, _ := block.NthTransaction(n)
+					trans, _ := chain.TransInterface(handle)
+					amounts, err := trans.AllTxoSatoshis()
+					if err != nil {
+						t.Fatal(err)
+					}
+					for _, amount := range amounts {
+						if len(test.celebs[epochs.Of(h)]) > 0 && celebrities[amount] {
+							continue
+						}
+						wantMags[bitLen(amount)]++
+						if amount > 0 {
+							wantExps[int(math.Floor(math.Log10(float64(amount))))]++
+						}
+					}
+				}
+			}
+
+			_, mags, exps, err := compress.ParallelAmountStatistics(context.Background(), newScanner(t, chain), epochs, test.celebs, jobs.MAX_BASE_10_EXP)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range wantMags {
+				if mags[i] != wantMags[i] {
+					t.Fatalf("%d amounts of %d bits, want %d", mags[i], i, wantMags[i])
+				}
+			}
+			for i := range wantExps {
+				if exps[i] != wantExps[i] {
+					t.Fatalf("%d amounts of exponent %d, want %d", exps[i], i, wantExps[i])
+				}
+			}
+		})
+	}
+}
+
+func mustBlockHandle(t *testing.T, chain *synthetic.Chain, height int64) *synthetic.BlockHandle {
+	t.Helper()
+	handle, err := chain.BlockHandleByHeight(height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handle.(*synthetic.BlockHandle)
+}
+
+func bitLen(amount int64) int {
+	n := 0
+	for ; amount > 0; amount >>= 1 {
+		n++
+	}
+	return n
+}
+
+// TestParallelKMeans checks that the anchor (main) peak of each micro-epoch is at the phase of the price
+func TestParallelKMeans(t *testing.T) {
+	for _, path := range pricePaths(TEST_BLOCKS) {
+		t.Run(path.name, func(t *testing.T) {
+			chain, config := generate(t, TEST_BLOCKS, path.price)
+			times := blockTimes(t, chain, TEST_BLOCKS)
+			epochs, err := calendar.NewEpochs(calendar.BlockCount(500), times)
+			if err != nil {
+				t.Fatal(err)
+			}
+			microEpochs, err := calendar.NewEpochs(calendar.BlockCount(144), times)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			peaks, _, err := kmeans.ParallelKMeans(context.Background(), newScanner(t, chain), epochs, microEpochs,
+				celebCodes(config, epochs), rand.New(rand.NewSource(1)), nil, kmeans.DefaultConfig(), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			truth := config.GroundTruthPhases(microEpochs)
+			checkPhases(t, truth, func(me int) (float64, bool) {
+				if len(peaks[me]) == 0 {
+					return 0, false
+				}
+				return peaks[me][0], true
+			})
+		})
+	}
+}
+
+// checkPhases fails the test unless nearly every micro-epoch's phase is within PHASE_TOLERANCE of the truth
+func checkPhases(t *testing.T, truth []float64, phaseOf func(me int) (float64, bool)) {
+	t.Helper()
+	hits := 0
+	for me, want := range truth {
+		got, ok := phaseOf(me)
+		if ok && kmeans.PhaseDistance(got, want) <= PHASE_TOLERANCE {
+			hits++
+		} else {
+			t.Logf("micro-epoch %d: phase %.4f (found %v), want %.4f", me, got, ok, want)
+		}
+	}
+	if hits < len(truth)*9/10 {
+		t.Fatalf("%d of %d micro-epochs at the phase of the price", hits, len(truth))
+	}
+}
+
+// TestRoundTrip runs the whole job on a synthetic chain. The compression simulation encodes and decodes every
+// block with the real codec, and fails unless every amount comes back as generated. Then the anchors in
+// Oracle.csv are checked against the phase of the price. (The fees are checked too, both from the chain and from
+// the amounts file, as the codec takes them from there rather than from the generator.)
+func TestRoundTrip(t *testing.T) {
+	paths := pricePaths(TEST_BLOCKS)
+	for _, path := range []int{0, 3} {
+		t.Run(paths[path].name, func(t *testing.T) {
+			chain, config := generate(t, TEST_BLOCKS, paths[path].price)
+			chainSource, err := amounts.NewChainSource(chain, chain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkFees(t, chainSource, config)
+			t.Chdir(t.TempDir()) // The CSVs are written to the current folder
+
+			runConfig := jobs.DefaultConfig()
+			runConfig.Epoch = calendar.BlockCount(500)
+			runConfig.MicroEpoch = calendar.BlockCount(144)
+			runConfig.Workers = 2
+			runConfig.Checkpoints = ""
+			runConfig.Amounts = "Amounts" // So the simulation reads the fees from the amounts file
+			// At a steady price the round fiat amounts are common enough to be celebrities, and celebrities are
+			// left out of k-means. So only the very commonest amounts (the round BTC ones) are made celebrities.
+			runConfig.CelebCoverage = 0.05
+			if err := jobs.GatherStatisticsFromChain(context.Background(), chain, rand.New(rand.NewSource(1)), runConfig); err != nil {
+				t.Fatal(err)
+			}
+
+			file, err := amounts.OpenFile(runConfig.Amounts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			checkFees(t, file, config)
+
+			microEpochs, err := calendar.NewEpochs(runConfig.MicroEpoch, blockTimes(t, chain, TEST_BLOCKS))
+			if err != nil {
+				t.Fatal(err)
+			}
+			anchors := readAnchors(t, "Oracle.csv")
+			checkPhases(t, config.GroundTruthPhases(microEpochs), func(me int) (float64, bool) {
+				anchor, ok := anchors[me]
+				return anchor, ok
+			})
+		})
+	}
+}
+
+// checkFees checks the fees from a source against how the generator chose them: no more than MaxFee, and the
+// coinbase (the first transaction) claiming exactly the subsidy plus the block's fees
+func checkFees(t *testing.T, source amounts.Source, config synthetic.GeneratorConfig) {
+	t.Helper()
+	if source.Blocks() != config.Blocks {
+		t.Fatalf("%d blocks, want %d", source.Blocks(), config.Blocks)
+	}
+	for h := int64(0); h < config.Blocks; h++ {
+		fees, err := source.BlockFees(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fees[0] != 0 {
+			t.Fatalf("block %d: the coinbase left %d sats unclaimed", h, fees[0])
+		}
+		for n, fee := range fees[1:] {
+			if fee < 0 || fee > config.MaxFee {
+				t.Fatalf("block %d transaction %d: fee %d, want 0 to %d", h, n+1, fee, config.MaxFee)
+			}
+		}
+	}
+}
+
+// readAnchors reads the anchor phase of each micro-epoch from Oracle.csv
+func readAnchors(t *testing.T, filename string) map[int]float64 {
+	t.Helper()
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	anchors := make(map[int]float64)
+	for _, row := range rows[1:] {
+		me, err := strconv.Atoi(row[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		anchors[me], err = strconv.ParseFloat(row[2], 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return anchors
+}